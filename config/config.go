@@ -4,6 +4,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/tkanos/gonfig"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 )
@@ -12,13 +13,132 @@ type Configuration struct {
 	UploadDir string `env:"UPLOAD_DIR"`
 	Host      string `env:"HOST"`
 	Port      int    `env:"APP_PORT"`
-	DbHost    string `env:"DB_HOST"` // Defaults to localhost
-	DbPort    int    `env:"DB_PORT"` // Defaults to 3306
+	DbDriver  string `env:"DB_DRIVER"` // mysql, postgres or sqlite. Defaults to mysql
+	DbHost    string `env:"DB_HOST"`   // Defaults to localhost
+	DbPort    int    `env:"DB_PORT"`   // Defaults to 3306 for mysql and 5432 for postgres
 	DbUser    string `env:"DB_USER"`
 	DbPass    string `env:"DB_PASS"`
-	DbName    string `env:"DB_NAME"`
+	DbName    string `env:"DB_NAME"` // For sqlite, the path of the db file. Defaults to <UploadDir>/gocleancode.db
+	// Apply the pending schema migrations at startup. Always done for sqlite.
+	DbAutoMigrate bool `env:"DB_AUTO_MIGRATE"`
+	// Connection pool. 0 means the database/sql default. Durations are in seconds.
+	DbMaxOpenConns    int `env:"DB_MAX_OPEN_CONNS"`
+	DbMaxIdleConns    int `env:"DB_MAX_IDLE_CONNS"`
+	DbConnMaxLifetime int `env:"DB_CONN_MAX_LIFETIME"`
+	DbConnMaxIdleTime int `env:"DB_CONN_MAX_IDLE_TIME"`
+	DbDialTimeout     int `env:"DB_DIAL_TIMEOUT"`  // In seconds
+	DbReadTimeout     int `env:"DB_READ_TIMEOUT"`  // In seconds. mysql only
+	DbWriteTimeout    int `env:"DB_WRITE_TIMEOUT"` // In seconds. mysql only
+	DbQueryTimeout    int `env:"DB_QUERY_TIMEOUT"` // In seconds. Bounds each query and transaction. Defaults to 30
+	// disable, require (encrypt without verifying the server), verify-ca or verify-full (also verify the host name).
+	// Defaults to disable. The client certificate is optional.
+	DbTlsMode   string `env:"DB_TLS_MODE"`
+	DbTlsCa     string `env:"DB_TLS_CA"`    // Path of the CA certificate used to verify the server
+	DbTlsCert   string `env:"DB_TLS_CERT"`  // Path of the client certificate
+	DbTlsKey    string `env:"DB_TLS_KEY"`   // Path of the client certificate's key
+	DbCharset   string `env:"DB_CHARSET"`   // mysql only. Eg, utf8mb4
+	DbCollation string `env:"DB_COLLATION"` // mysql only. Eg, utf8mb4_unicode_ci
+	DbTimeZone  string `env:"DB_TIME_ZONE"` // Eg, UTC or Asia/Manila. Defaults to UTC for mysql and the server time zone for postgres
+	// Bound the storing of an upload and the streaming of a download, in seconds. 0 means no timeout.
+	UploadTimeout   int `env:"UPLOAD_TIMEOUT"`
+	DownloadTimeout int `env:"DOWNLOAD_TIMEOUT"`
+	// Token required by the /admin endpoints as "Authorization: Bearer <token>". The endpoints are disabled if empty.
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// Antivirus scanning of uploads is enabled if set. Eg, tcp://localhost:3310 or unix:///var/run/clamav/clamd.ctl
+	ClamdAddress  string `env:"CLAMD_ADDRESS"`
+	ClamdTimeout  int    `env:"CLAMD_TIMEOUT"`  // In seconds. Defaults to 60
+	QuarantineDir string `env:"QUARANTINE_DIR"` // Infected files are moved here. Defaults to <UploadDir>/.quarantine
+	// The upload dir is reconciled with the files table periodically if set. See services.Reconcile.
+	ReconcileInterval int    `env:"RECONCILE_INTERVAL"` // In seconds
+	ReconcileOrphans  string `env:"RECONCILE_ORPHANS"`  // report, quarantine or delete. Defaults to report
+	ReconcileDryRun   bool   `env:"RECONCILE_DRY_RUN"`
+	// The blobs are periodically verified against their checksum if set. See services.ScrubFiles.
+	ScrubInterval       int   `env:"SCRUB_INTERVAL"`         // In seconds
+	ScrubBytesPerSecond int64 `env:"SCRUB_BYTES_PER_SECOND"` // Defaults to 10MiB. -1 means unlimited
+	// Levels of sub directories that the blobs are spread over within a bucket, eg ab/cd/<blob> for 2. Defaults to 2.
+	// -1 stores the blobs directly in the bucket dir. Run the migrate-layout command after changing it.
+	ShardDepth int `env:"SHARD_DEPTH"`
+	// S3 compatible store used by the secondary and cold storages
+	S3Endpoint    string `env:"S3_ENDPOINT"` // Eg, s3.amazonaws.com or localhost:9000
+	S3AccessKeyId string `env:"S3_ACCESS_KEY_ID"`
+	S3SecretKey   string `env:"S3_SECRET_KEY"`
+	S3Region      string `env:"S3_REGION"`
+	S3DisableTls  bool   `env:"S3_DISABLE_TLS"`
+	// Uploads are also written to a secondary storage if either is set: a bucket of the S3 store, or else a dir
+	// mirroring UploadDir, eg a second disk. Reads fall back to it and the scrubber restores corrupt blobs from it.
+	S3Bucket        string `env:"S3_BUCKET"`
+	ReplicaDir      string `env:"REPLICA_DIR"`
+	ReplicationMode string `env:"REPLICATION_MODE"` // sync (uploads fail if the secondary does) or async. Defaults to async
+	// Cold storage that the lifecycle rules transition the files to: a bucket of the S3 store, or else a dir mirroring
+	// UploadDir, eg a slower disk.
+	ColdS3Bucket string `env:"COLD_S3_BUCKET"`
+	ColdDir      string `env:"COLD_DIR"`
+	// Bucket of the S3 store that the files can be moved to from UploadDir with the migrate-storage command. The files
+	// moved there are served, scrubbed and transitioned like those in UploadDir.
+	RemoteS3Bucket string `env:"REMOTE_S3_BUCKET"`
+	// The lifecycle rules are applied periodically if set. See services.ApplyLifecycleRules.
+	LifecycleInterval int `env:"LIFECYCLE_INTERVAL"` // In seconds
+	LifecycleRules    []LifecycleRule
+	// The blobs of the content types matching a rule are compressed with its encoding. The first matching rule applies.
+	CompressionRules []CompressionRule
+	// Images of more pixels are rejected rather than decoded to generate their thumbnails or transform them. Defaults to
+	// 50 million.
+	MaxImagePixels int64 `env:"MAX_IMAGE_PIXELS"`
+	// Transformations of the images resulting in more pixels are rejected. Defaults to 25 million.
+	MaxOutputImagePixels int64 `env:"MAX_OUTPUT_IMAGE_PIXELS"`
+	// Widths and heights of the thumbnails that are cached. The thumbnails of other sizes are generated on each request.
+	// Defaults to 64, 128, 256, 512 and 1024.
+	ThumbnailSizes []int
+	// Cached thumbnails and transformed images kept per file, the oldest are evicted beyond. Defaults to 16. -1
+	// disables the cache.
+	MaxDerivativesPerFile int `env:"MAX_DERIVATIVES_PER_FILE"`
+	// Encryption at rest is enabled if set. MasterKeys maps a key id to a base64 encoded 256 bit key.
+	// Keep the retired keys so the files they wrapped can still be decrypted.
+	ActiveMasterKeyId string `env:"ACTIVE_MASTER_KEY_ID"`
+	MasterKeys        map[string]string
+	// Buckets maps a bucket name to its settings. The default bucket always exists.
+	Buckets      map[string]BucketConfig
+	UploadPolicy UploadPolicy
 }
 
+// UploadPolicy applies to every bucket, on top of the bucket's own settings.
+type UploadPolicy struct {
+	MaxFileSize       int64    // In bytes. 0 means unlimited.
+	AllowedTypes      []string // Checked against the type detected from the contents. Empty means any type.
+	DeniedTypes       []string
+	AllowedExtensions []string // Eg, [".pdf", ".png"]. Empty means any extension.
+	DeniedExtensions  []string
+}
+
+// LifecycleRule transitions or expires the files that match all of its conditions.
+type LifecycleRule struct {
+	Bucket       string   // Empty means any bucket
+	MinAgeDays   int      // Days since the upload
+	ContentTypes []string // Eg, ["image/*", "application/pdf"]. Empty means any type.
+	Tags         []string // The file must have one of them. Empty means any tags.
+	Action       string   // transition (to the cold storage) or expire
+}
+
+// CompressionRule compresses the blobs of the matching content types.
+type CompressionRule struct {
+	ContentTypes []string // Eg, ["text/*", "application/json"]
+	Encoding     string   // gzip or zstd
+}
+
+type BucketConfig struct {
+	StoragePrefix string   // Sub directory of UploadDir. Defaults to the bucket name.
+	MaxFileSize   int64    // In bytes. 0 means unlimited.
+	AllowedTypes  []string // Eg, ["image/*", "application/pdf"]. Empty means any type.
+	RetentionDays int      // Files older than this are purged. 0 means keep forever.
+	// Quotas of the whole bucket and of each owner within the bucket. 0 means unlimited.
+	QuotaBytes      int64
+	QuotaFiles      int64
+	OwnerQuotaBytes int64
+	OwnerQuotaFiles int64
+}
+
+const DefaultBucket = "default"
+
 func New() Configuration {
 	config := Configuration{}
 	configPath := getConfigPath()
@@ -33,12 +153,59 @@ func New() Configuration {
 	if config.DbHost == "" {
 		config.DbHost = "127.0.0.1"
 	}
-	if config.DbPort == 0 {
+	if config.DbPort == 0 && config.DbDriver == "postgres" {
+		config.DbPort = 5432
+	} else if config.DbPort == 0 {
 		config.DbPort = 3306
 	}
+	if config.DbDriver == "sqlite" && config.DbName == "" {
+		config.DbName = filepath.Join(config.UploadDir, "gocleancode.db")
+	}
+	if config.DbQueryTimeout == 0 {
+		config.DbQueryTimeout = 30
+	}
+	if config.ClamdTimeout == 0 {
+		config.ClamdTimeout = 60
+	}
+	if config.ScrubBytesPerSecond == 0 {
+		config.ScrubBytesPerSecond = 10 << 20
+	}
+	if config.ReconcileOrphans == "" {
+		config.ReconcileOrphans = "report"
+	}
+	if config.ReplicationMode == "" {
+		config.ReplicationMode = "async"
+	}
+	if config.ShardDepth == 0 {
+		config.ShardDepth = 2
+	}
+	if config.MaxImagePixels == 0 {
+		config.MaxImagePixels = 50_000_000
+	}
+	if config.MaxOutputImagePixels == 0 {
+		config.MaxOutputImagePixels = 25_000_000
+	}
+	if len(config.ThumbnailSizes) == 0 {
+		config.ThumbnailSizes = []int{64, 128, 256, 512, 1024}
+	}
+	if config.MaxDerivativesPerFile == 0 {
+		config.MaxDerivativesPerFile = 16
+	}
 	return config
 }
 
+// Bucket returns the settings of the named bucket. The default bucket is always available even if not configured.
+func (config Configuration) Bucket(name string) (BucketConfig, bool) {
+	bucket, ok := config.Buckets[name]
+	if !ok && name != DefaultBucket {
+		return bucket, false
+	}
+	if bucket.StoragePrefix == "" {
+		bucket.StoragePrefix = name
+	}
+	return bucket, true
+}
+
 func getConfigPath() string {
 	env := os.Getenv("ENV")
 	if len(env) == 0 {
@@ -68,7 +235,12 @@ func fillFromEnvVariables(config *Configuration) {
 				kind := f.Kind()
 				if kind == reflect.Int || kind == reflect.Int64 {
 					setStringToInt(f, envVal, 64)
-				} else {
+				} else if kind == reflect.Bool {
+					boolVal, err := strconv.ParseBool(envVal)
+					if err == nil {
+						f.SetBool(boolVal)
+					}
+				} else if kind == reflect.String {
 					f.SetString(envVal)
 				}
 			}
@@ -30,3 +30,15 @@ func TestFillFromEnvironmentVariables(t *testing.T) {
 	assert.Equal(t, expectedDbName, appConfig.DbName)
 	assert.Equal(t, 3306, appConfig.DbPort) // Default
 }
+
+func TestPostgresDefaultPort(t *testing.T) {
+	err := os.Setenv("DB_DRIVER", "postgres")
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+		return
+	}
+	defer os.Unsetenv("DB_DRIVER")
+	appConfig := config.New()
+	assert.Equal(t, "postgres", appConfig.DbDriver)
+	assert.Equal(t, 5432, appConfig.DbPort)
+}
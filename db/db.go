@@ -1,26 +1,32 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"gocleancode/config"
+	_ "modernc.org/sqlite"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type Db interface {
 	Close() error
-	Transact(txFunc func(*sql.Tx) error) (err error)
+	Transact(ctx context.Context, txFunc func(*sql.Tx) error) (err error)
 }
 
 type DB struct {
 	*sql.DB
 	DataSourceName string
+	Dialect        Dialect       // Defaults to MySQL if nil
+	QueryTimeout   time.Duration // Bounds each query and transaction. 0 means no timeout
 }
 
 var instances []Db
@@ -39,35 +45,116 @@ func init() {
 		}
 	}()
 }
+
+// NewDb connects to the database of the driver selected by Configuration.DbDriver. Defaults to mysql.
+func NewDb(config config.Configuration) (DB, error) {
+	driver := config.DbDriver
+	if driver == "" {
+		driver = MySQL.Name()
+	}
+	dialect, ok := dialects[driver]
+	if !ok {
+		return DB{}, errors.New("Unsupported database driver " + driver)
+	}
+	return open(config, dialect)
+}
+
 func NewMysqlDb(config config.Configuration) (DB, error) {
-	ds := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", config.DbUser, config.DbPass, config.DbHost, strconv.Itoa(config.DbPort), config.DbName)
+	return open(config, MySQL)
+}
+
+func NewPostgresDb(config config.Configuration) (DB, error) {
+	return open(config, Postgres)
+}
+
+// NewSqliteDb opens the sqlite db at config.DbName, creating the file if needed.
+func NewSqliteDb(config config.Configuration) (DB, error) {
+	return open(config, SQLite)
+}
+
+func open(config config.Configuration, dialect Dialect) (DB, error) {
+	ds, err := dialect.DataSourceName(config)
+	if err != nil {
+		return DB{}, err
+	}
+	if dialect == SQLite {
+		err = os.MkdirAll(filepath.Dir(config.DbName), os.ModePerm)
+		if err != nil {
+			return DB{}, err
+		}
+	}
 
-	db, err := sql.Open("mysql", ds)
-	_db := DB{db, ds}
+	db, err := sql.Open(dialect.Name(), ds)
+	_db := DB{db, ds, dialect, seconds(config.DbQueryTimeout)}
 
 	instances = append(instances, _db)
 
 	if err != nil {
 		return _db, err
 	}
+	db.SetMaxOpenConns(config.DbMaxOpenConns)
+	if config.DbMaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.DbMaxIdleConns)
+	}
+	db.SetConnMaxLifetime(seconds(config.DbConnMaxLifetime))
+	db.SetConnMaxIdleTime(seconds(config.DbConnMaxIdleTime))
 
 	err = db.Ping() // Check if can connect to db
 	if err != nil {
 		log.Error(err)
 		return _db, errors.New("Cannot connect to " + ds)
+	} else if dialect == SQLite {
+		log.Info("Successfully opened sqlite db " + config.DbName)
 	} else {
-		log.Info(fmt.Sprintf("Successfully connected to %s:%v/%s", config.DbHost, config.DbPort, config.DbName))
+		log.Info(fmt.Sprintf("Successfully connected to %s %s:%v/%s", dialect.Name(), config.DbHost, config.DbPort, config.DbName))
 	}
 	return _db, err
 }
 
+func (db DB) dialect() Dialect {
+	if db.Dialect == nil {
+		return MySQL
+	}
+	return db.Dialect
+}
+
+// Rebind converts a query written with ? placeholders to the placeholders of the db's dialect.
+func (db DB) Rebind(query string) string {
+	return db.dialect().Rebind(query)
+}
+
+// Insert executes the insert statement and returns the id generated for the new row.
+func (db DB) Insert(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	return db.dialect().Insert(ctx, db.DB, query, args...)
+}
+
+// TxInsert is Insert within the transaction.
+func (db DB) TxInsert(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	return db.dialect().Insert(ctx, tx, query, args...)
+}
+
+// TxLock acquires a named lock that is held until the transaction ends.
+func (db DB) TxLock(ctx context.Context, tx *sql.Tx, name string) error {
+	return db.dialect().TxLock(ctx, tx, name)
+}
+
+// WithTimeout bounds the context by the query timeout of the db.
+func (db DB) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
 func (db DB) Close() error {
 	log.Info("Closing db " + db.DataSourceName)
 	return db.DB.Close()
 }
 
-func (db DB) Transact(txFunc func(*sql.Tx) error) (err error) {
-	tx, err := db.Begin()
+func (db DB) Transact(ctx context.Context, txFunc func(*sql.Tx) error) (err error) {
+	ctx, cancel := db.WithTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		log.Error(err)
 		return err
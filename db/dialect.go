@@ -0,0 +1,281 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"gocleancode/config"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect hides the differences between the supported databases. Queries are written with ? placeholders and
+// rebound to the placeholders of the dialect.
+type Dialect interface {
+	// Name is the name of the database/sql driver. It's also the value of Configuration.DbDriver.
+	Name() string
+	DataSourceName(config config.Configuration) (string, error)
+	Rebind(query string) string
+	// Insert executes the insert statement and returns the id generated for the new row.
+	Insert(ctx context.Context, db preparer, query string, args ...interface{}) (int64, error)
+	// Lock acquires a named lock that is held by the connection until Unlock. It serializes work, like migrations,
+	// across the instances sharing the db.
+	Lock(conn *sql.Conn, name string) error
+	Unlock(conn *sql.Conn, name string) error
+	// TxLock acquires a named lock that is held until the transaction ends. It serializes transactions, like the quota
+	// checks of the uploads, across the instances sharing the db.
+	TxLock(ctx context.Context, tx *sql.Tx, name string) error
+}
+
+type preparer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+var (
+	MySQL    Dialect = mysqlDialect{}
+	Postgres Dialect = postgresDialect{}
+	SQLite   Dialect = sqliteDialect{}
+	dialects         = map[string]Dialect{MySQL.Name(): MySQL, Postgres.Name(): Postgres, SQLite.Name(): SQLite}
+)
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) DataSourceName(config config.Configuration) (string, error) {
+	mysqlConfig := mysql.NewConfig()
+	mysqlConfig.User = config.DbUser
+	mysqlConfig.Passwd = config.DbPass
+	mysqlConfig.Net = "tcp"
+	mysqlConfig.Addr = fmt.Sprintf("%s:%d", config.DbHost, config.DbPort)
+	mysqlConfig.DBName = config.DbName
+	mysqlConfig.ParseTime = true
+	mysqlConfig.Timeout = seconds(config.DbDialTimeout)
+	mysqlConfig.ReadTimeout = seconds(config.DbReadTimeout)
+	mysqlConfig.WriteTimeout = seconds(config.DbWriteTimeout)
+	mysqlConfig.Params = map[string]string{}
+	if config.DbCharset != "" {
+		mysqlConfig.Params["charset"] = config.DbCharset
+	}
+	if config.DbCollation != "" {
+		mysqlConfig.Collation = config.DbCollation
+	}
+	if config.DbTimeZone != "" {
+		loc, err := time.LoadLocation(config.DbTimeZone)
+		if err != nil {
+			return "", err
+		}
+		mysqlConfig.Loc = loc
+		// The server converts the TIMESTAMP columns in the time zone of the session, which must be the one the driver
+		// parses them in. Named zones other than UTC need the time zone tables of the server to be loaded
+		zone := config.DbTimeZone
+		if loc == time.UTC {
+			zone = "+00:00"
+		}
+		mysqlConfig.Params["time_zone"] = "'" + zone + "'"
+	}
+	tlsConfig, err := newTlsConfig(config)
+	if err != nil {
+		return "", err
+	}
+	if tlsConfig != nil {
+		// The driver looks up TLS configs by the name in the DSN
+		err = mysql.RegisterTLSConfig(mysqlTlsConfigName, tlsConfig)
+		if err != nil {
+			return "", err
+		}
+		mysqlConfig.TLSConfig = mysqlTlsConfigName
+	}
+	return mysqlConfig.FormatDSN(), nil
+}
+
+func (mysqlDialect) Rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) Insert(ctx context.Context, db preparer, query string, args ...interface{}) (int64, error) {
+	return insertWithLastInsertId(ctx, db, query, args...)
+}
+
+func (mysqlDialect) Lock(conn *sql.Conn, name string) error {
+	var acquired sql.NullInt64
+	err := conn.QueryRowContext(context.Background(), "SELECT GET_LOCK(?, ?)", name, lockTimeoutSeconds).Scan(&acquired)
+	if err != nil {
+		return err
+	}
+	if acquired.Int64 != 1 {
+		return errors.New("Timed out waiting for lock " + name)
+	}
+	return nil
+}
+
+func (mysqlDialect) Unlock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+	return err
+}
+
+// TxLock writes the row of the lock in the transaction_locks table, which keeps it locked until the transaction ends.
+// GET_LOCK locks are held by the connection instead.
+func (mysqlDialect) TxLock(ctx context.Context, tx *sql.Tx, name string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO transaction_locks(name) VALUES(?) ON DUPLICATE KEY UPDATE name = name", name)
+	return err
+}
+
+func insertWithLastInsertId(ctx context.Context, db preparer, query string, args ...interface{}) (int64, error) {
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+const lockTimeoutSeconds = 300
+
+const mysqlTlsConfigName = "gocleancode"
+
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) DataSourceName(config config.Configuration) (string, error) {
+	params := url.Values{}
+	switch config.DbTlsMode {
+	case "":
+		params.Set("sslmode", TlsDisable)
+	case TlsDisable, TlsRequire, TlsVerifyCa, TlsVerifyFull:
+		params.Set("sslmode", config.DbTlsMode)
+	default:
+		return "", errors.New("Unsupported db TLS mode " + config.DbTlsMode)
+	}
+	// The driver loads the certificates itself
+	if config.DbTlsCa != "" {
+		params.Set("sslrootcert", config.DbTlsCa)
+	}
+	if config.DbTlsCert != "" {
+		params.Set("sslcert", config.DbTlsCert)
+		params.Set("sslkey", config.DbTlsKey)
+	}
+	if config.DbDialTimeout > 0 {
+		params.Set("connect_timeout", strconv.Itoa(config.DbDialTimeout))
+	}
+	if config.DbTimeZone != "" {
+		params.Set("timezone", config.DbTimeZone)
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(config.DbUser, config.DbPass),
+		Host:     fmt.Sprintf("%s:%d", config.DbHost, config.DbPort),
+		Path:     config.DbName,
+		RawQuery: params.Encode(),
+	}
+	return dsn.String(), nil
+}
+
+// Rebind replaces the ? placeholders with $1, $2, etc. Question marks in quoted strings are left as is.
+func (postgresDialect) Rebind(query string) string {
+	rebound := strings.Builder{}
+	index := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			index++
+			rebound.WriteString("$" + strconv.Itoa(index))
+			continue
+		}
+		rebound.WriteRune(c)
+	}
+	return rebound.String()
+}
+
+// Insert relies on RETURNING id since the postgres driver doesn't support LastInsertId.
+func (d postgresDialect) Insert(ctx context.Context, db preparer, query string, args ...interface{}) (int64, error) {
+	var id int64
+	stmt, err := db.PrepareContext(ctx, d.Rebind(query)+" RETURNING id")
+	if err != nil {
+		return id, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRowContext(ctx, args...).Scan(&id)
+	return id, err
+}
+
+// Lock uses an advisory lock, which is identified by a number rather than a name.
+func (postgresDialect) Lock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock($1)", advisoryLockKey(name))
+	return err
+}
+
+func (postgresDialect) Unlock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockKey(name))
+	return err
+}
+
+func (postgresDialect) TxLock(ctx context.Context, tx *sql.Tx, name string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", advisoryLockKey(name))
+	return err
+}
+
+func advisoryLockKey(name string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return int64(hash.Sum64())
+}
+
+// sqliteDialect uses the pure Go driver, so the service can run without a database server. The database is the file
+// at Configuration.DbName.
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// DataSourceName waits for the locks held by concurrent writers instead of failing, and stores the timestamps in a
+// format that sorts chronologically. Transactions take the write lock when they begin rather than failing to upgrade
+// their read lock later.
+func (sqliteDialect) DataSourceName(config config.Configuration) (string, error) {
+	return "file:" + config.DbName + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate", nil
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) Insert(ctx context.Context, db preparer, query string, args ...interface{}) (int64, error) {
+	return insertWithLastInsertId(ctx, db, query, args...)
+}
+
+// Lock does nothing since sqlite has a single writer. The transactions begin immediately, ie they wait for the write
+// lock upfront, so work done in a transaction is already serialized.
+func (sqliteDialect) Lock(conn *sql.Conn, name string) error {
+	return nil
+}
+
+func (sqliteDialect) Unlock(conn *sql.Conn, name string) error {
+	return nil
+}
+
+// TxLock does nothing, the transactions are serialized like for Lock.
+func (sqliteDialect) TxLock(ctx context.Context, tx *sql.Tx, name string) error {
+	return nil
+}
@@ -0,0 +1,307 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/db"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each dialect has its own directory of migrations named <version>_<name>.up.sql and <version>_<name>.down.sql. The
+// dialects must have the same versions.
+//
+//go:embed mysql/*.sql postgres/*.sql sqlite/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// lockName identifies the lock that keeps concurrent instances from migrating at the same time.
+const lockName = "gocleancode_schema_migrations"
+
+var ErrUnknownVersion = errors.New("unknown schema version")
+
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string // Empty if the migration can't be rolled back
+}
+
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedDt *time.Time // nil if not applied
+}
+
+// Migrator applies the migrations of the db's dialect and records the applied versions in the schema_migrations table.
+type Migrator struct {
+	db         db.DB
+	dialect    db.Dialect
+	migrations []Migration
+}
+
+func NewMigrator(appDb db.DB) (Migrator, error) {
+	dialect := appDb.Dialect
+	if dialect == nil {
+		dialect = db.MySQL
+	}
+	migrations, err := loadMigrations(dialect.Name())
+	return Migrator{appDb, dialect, migrations}, err
+}
+
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, errors.New("Invalid migration file name " + entry.Name())
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		contents, err := fs.ReadFile(migrationFiles, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if match[3] == "up" {
+			migration.up = string(contents)
+		} else {
+			migration.down = string(contents)
+		}
+	}
+	var migrations []Migration
+	for _, migration := range byVersion {
+		if migration.up == "" {
+			return nil, fmt.Errorf("Migration %d has no up file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (m Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// LatestVersion returns the version of the last migration.
+func (m Migrator) LatestVersion() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all the pending migrations.
+func (m Migrator) Up() error {
+	return m.MigrateTo(m.LatestVersion())
+}
+
+// Down rolls back the last applied migration.
+func (m Migrator) Down() error {
+	return m.withLock(func(conn *sql.Conn) error {
+		version, err := currentVersion(conn)
+		if err != nil {
+			return err
+		}
+		previous := int64(0)
+		for _, migration := range m.migrations {
+			if migration.Version < version {
+				previous = migration.Version
+			}
+		}
+		return m.migrateTo(conn, previous)
+	})
+}
+
+// MigrateTo applies or rolls back migrations until the schema is at the given version. Version 0 rolls back all.
+func (m Migrator) MigrateTo(version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return ErrUnknownVersion
+	}
+	return m.withLock(func(conn *sql.Conn) error {
+		return m.migrateTo(conn, version)
+	})
+}
+
+// Status lists the migrations and when they were applied.
+func (m Migrator) Status() ([]Status, error) {
+	var statuses []Status
+	err := m.withLock(func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(context.Background(), "SELECT version, applied_dt from schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		appliedDts := map[int64]time.Time{}
+		for rows.Next() {
+			var version int64
+			var appliedDt time.Time
+			err = rows.Scan(&version, &appliedDt)
+			if err != nil {
+				return err
+			}
+			appliedDts[version] = appliedDt
+		}
+		for _, migration := range m.migrations {
+			status := Status{Version: migration.Version, Name: migration.Name}
+			if appliedDt, ok := appliedDts[migration.Version]; ok {
+				status.AppliedDt = &appliedDt
+			}
+			statuses = append(statuses, status)
+		}
+		return rows.Err()
+	})
+	return statuses, err
+}
+
+func (m Migrator) find(version int64) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// withLock runs the function on a connection holding the migrations lock, after creating the schema_migrations table.
+func (m Migrator) withLock(lockedFunc func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = m.dialect.Lock(conn, lockName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlockErr := m.dialect.Unlock(conn, lockName)
+		if unlockErr != nil {
+			log.Error(fmt.Sprintf("Failed to release the %s lock. %v", lockName, unlockErr))
+		}
+	}()
+	_, err = conn.ExecContext(context.Background(), "CREATE TABLE IF NOT EXISTS schema_migrations ("+
+		"version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_dt TIMESTAMP NOT NULL)")
+	if err != nil {
+		return err
+	}
+	return lockedFunc(conn)
+}
+
+// migrateTo applies or rolls back one migration per transaction. The current version is read again in each
+// transaction, so a migration that another instance applied in the meantime is not applied twice.
+func (m Migrator) migrateTo(conn *sql.Conn, target int64) error {
+	for {
+		done, err := m.step(conn, target)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (m Migrator) step(conn *sql.Conn, target int64) (bool, error) {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return false, err
+	}
+	version, err := currentVersion(tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	switch {
+	case version < target:
+		err = m.apply(tx, m.next(version))
+	case version > target:
+		err = m.rollback(tx, version)
+	default:
+		return true, tx.Rollback()
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+func (m Migrator) next(version int64) Migration {
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			return migration
+		}
+	}
+	return Migration{} // Unreachable since the target version exists
+}
+
+func (m Migrator) apply(tx *sql.Tx, migration Migration) error {
+	log.Info(fmt.Sprintf("Applying migration %d_%s", migration.Version, migration.Name))
+	err := execStatements(tx, migration.up)
+	if err != nil {
+		return fmt.Errorf("Failed to apply migration %d_%s. %v", migration.Version, migration.Name, err)
+	}
+	_, err = tx.Exec(m.db.Rebind("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)"),
+		migration.Version, migration.Name, time.Now().UTC())
+	return err
+}
+
+func (m Migrator) rollback(tx *sql.Tx, version int64) error {
+	migration := m.find(version)
+	if migration == nil {
+		return fmt.Errorf("Applied migration %d is unknown to this build", version)
+	}
+	if migration.down == "" {
+		return fmt.Errorf("Migration %d_%s can't be rolled back", migration.Version, migration.Name)
+	}
+	log.Info(fmt.Sprintf("Rolling back migration %d_%s", migration.Version, migration.Name))
+	err := execStatements(tx, migration.down)
+	if err != nil {
+		return fmt.Errorf("Failed to roll back migration %d_%s. %v", migration.Version, migration.Name, err)
+	}
+	_, err = tx.Exec(m.db.Rebind("DELETE from schema_migrations where version = ?"), version)
+	return err
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func currentVersion(db queryer) (int64, error) {
+	var version int64
+	err := db.QueryRowContext(context.Background(), "SELECT COALESCE(MAX(version), 0) from schema_migrations").Scan(&version)
+	return version, err
+}
+
+// execStatements runs the statements of a migration file one by one since not all drivers support multiple
+// statements per query. Statements are separated by a semicolon at the end of a line.
+func execStatements(tx *sql.Tx, statements string) error {
+	for _, statement := range strings.Split(statements, ";\n") {
+		statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+		if statement == "" {
+			continue
+		}
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package migrations_test
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	myDb "gocleancode/db"
+	"gocleancode/db/migrations"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestDialectsHaveTheSameMigrations(t *testing.T) {
+	var versions [][]int64
+	for _, dialect := range []myDb.Dialect{myDb.MySQL, myDb.Postgres, myDb.SQLite} {
+		migrator, err := migrations.NewMigrator(myDb.DB{Dialect: dialect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dialectVersions []int64
+		for _, migration := range migrator.Migrations() {
+			dialectVersions = append(dialectVersions, migration.Version)
+		}
+		versions = append(versions, dialectVersions)
+	}
+	assert.NotEmpty(t, versions[0])
+	assert.Equal(t, versions[0], versions[1])
+	assert.Equal(t, versions[0], versions[2])
+}
+
+func TestUp(t *testing.T) {
+	// Given
+	mockDb, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal("an error was not expected when opening a stub database connection", err)
+	}
+	defer mockDb.Close()
+	migrator, err := migrations.NewMigrator(myDb.DB{DB: mockDb, DataSourceName: "mockdb", Dialect: myDb.MySQL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(?, ?)")).
+		WithArgs("gocleancode_schema_migrations", 300).
+		WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS files")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(1, "create_files", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	for _, statement := range []string{"ALTER TABLE files ADD COLUMN bucket", "CREATE INDEX files_bucket_created_dt"} {
+		mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(2, "add_files_bucket", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(2))
+	for _, statement := range []string{"ALTER TABLE files ADD COLUMN owner", "ALTER TABLE files ADD COLUMN size", "CREATE INDEX files_bucket_owner"} {
+		mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(3, "add_files_owner_and_size", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(3))
+	for _, statement := range []string{"ALTER TABLE files ADD COLUMN scan_status", "CREATE INDEX files_scan_status"} {
+		mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(4, "add_files_scan_status", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(4))
+	for _, column := range []string{"encryption_key_id", "wrapped_key"} {
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE files ADD COLUMN " + column)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(5, "add_files_encryption_keys", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(5))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS pending_deletions")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(6, "create_pending_deletions", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(6, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(6))
+	for _, column := range []string{"checksum", "integrity_status", "scrubbed_dt"} {
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE files ADD COLUMN " + column)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(7, "add_files_checksum", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(7))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE files ADD COLUMN replication_status")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX files_replication_status")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(8, "add_files_replication_status", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(8, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(8))
+	for _, statement := range []string{"ALTER TABLE files ADD COLUMN backend", "ALTER TABLE files ADD COLUMN tags", "ALTER TABLE pending_deletions ADD COLUMN backend"} {
+		mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(9, "add_files_backend_and_tags", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(9))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE files ADD COLUMN expires_dt")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX files_expires_dt")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(10, "add_files_expires_dt", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(10, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(10))
+	for _, statement := range []string{"ALTER TABLE files ADD COLUMN retention_until_dt", "ALTER TABLE files ADD COLUMN legal_hold", "CREATE TABLE IF NOT EXISTS audit_log"} {
+		mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(11, "add_files_retention", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(11))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE files ADD COLUMN content_encoding")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(12, "add_files_content_encoding", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(12, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(12))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS transaction_locks")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name, applied_dt) VALUES(?, ?, ?)")).
+		WithArgs(13, "create_transaction_locks", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(13, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(13))
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT RELEASE_LOCK(?)")).WithArgs("gocleancode_schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	// When
+	err = migrator.Up()
+	// Then
+	assert.Nil(t, err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDown(t *testing.T) {
+	// Given
+	mockDb, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal("an error was not expected when opening a stub database connection", err)
+	}
+	defer mockDb.Close()
+	migrator, err := migrations.NewMigrator(myDb.DB{DB: mockDb, DataSourceName: "mockdb", Dialect: myDb.Postgres})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE files")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE from schema_migrations where version = $1")).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	// When
+	err = migrator.Down()
+	// Then
+	assert.Nil(t, err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateToUnknownVersion(t *testing.T) {
+	migrator, err := migrations.NewMigrator(myDb.DB{Dialect: myDb.SQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrator.MigrateTo(9999)
+	assert.Equal(t, migrations.ErrUnknownVersion, err)
+}
+
+// The mysql TIMESTAMP columns can't hold the dates after 2038-01-19, which the expiries and retentions may be set to.
+func TestMySQLFutureDatesAreDatetime(t *testing.T) {
+	paths, err := filepath.Glob("mysql/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	column := regexp.MustCompile(`ADD COLUMN (expires_dt|retention_until_dt) (\w+)`)
+	var declared []string
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range column.FindAllStringSubmatch(string(contents), -1) {
+			declared = append(declared, match[1])
+			assert.Equal(t, "DATETIME", match[2], match[1])
+		}
+	}
+	assert.ElementsMatch(t, []string{"expires_dt", "retention_until_dt"}, declared)
+}
@@ -0,0 +1,2 @@
+DROP INDEX files_bucket_created_dt ON files;
+ALTER TABLE files DROP COLUMN bucket;
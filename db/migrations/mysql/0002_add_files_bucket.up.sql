@@ -0,0 +1,2 @@
+ALTER TABLE files ADD COLUMN bucket VARCHAR(63) NOT NULL DEFAULT 'default';
+CREATE INDEX files_bucket_created_dt ON files (bucket, created_dt);
@@ -0,0 +1,3 @@
+DROP INDEX files_bucket_owner ON files;
+ALTER TABLE files DROP COLUMN size;
+ALTER TABLE files DROP COLUMN owner;
@@ -0,0 +1,5 @@
+-- User that uploaded the file
+ALTER TABLE files ADD COLUMN owner VARCHAR(255);
+-- In bytes. 0 for the files predating the column
+ALTER TABLE files ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX files_bucket_owner ON files (bucket, owner);
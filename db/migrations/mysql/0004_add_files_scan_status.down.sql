@@ -0,0 +1,2 @@
+DROP INDEX files_scan_status ON files;
+ALTER TABLE files DROP COLUMN scan_status;
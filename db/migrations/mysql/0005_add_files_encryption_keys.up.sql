@@ -0,0 +1,4 @@
+-- Id of the master key that wrapped the data key. NULL if not encrypted
+ALTER TABLE files ADD COLUMN encryption_key_id VARCHAR(64);
+-- Base64 encoded data key, encrypted by the master key
+ALTER TABLE files ADD COLUMN wrapped_key VARCHAR(255);
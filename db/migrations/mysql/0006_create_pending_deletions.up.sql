@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS pending_deletions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    file_path VARCHAR(255) NOT NULL, -- blob to remove once the transaction that recorded it has committed
+    created_dt TIMESTAMP NOT NULL, -- created date time
+    INDEX pending_deletions_created_dt (created_dt)
+);
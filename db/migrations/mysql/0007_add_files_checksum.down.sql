@@ -0,0 +1,3 @@
+ALTER TABLE files DROP COLUMN scrubbed_dt;
+ALTER TABLE files DROP COLUMN integrity_status;
+ALTER TABLE files DROP COLUMN checksum;
@@ -0,0 +1,2 @@
+DROP INDEX files_replication_status ON files;
+ALTER TABLE files DROP COLUMN replication_status;
@@ -0,0 +1,6 @@
+-- Storage backend holding the blob: hot or cold
+ALTER TABLE files ADD COLUMN backend VARCHAR(32) NOT NULL DEFAULT 'hot';
+-- Comma separated tags given on upload, matched by the lifecycle rules
+ALTER TABLE files ADD COLUMN tags VARCHAR(255);
+-- Backend to delete the blob from. NULL means every backend
+ALTER TABLE pending_deletions ADD COLUMN backend VARCHAR(32);
@@ -0,0 +1,2 @@
+DROP INDEX files_expires_dt ON files;
+ALTER TABLE files DROP COLUMN expires_dt;
@@ -0,0 +1,3 @@
+-- When the file stops being served and is swept. NULL means never. Not a TIMESTAMP, which ends in 2038
+ALTER TABLE files ADD COLUMN expires_dt DATETIME NULL;
+CREATE INDEX files_expires_dt ON files (expires_dt);
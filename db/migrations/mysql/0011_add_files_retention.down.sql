@@ -0,0 +1,3 @@
+DROP TABLE audit_log;
+ALTER TABLE files DROP COLUMN legal_hold;
+ALTER TABLE files DROP COLUMN retention_until_dt;
@@ -0,0 +1,2 @@
+-- gzip or zstd if the blob is compressed. NULL if stored as is
+ALTER TABLE files ADD COLUMN content_encoding VARCHAR(16);
@@ -0,0 +1,9 @@
+-- The schema predating the migrations. The later columns are added by the following migrations, so that the existing
+-- tables get them too
+CREATE TABLE IF NOT EXISTS files (
+    id BIGSERIAL PRIMARY KEY,
+    file_name VARCHAR(255) NOT NULL,
+    file_path VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255),
+    created_dt TIMESTAMPTZ NOT NULL -- created date time
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS files_bucket_owner;
+ALTER TABLE files DROP COLUMN size;
+ALTER TABLE files DROP COLUMN owner;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS pending_deletions (
+    id BIGSERIAL PRIMARY KEY,
+    file_path VARCHAR(255) NOT NULL, -- blob to remove once the transaction that recorded it has committed
+    created_dt TIMESTAMPTZ NOT NULL -- created date time
+);
+CREATE INDEX IF NOT EXISTS pending_deletions_created_dt ON pending_deletions (created_dt);
@@ -0,0 +1,6 @@
+-- Hex encoded sha256 of the stored blob
+ALTER TABLE files ADD COLUMN checksum VARCHAR(64);
+-- ok or corrupt. NULL until scrubbed
+ALTER TABLE files ADD COLUMN integrity_status VARCHAR(16);
+-- Last time the blob was verified against the checksum
+ALTER TABLE files ADD COLUMN scrubbed_dt TIMESTAMPTZ NULL;
@@ -0,0 +1,3 @@
+-- pending or replicated. NULL when there is no secondary storage
+ALTER TABLE files ADD COLUMN replication_status VARCHAR(16);
+CREATE INDEX IF NOT EXISTS files_replication_status ON files (replication_status);
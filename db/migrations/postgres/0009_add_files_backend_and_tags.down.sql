@@ -0,0 +1,3 @@
+ALTER TABLE pending_deletions DROP COLUMN backend;
+ALTER TABLE files DROP COLUMN tags;
+ALTER TABLE files DROP COLUMN backend;
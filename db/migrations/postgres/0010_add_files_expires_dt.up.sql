@@ -0,0 +1,3 @@
+-- When the file stops being served and is swept. NULL means never
+ALTER TABLE files ADD COLUMN expires_dt TIMESTAMPTZ NULL;
+CREATE INDEX IF NOT EXISTS files_expires_dt ON files (expires_dt);
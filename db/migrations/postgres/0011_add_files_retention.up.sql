@@ -0,0 +1,15 @@
+-- The file can't be deleted before this time. NULL means no retention
+ALTER TABLE files ADD COLUMN retention_until_dt TIMESTAMPTZ NULL;
+-- The file can't be deleted while on legal hold, whatever its retention
+ALTER TABLE files ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    bucket VARCHAR(255) NOT NULL, -- of the file, whose audit log outlives it
+    file_id BIGINT NOT NULL,
+    action VARCHAR(32) NOT NULL, -- set_retention or set_legal_hold
+    old_value VARCHAR(64),
+    new_value VARCHAR(64),
+    actor VARCHAR(255), -- who made the change
+    created_dt TIMESTAMPTZ NOT NULL -- created date time
+);
+CREATE INDEX IF NOT EXISTS audit_log_bucket_file_id ON audit_log (bucket, file_id);
@@ -0,0 +1,5 @@
+-- Rows locked until the end of a transaction by the mysql TxLock, since mysql has no transaction scoped named locks.
+-- Created for every driver so that the schemas are the same
+CREATE TABLE IF NOT EXISTS transaction_locks (
+    name VARCHAR(255) NOT NULL PRIMARY KEY
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS files_bucket_created_dt;
+ALTER TABLE files DROP COLUMN bucket;
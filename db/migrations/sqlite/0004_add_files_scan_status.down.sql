@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS files_scan_status;
+ALTER TABLE files DROP COLUMN scan_status;
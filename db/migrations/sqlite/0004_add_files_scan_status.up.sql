@@ -0,0 +1,4 @@
+-- pending, clean, infected or error. The files predating the scans are clean, so that they can still be downloaded.
+-- The uploads always set it
+ALTER TABLE files ADD COLUMN scan_status VARCHAR(16) NOT NULL DEFAULT 'clean';
+CREATE INDEX IF NOT EXISTS files_scan_status ON files (scan_status);
@@ -0,0 +1,2 @@
+ALTER TABLE files DROP COLUMN wrapped_key;
+ALTER TABLE files DROP COLUMN encryption_key_id;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS files_replication_status;
+ALTER TABLE files DROP COLUMN replication_status;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS files_expires_dt;
+ALTER TABLE files DROP COLUMN expires_dt;
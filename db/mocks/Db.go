@@ -3,6 +3,7 @@
 package mocks
 
 import mock "github.com/stretchr/testify/mock"
+import context "context"
 import sql "database/sql"
 
 // Db is an autogenerated mock type for the Db type
@@ -24,13 +25,13 @@ func (_m *Db) Close() error {
 	return r0
 }
 
-// Transact provides a mock function with given fields: txFunc
-func (_m *Db) Transact(txFunc func(*sql.Tx) error) error {
-	ret := _m.Called(txFunc)
+// Transact provides a mock function with given fields: ctx, txFunc
+func (_m *Db) Transact(ctx context.Context, txFunc func(*sql.Tx) error) error {
+	ret := _m.Called(ctx, txFunc)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(func(*sql.Tx) error) error); ok {
-		r0 = rf(txFunc)
+	if rf, ok := ret.Get(0).(func(context.Context, func(*sql.Tx) error) error); ok {
+		r0 = rf(ctx, txFunc)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"gocleancode/config"
+	"io/ioutil"
+)
+
+// TLS modes of Configuration.DbTlsMode. These match the sslmode values of postgres.
+const (
+	TlsDisable    = "disable"
+	TlsRequire    = "require"
+	TlsVerifyCa   = "verify-ca"
+	TlsVerifyFull = "verify-full"
+)
+
+// newTlsConfig builds the client TLS config of the mode. It returns nil if TLS is disabled.
+func newTlsConfig(config config.Configuration) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.DbHost}
+	switch config.DbTlsMode {
+	case "", TlsDisable:
+		return nil, nil
+	case TlsRequire:
+		tlsConfig.InsecureSkipVerify = true
+	case TlsVerifyCa:
+		// Verify the certificate chain but not the host name, which crypto/tls can't do on its own
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, tlsConfig.RootCAs)
+		}
+	case TlsVerifyFull:
+	default:
+		return nil, errors.New("Unsupported db TLS mode " + config.DbTlsMode)
+	}
+	if config.DbTlsCa != "" {
+		caCert, err := ioutil.ReadFile(config.DbTlsCa)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("No certificate found in " + config.DbTlsCa)
+		}
+	}
+	if config.DbTlsCert != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.DbTlsCert, config.DbTlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	return tlsConfig, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("The db server sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
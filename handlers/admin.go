@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"gocleancode/services"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit log actor column holds 255 characters, of which the claimed admin name takes at most this many.
+const maxClaimedActorLength = 200
+
+// DbStats reports the connection pool stats. Implemented by *sql.DB.
+type DbStats interface {
+	Stats() sql.DBStats
+}
+
+type DbStatsResponse struct {
+	MaxOpenConnections int   `json:"maxOpenConnections"`
+	OpenConnections    int   `json:"openConnections"`
+	InUse              int   `json:"inUse"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"waitCount"`
+	WaitDurationMs     int64 `json:"waitDurationMs"`
+	MaxIdleClosed      int64 `json:"maxIdleClosed"`
+	MaxIdleTimeClosed  int64 `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed  int64 `json:"maxLifetimeClosed"`
+}
+
+// RetentionRequest changes the protection of a file. Omitted fields are left unchanged.
+type RetentionRequest struct {
+	RetentionUntil *time.Time `json:"retentionUntil"` // RFC 3339. Can only be extended
+	LegalHold      *bool      `json:"legalHold"`
+}
+
+type RetentionResponse struct {
+	FileId         int64      `json:"fileId"`
+	RetentionUntil *time.Time `json:"retentionUntil"`
+	LegalHold      bool       `json:"legalHold"`
+}
+
+type AuditLogEntryResponse struct {
+	Action    string    `json:"action"`
+	OldValue  *string   `json:"oldValue"`
+	NewValue  *string   `json:"newValue"`
+	Actor     *string   `json:"actor"`
+	CreatedDt time.Time `json:"createdDt"`
+}
+
+// requireAdmin lets through the requests bearing the admin token. Admin endpoints are not found if no token is set.
+func (handlers Handlers) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handlers.adminToken == "" {
+			jsonResponse(w, http.StatusNotFound, Response{false, "Admin endpoints are disabled."})
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(handlers.adminToken)) != 1 {
+			jsonResponse(w, http.StatusUnauthorized, Response{false, "Invalid admin token."})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (handlers Handlers) GetDbStats(w http.ResponseWriter, r *http.Request) {
+	stats := handlers.dbStats.Stats()
+	jsonResponse(w, http.StatusOK, DbStatsResponse{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	})
+}
+
+// SetRetention updates the retention and the legal hold of a file. See auditActor for how the change is attributed in
+// the audit log.
+func (handlers Handlers) SetRetention(w http.ResponseWriter, r *http.Request) {
+	fileId := mux.Vars(r)["fileId"]
+	fileIdInt64, err := strconv.ParseInt(fileId, 0, 64)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Response{false, "Unparseable fileId."})
+		return
+	}
+	var request RetentionRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Response{false, "Unparseable retention: " + err.Error()})
+		return
+	}
+	update := services.RetentionUpdate{RetentionUntil: request.RetentionUntil, LegalHold: request.LegalHold}
+	file, err := handlers.fileService.SetRetention(r.Context(), bucketName(r), fileIdInt64, update, auditActor(r))
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to set the retention of file %s. Reason: %v", fileId, err))
+		jsonResponse(w, errorStatusCode(err), Response{false, errorMessage("Failed to set retention!", err)})
+		return
+	}
+	jsonResponse(w, http.StatusOK, RetentionResponse{fileIdInt64, file.RetentionUntilDt, file.LegalHold != nil && *file.LegalHold})
+}
+
+// auditActor returns the actor recorded in the audit log. Every admin holds the same token, so the X-User-Id header
+// naming the admin can't be verified and is recorded as such, truncated to maxClaimedActorLength.
+func auditActor(r *http.Request) string {
+	actor := "admin token"
+	claimed := []rune(r.Header.Get(OwnerHeader))
+	if len(claimed) > maxClaimedActorLength {
+		claimed = claimed[:maxClaimedActorLength]
+	}
+	if len(claimed) > 0 {
+		actor += " (unverified " + OwnerHeader + ": " + string(claimed) + ")"
+	}
+	return actor
+}
+
+// GetAuditLog lists the changes to the retention and the legal hold of a file.
+func (handlers Handlers) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	fileId := mux.Vars(r)["fileId"]
+	fileIdInt64, err := strconv.ParseInt(fileId, 0, 64)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Response{false, "Unparseable fileId."})
+		return
+	}
+	entries, err := handlers.fileService.GetAuditLog(r.Context(), bucketName(r), fileIdInt64)
+	if err != nil {
+		jsonResponse(w, errorStatusCode(err), Response{false, "Failed to get audit log."})
+		return
+	}
+	response := []AuditLogEntryResponse{}
+	for _, entry := range entries {
+		response = append(response, auditLogEntryResponse(entry))
+	}
+	jsonResponse(w, http.StatusOK, response)
+}
+
+func auditLogEntryResponse(entry repository.AuditLogEntry) AuditLogEntryResponse {
+	response := AuditLogEntryResponse{Action: *entry.Action, OldValue: entry.OldValue, NewValue: entry.NewValue, Actor: entry.Actor}
+	if entry.CreatedDt != nil {
+		response.CreatedDt = *entry.CreatedDt
+	}
+	return response
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this are not worth compressing.
+const minCompressedSize = 1024
+
+// incompressibleTypes are already compressed. Types ending with / match the whole type, except the compressibleTypes.
+var incompressibleTypes = []string{"image/", "video/", "audio/", "font/woff", "font/woff2", "application/zip",
+	"application/gzip", "application/x-gzip", "application/zstd", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/vnd.rar", "application/x-rar-compressed", "application/pdf",
+	"application/octet-stream"}
+var compressibleTypes = []string{"image/svg+xml", "image/bmp"}
+
+// compressResponses compresses the responses with brotli or gzip, as negotiated with the Accept-Encoding header of the
+// request. Responses below minCompressedSize, partial or already encoded responses and those of incompressible types
+// are written as is.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressingWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns br or gzip, whichever the request prefers, or "" if it accepts neither.
+func negotiateEncoding(r *http.Request) string {
+	brWeight, gzipWeight := encodingWeight(r, "br"), encodingWeight(r, "gzip")
+	if brWeight > 0 && brWeight >= gzipWeight {
+		return "br"
+	}
+	if gzipWeight > 0 {
+		return "gzip"
+	}
+	return ""
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request allows the content coding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	return encodingWeight(r, encoding) > 0
+}
+
+// encodingWeight returns the q value given to the content coding by the Accept-Encoding header of the request, 0 if
+// it's not accepted.
+func encodingWeight(r *http.Request, encoding string) float64 {
+	anyWeight := 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.SplitN(accepted, ";", 2)
+		coding := strings.TrimSpace(parts[0])
+		weight := 1.0
+		if len(parts) == 2 {
+			param := strings.TrimSpace(parts[1])
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[len("q="):], 64)
+				if err == nil {
+					weight = parsed
+				}
+			}
+		}
+		if strings.EqualFold(coding, encoding) {
+			return weight
+		}
+		if coding == "*" {
+			anyWeight = weight
+		}
+	}
+	return anyWeight
+}
+
+// compressingWriter buffers the start of the body until it reaches minCompressedSize, then compresses it if the
+// response is compressible.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding    string
+	status      int // Written along with the body, once it's known whether it's compressed
+	buffer      []byte
+	encoder     io.WriteCloser // Nil until compressing
+	passthrough bool
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.encoder == nil && !w.passthrough {
+		if !w.compressible() {
+			err := w.writeAsIs()
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			w.buffer = append(w.buffer, p...)
+			if len(w.buffer) < minCompressedSize {
+				return len(p), nil
+			}
+			return len(p), w.startCompressing()
+		}
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Close writes the buffered body, too small to be compressed, or finishes the compressed body.
+func (w *compressingWriter) Close() error {
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	if !w.passthrough && w.status != 0 {
+		return w.writeAsIs()
+	}
+	return nil
+}
+
+func (w *compressingWriter) compressible() bool {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || w.status < http.StatusOK || w.status == http.StatusNoContent ||
+		w.status == http.StatusPartialContent || w.status == http.StatusNotModified {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < minCompressedSize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, compressible := range compressibleTypes {
+		if mediaType == compressible {
+			return true
+		}
+	}
+	for _, incompressible := range incompressibleTypes {
+		if mediaType == incompressible || (strings.HasSuffix(incompressible, "/") && strings.HasPrefix(mediaType, incompressible)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *compressingWriter) writeAsIs() error {
+	w.passthrough = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buffer)
+	w.buffer = nil
+	return err
+}
+
+func (w *compressingWriter) startCompressing() error {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", w.encoding)
+	if !strings.Contains(header.Get("Vary"), "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.encoding == "br" {
+		w.encoder = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+	} else {
+		w.encoder = gzip.NewWriter(w.ResponseWriter)
+	}
+	_, err := w.encoder.Write(w.buffer)
+	w.buffer = nil
+	return err
+}
@@ -0,0 +1,136 @@
+package handlers_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gocleancode/config"
+	"gocleancode/repository"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressJsonResponse(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"*", "br"},
+		{"deflate", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		_, appHandlers := createHandlers()
+		req, err := http.NewRequest("GET", "/admin/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rr := httptest.NewRecorder()
+		// When
+		appHandlers.ServeHTTP(rr, req)
+		// Then
+		assert.Equal(t, http.StatusOK, rr.Code, test.acceptEncoding)
+		assert.Equal(t, test.encoding, rr.Header().Get("Content-Encoding"), test.acceptEncoding)
+		metrics := map[string]interface{}{}
+		err = json.Unmarshal(decodeBody(t, rr), &metrics)
+		assert.Nil(t, err, test.acceptEncoding)
+		assert.Contains(t, metrics, "scrubber", test.acceptEncoding)
+	}
+}
+
+func TestSmallJsonResponseNotCompressed(t *testing.T) {
+	_, appHandlers := createHandlers()
+	req, err := http.NewRequest("GET", "/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.True(t, json.Valid(rr.Body.Bytes()))
+}
+
+func TestCompressDownload(t *testing.T) {
+	tests := []struct {
+		contentType string
+		compressed  bool
+	}{
+		{"text/plain", true},
+		{"image/svg+xml", true},
+		{"image/jpg", false},
+		{"application/zip", false},
+	}
+	for _, test := range tests {
+		fileService, appHandlers := createHandlers()
+		fileId := int64(5)
+		req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d", fileId), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		fileName, filePath, contentType := "data", uploadDir+"TestCompressDownload", test.contentType
+		createdDt := time.Now()
+		file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt}
+		fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+		expectedBody := []byte(strings.Repeat("hello world\n", 1000))
+		err = ioutil.WriteFile(filePath, expectedBody, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileService.On("OpenFile", mock.Anything, file).Return(contents, nil).Once()
+		// When
+		appHandlers.ServeHTTP(rr, req)
+		// Then
+		assert.Equal(t, http.StatusOK, rr.Code, test.contentType)
+		if test.compressed {
+			assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"), test.contentType)
+			assert.Empty(t, rr.Header().Get("Content-Length"), test.contentType)
+			assert.Less(t, rr.Body.Len(), len(expectedBody), test.contentType)
+		} else {
+			assert.Empty(t, rr.Header().Get("Content-Encoding"), test.contentType)
+		}
+		assert.Equal(t, expectedBody, decodeBody(t, rr), test.contentType)
+	}
+}
+
+func decodeBody(t *testing.T, rr *httptest.ResponseRecorder) []byte {
+	var reader io.Reader = rr.Body
+	switch rr.Header().Get("Content-Encoding") {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gzipReader
+	case "br":
+		reader = brotli.NewReader(rr.Body)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
@@ -1,62 +1,245 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"gocleancode/services"
 	"gocleancode/utils"
-	"io"
+	"image"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// multipartOverhead is the allowance for the multipart boundaries and headers when comparing the request size to the quota.
+const multipartOverhead = 4 << 10
+
 func (handlers Handlers) UploadFile(w http.ResponseWriter, r *http.Request) {
+	bucket := bucketName(r)
+	owner := r.Header.Get(OwnerHeader)
+	remainingQuota, err := handlers.fileService.RemainingQuota(r.Context(), bucket, owner)
+	if err != nil {
+		log.Error(err)
+		jsonResponse(w, errorStatusCode(err), Response{false, errorMessage("Failed to save file!", err)})
+		return
+	}
+	if remainingQuota >= 0 {
+		// Reject before the whole request body is read
+		if r.ContentLength > remainingQuota+multipartOverhead {
+			jsonResponse(w, http.StatusInsufficientStorage, Response{false, "Failed to save file! " + services.ErrQuotaExceeded.Error()})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, remainingQuota+multipartOverhead)
+	}
 	file, handle, err := r.FormFile("file")
 	if err != nil {
 		log.Error(err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonResponse(w, http.StatusInsufficientStorage, Response{false, "Failed to save file! " + services.ErrQuotaExceeded.Error()})
+			return
+		}
 		jsonResponse(w, http.StatusBadRequest, Response{false, "Failed to save file!"})
 		return
 	}
 	defer utils.CloseFile(file)
-	generatedId, err := handlers.fileService.SaveFile(file, handle)
+	options := services.UploadOptions{}
+	if tags := r.FormValue("tags"); tags != "" {
+		options.Tags = strings.Split(tags, ",")
+	}
+	options.ExpiresAt, err = expiry(r)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Response{false, "Failed to save file! " + err.Error()})
+		return
+	}
+	generatedId, err := handlers.fileService.SaveFile(r.Context(), bucket, owner, file, handle, options)
 	if err != nil {
 		log.Error(err)
-		jsonResponse(w, http.StatusInternalServerError, Response{false, "Failed to save file!"})
+		jsonResponse(w, errorStatusCode(err), Response{false, errorMessage("Failed to save file!", err)})
 	} else {
 		jsonResponse(w, http.StatusCreated, Response{true, fmt.Sprintf("Created file with id %v.", generatedId)})
 	}
 }
 
-func (handlers Handlers) GetFileById(w http.ResponseWriter, r *http.Request) {
+// expiry reads the optional expiry of an upload, either expires_in, in seconds, or expires_at, in RFC 3339 format.
+func expiry(r *http.Request) (*time.Time, error) {
+	expiresIn, expiresAt := r.FormValue("expires_in"), r.FormValue("expires_at")
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return nil, errors.New("expires_in and expires_at can't be both set")
+	case expiresIn != "":
+		seconds, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("expires_in must be a positive number of seconds")
+		}
+		expiresDt := time.Now().Add(time.Duration(seconds) * time.Second)
+		return &expiresDt, nil
+	case expiresAt != "":
+		expiresDt, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, errors.New("expires_at must be in RFC 3339 format, eg 2019-01-02T15:04:05Z")
+		}
+		return &expiresDt, nil
+	}
+	return nil, nil
+}
+
+// downloadableFile returns the file of the request if it can be downloaded. Otherwise, it writes the error response
+// and returns false.
+func (handlers Handlers) downloadableFile(w http.ResponseWriter, r *http.Request) (repository.File, bool) {
 	vars := mux.Vars(r)
 	fileId := vars["fileId"]
 	fileIdInt64, err := strconv.ParseInt(fileId, 0, 64)
 	if err != nil {
 		jsonResponse(w, http.StatusBadRequest, Response{false, "Unparseable fileId."})
-		return
+		return repository.File{}, false
 	}
-	file, err := handlers.fileService.GetFileById(fileIdInt64)
+	file, err := handlers.fileService.GetFileById(r.Context(), bucketName(r), fileIdInt64)
 	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, Response{false, "Failed to get file."})
+		jsonResponse(w, errorStatusCode(err), Response{false, "Failed to get file."})
+		return file, false
+	}
+	if file.ExpiresDt != nil && !file.ExpiresDt.After(time.Now()) {
+		jsonResponse(w, http.StatusGone, Response{false, "File has expired."})
+		return file, false
+	}
+	if file.ScanStatus != nil {
+		switch *file.ScanStatus {
+		case repository.ScanStatusClean:
+		case repository.ScanStatusInfected:
+			jsonResponse(w, http.StatusForbidden, Response{false, "File is infected."})
+			return file, false
+		default:
+			jsonResponse(w, http.StatusLocked, Response{false, "File is not yet scanned."})
+			return file, false
+		}
+	}
+	return file, true
+}
+
+func (handlers Handlers) GetFileById(w http.ResponseWriter, r *http.Request) {
+	file, ok := handlers.downloadableFile(w, r)
+	if !ok {
 		return
 	}
-	filePath := *file.FilePath
-	actualFile, err := os.Open(filePath)
+	transformation, err := imageTransformation(r)
 	if err != nil {
-		log.Error(fmt.Sprintf("Failed to open file %s.", filePath))
-		jsonResponse(w, http.StatusInternalServerError, Response{false, "Failed to open file."})
+		jsonResponse(w, http.StatusBadRequest, Response{false, err.Error()})
+		return
+	}
+	if transformation != nil {
+		handlers.serveTransformedImage(w, r, file, *transformation)
 		return
 	}
-	n, err := io.Copy(w, actualFile)
+	// Compressed files are served as stored to the clients accepting their encoding, unless a range is requested: the
+	// ranges are of the decompressed contents
+	encoded := file.ContentEncoding != nil && r.Header.Get("Range") == "" && acceptsEncoding(r, *file.ContentEncoding)
+	openFile := handlers.fileService.OpenFile
+	if encoded {
+		openFile = handlers.fileService.OpenEncodedFile
+	}
+	contents, err := openFile(r.Context(), file)
 	if err != nil {
-		log.Error(fmt.Sprintf("Failed to copy file %s. Reason: %v", filePath, err))
-		jsonResponse(w, http.StatusInternalServerError, Response{false, "Failed to get file."})
+		log.Error(fmt.Sprintf("Failed to open file %s. Reason: %v", *file.FilePath, err))
+		jsonResponse(w, http.StatusInternalServerError, Response{false, "Failed to open file."})
 		return
 	}
+	defer utils.CloseFile(contents)
 	w.Header().Set("Content-Type", *file.ContentType)
 	w.Header().Set("Content-Disposition", "inline") // Display in browser
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", n))
+	if file.ContentEncoding != nil {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	if encoded {
+		w.Header().Set("Content-Encoding", *file.ContentEncoding)
+	}
+	// ServeContent handles the Range requests and sets the Content-Length
+	http.ServeContent(w, r, *file.FileName, *file.CreatedDt, contents)
+}
+
+// imageTransformation reads the transformation of the image requested by the format, quality, orient and crop
+// parameters, eg ?format=jpeg&quality=70&orient=auto&crop=0,0,200,100 (x,y,width,height). nil if there is none.
+func imageTransformation(r *http.Request) (*services.ImageTransformation, error) {
+	query := r.URL.Query()
+	if query.Get("format") == "" && query.Get("quality") == "" && query.Get("orient") == "" && query.Get("crop") == "" {
+		return nil, nil
+	}
+	transformation := services.ImageTransformation{Format: query.Get("format")}
+	if quality := query.Get("quality"); quality != "" {
+		var err error
+		transformation.Quality, err = strconv.Atoi(quality)
+		if err != nil || transformation.Quality == 0 {
+			return nil, errors.New("quality must be a number from 1 to 100")
+		}
+	}
+	switch query.Get("orient") {
+	case "":
+	case "auto":
+		transformation.AutoOrient = true
+	default:
+		return nil, errors.New("orient must be auto")
+	}
+	if crop := query.Get("crop"); crop != "" {
+		var bounds [4]int
+		parts := strings.Split(crop, ",")
+		if len(parts) != len(bounds) {
+			return nil, errors.New("crop must be x,y,width,height")
+		}
+		for i, part := range parts {
+			var err error
+			bounds[i], err = strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || bounds[i] < 0 {
+				return nil, errors.New("crop must be x,y,width,height")
+			}
+		}
+		rectangle := image.Rect(bounds[0], bounds[1], bounds[0]+bounds[2], bounds[1]+bounds[3])
+		transformation.Crop = &rectangle
+	}
+	return &transformation, nil
+}
+
+func (handlers Handlers) serveTransformedImage(w http.ResponseWriter, r *http.Request, file repository.File, transformation services.ImageTransformation) {
+	contents, contentType, err := handlers.fileService.TransformImage(r.Context(), file, transformation)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to transform file %d. Reason: %v", *file.Id, err))
+		jsonResponse(w, errorStatusCode(err), Response{false, errorMessage("Failed to transform image.", err)})
+		return
+	}
+	defer utils.CloseFile(contents)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline")
+	http.ServeContent(w, r, "", *file.CreatedDt, contents)
+}
+
+// GetThumbnail serves a thumbnail of an image file, eg /files/1/thumbnail?w=200&h=200&fit=cover. fit is contain,
+// cover or fill, and defaults to contain.
+func (handlers Handlers) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	file, ok := handlers.downloadableFile(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	width, widthErr := strconv.Atoi(query.Get("w"))
+	height, heightErr := strconv.Atoi(query.Get("h"))
+	if widthErr != nil || heightErr != nil {
+		jsonResponse(w, http.StatusBadRequest, Response{false, "w and h must be numbers of pixels."})
+		return
+	}
+	options := services.ThumbnailOptions{Width: width, Height: height, Fit: query.Get("fit")}
+	contents, contentType, err := handlers.fileService.GetThumbnail(r.Context(), file, options)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to get the thumbnail of file %d. Reason: %v", *file.Id, err))
+		jsonResponse(w, errorStatusCode(err), Response{false, errorMessage("Failed to get thumbnail.", err)})
+		return
+	}
+	defer utils.CloseFile(contents)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline")
+	http.ServeContent(w, r, "", *file.CreatedDt, contents)
 }
 
 func (handlers Handlers) DeleteFileById(w http.ResponseWriter, r *http.Request) {
@@ -67,10 +250,20 @@ func (handlers Handlers) DeleteFileById(w http.ResponseWriter, r *http.Request)
 		jsonResponse(w, http.StatusBadRequest, Response{false, "Unparseable fileId."})
 		return
 	}
-	err = handlers.fileService.DeleteFileById(fileIdInt64)
+	err = handlers.fileService.DeleteFileById(r.Context(), bucketName(r), fileIdInt64)
 	if err != nil {
-		jsonResponse(w, http.StatusInternalServerError, Response{false, "Failed to delete file with id " + fileId})
+		jsonResponse(w, errorStatusCode(err), Response{false, "Failed to delete file with id " + fileId})
 	} else {
 		jsonResponse(w, http.StatusOK, Response{true, "Successfully deleted file with id " + fileId})
 	}
 }
+
+func (handlers Handlers) GetUsage(w http.ResponseWriter, r *http.Request) {
+	report, err := handlers.fileService.GetUsage(r.Context(), bucketName(r), r.Header.Get(OwnerHeader))
+	if err != nil {
+		log.Error(err)
+		jsonResponse(w, errorStatusCode(err), Response{false, "Failed to get usage."})
+		return
+	}
+	jsonResponse(w, http.StatusOK, report)
+}
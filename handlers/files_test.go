@@ -3,11 +3,16 @@ package handlers_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gocleancode/config"
 	"gocleancode/handlers"
 	"gocleancode/repository"
+	"gocleancode/services"
+	"image"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
@@ -44,7 +49,8 @@ func TestUploadFile(t *testing.T) {
 	}
 	expectedFile, expectedHandle, err := req.FormFile("file")
 	expectedGeneratedId := int64(1)
-	fileService.On("SaveFile", expectedFile, expectedHandle).Return(expectedGeneratedId, nil).Once()
+	fileService.On("RemainingQuota", mock.Anything, config.DefaultBucket, "").Return(int64(-1), nil).Once()
+	fileService.On("SaveFile", mock.Anything, config.DefaultBucket, "", expectedFile, expectedHandle, services.UploadOptions{}).Return(expectedGeneratedId, nil).Once()
 
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
@@ -64,7 +70,169 @@ func TestUploadFile(t *testing.T) {
 		return
 	}
 	assert.Equal(t, expectedResponse, actualResponse)
-	fileService.AssertCalled(t, "SaveFile", expectedFile, expectedHandle)
+	fileService.AssertCalled(t, "SaveFile", mock.Anything, config.DefaultBucket, "", expectedFile, expectedHandle, services.UploadOptions{})
+}
+
+func TestUploadFileExceedingQuota(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := newfileUploadRequest("/buckets/shared/files", "quota.txt", strings.Repeat("a", 8<<10))
+	if err != nil {
+		t.Errorf("Failed to create POST upload request %v.", err)
+	}
+	req.Header.Set(handlers.OwnerHeader, "user1")
+	fileService.On("RemainingQuota", mock.Anything, "shared", "user1").Return(int64(1<<10), nil).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	if status := rr.Code; status != http.StatusInsufficientStorage {
+		t.Errorf("handler returned wrong status code: got %d want %d", status, http.StatusInsufficientStorage)
+	}
+	fileService.AssertNotCalled(t, "SaveFile", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUploadFileFailing(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := newfileUploadRequest("/files", "failing.txt", "This is a test.")
+	if err != nil {
+		t.Errorf("Failed to create POST upload request %v.", err)
+	}
+	fileService.On("RemainingQuota", mock.Anything, config.DefaultBucket, "").Return(int64(-1), nil).Once()
+	fileService.On("SaveFile", mock.Anything, config.DefaultBucket, "", mock.Anything, mock.Anything, services.UploadOptions{}).
+		Return(int64(0), errors.New("open /var/files/failing.txt: permission denied")).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then the internal error isn't disclosed
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	actualResponse := handlers.Response{}
+	json.Unmarshal(rr.Body.Bytes(), &actualResponse)
+	assert.Equal(t, handlers.Response{false, "Failed to save file!"}, actualResponse)
+
+	fileService.On("SaveFile", mock.Anything, config.DefaultBucket, "", mock.Anything, mock.Anything, services.UploadOptions{}).
+		Return(int64(0), services.ErrFileTooLarge).Once()
+	fileService.On("RemainingQuota", mock.Anything, config.DefaultBucket, "").Return(int64(-1), nil).Once()
+	req, _ = newfileUploadRequest("/files", "failing.txt", "This is a test.")
+	rr = httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then the known errors are
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &actualResponse)
+	assert.Equal(t, handlers.Response{false, "Failed to save file! " + services.ErrFileTooLarge.Error()}, actualResponse)
+}
+
+func TestUploadFileWithTags(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "export.csv")
+	if err == nil {
+		_, err = part.Write([]byte("a,b"))
+	}
+	if err == nil {
+		err = writer.WriteField("tags", "export,monthly")
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/files", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	fileService.On("RemainingQuota", mock.Anything, config.DefaultBucket, "").Return(int64(-1), nil).Once()
+	fileService.On("SaveFile", mock.Anything, config.DefaultBucket, "", mock.Anything, mock.Anything,
+		services.UploadOptions{Tags: []string{"export", "monthly"}}).Return(int64(1), nil).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	fileService.AssertExpectations(t)
+}
+
+func TestUploadFileWithExpiry(t *testing.T) {
+	tests := []struct {
+		fields       map[string]string
+		expectedCode int
+	}{
+		{map[string]string{"expires_in": "3600"}, http.StatusCreated},
+		{map[string]string{"expires_at": "2030-01-02T15:04:05Z"}, http.StatusCreated},
+		{map[string]string{"expires_in": "soon"}, http.StatusBadRequest},
+		{map[string]string{"expires_at": "2030-01-02"}, http.StatusBadRequest},
+		{map[string]string{"expires_in": "3600", "expires_at": "2030-01-02T15:04:05Z"}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		fileService, appHandlers := createHandlers()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "export.csv")
+		if err == nil {
+			_, err = part.Write([]byte("a,b"))
+		}
+		for name, value := range test.fields {
+			if err == nil {
+				err = writer.WriteField(name, value)
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/files", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		fileService.On("RemainingQuota", mock.Anything, config.DefaultBucket, "").Return(int64(-1), nil).Once()
+		var options services.UploadOptions
+		fileService.On("SaveFile", mock.Anything, config.DefaultBucket, "", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			options = args.Get(5).(services.UploadOptions)
+		}).Return(int64(1), nil).Once()
+		rr := httptest.NewRecorder()
+		// When
+		appHandlers.ServeHTTP(rr, req)
+		// Then
+		assert.Equal(t, test.expectedCode, rr.Code, "%v", test.fields)
+		if test.expectedCode == http.StatusCreated {
+			assert.NotNil(t, options.ExpiresAt)
+			assert.True(t, options.ExpiresAt.After(time.Now()))
+		} else {
+			fileService.AssertNotCalled(t, "SaveFile", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		}
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := http.NewRequest("GET", "/buckets/shared/usage", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(handlers.OwnerHeader, "user1")
+	expectedReport := services.UsageReport{Bucket: "shared", Usage: services.Usage{Bytes: 10, Files: 1, QuotaBytes: 100}, Owner: "user1",
+		OwnerUsage: &services.Usage{Bytes: 10, Files: 1}}
+	fileService.On("GetUsage", mock.Anything, "shared", "user1").Return(expectedReport, nil).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %d want %d", status, http.StatusOK)
+	}
+	actualReport := services.UsageReport{}
+	err = json.Unmarshal(rr.Body.Bytes(), &actualReport)
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+		return
+	}
+	assert.Equal(t, expectedReport, actualReport)
 }
 
 func TestGetFileById(t *testing.T) {
@@ -83,13 +251,18 @@ func TestGetFileById(t *testing.T) {
 	filePath := uploadDir + "TestGetFileById.txt"
 	createdDt := time.Now()
 	file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &expectedRespContentType, CreatedDt: &createdDt}
-	fileService.On("GetFileById", fileId).Return(file, nil).Once()
+	fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
 
 	err = ioutil.WriteFile(filePath, expectedRespBody, 0666)
 	if err != nil {
 		t.Errorf("Expected no error, but got %s instead", err)
 		return
 	}
+	contents, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileService.On("OpenFile", mock.Anything, file).Return(contents, nil).Once()
 	// When
 	appHandlers.ServeHTTP(rr, req)
 	// Then
@@ -103,7 +276,133 @@ func TestGetFileById(t *testing.T) {
 	assert.Equal(t, expectedRespContentType, headers.Get("Content-Type"))
 	assert.Equal(t, "inline", headers.Get("Content-Disposition"))
 	assert.Equal(t, fmt.Sprintf("%d", len(expectedRespBody)), headers.Get("Content-Length"))
-	fileService.AssertCalled(t, "GetFileById", fileId)
+	fileService.AssertCalled(t, "GetFileById", mock.Anything, config.DefaultBucket, fileId)
+}
+
+func TestGetFileByIdWithRange(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	fileId := int64(3)
+	req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d", fileId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=6-10")
+	rr := httptest.NewRecorder()
+	fileName := "fname"
+	filePath := uploadDir + "TestGetFileByIdWithRange.txt"
+	contentType := "text/plain"
+	createdDt := time.Now()
+	file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt}
+	fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+	err = ioutil.WriteFile(filePath, []byte("hello world"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileService.On("OpenFile", mock.Anything, file).Return(contents, nil).Once()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	if status := rr.Code; status != http.StatusPartialContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPartialContent)
+	}
+	assert.Equal(t, "world", rr.Body.String())
+	assert.Equal(t, "bytes 6-10/11", rr.Header().Get("Content-Range"))
+}
+
+func TestGetFileByIdCompressed(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		rangeHeader    string
+		encoded        bool
+	}{
+		{"gzip, deflate", "", true},
+		{"*", "", true},
+		{"br, gzip;q=0", "", false},
+		{"", "", false},
+		{"gzip", "bytes=0-4", false}, // The ranges are of the decompressed contents
+	}
+	for _, test := range tests {
+		fileService, appHandlers := createHandlers()
+		fileId := int64(4)
+		req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d", fileId), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		req.Header.Set("Range", test.rangeHeader)
+		rr := httptest.NewRecorder()
+		fileName, filePath, contentType, encoding := "data.csv", uploadDir+"TestGetFileByIdCompressed.csv", "text/csv", "gzip"
+		createdDt := time.Now()
+		file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt, ContentEncoding: &encoding}
+		fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+		err = ioutil.WriteFile(filePath, []byte("a,b,c"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		openMethod := "OpenFile"
+		if test.encoded {
+			openMethod = "OpenEncodedFile"
+		}
+		fileService.On(openMethod, mock.Anything, file).Return(contents, nil).Once()
+		// When
+		appHandlers.ServeHTTP(rr, req)
+		// Then
+		fileService.AssertExpectations(t)
+		assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"), test.acceptEncoding)
+		if test.encoded {
+			assert.Equal(t, encoding, rr.Header().Get("Content-Encoding"), test.acceptEncoding)
+		} else {
+			assert.Empty(t, rr.Header().Get("Content-Encoding"), test.acceptEncoding)
+		}
+	}
+}
+
+func TestGetFileByIdNotYetScanned(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	fileId := int64(2)
+	req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d", fileId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	filePath := uploadDir + "TestGetFileByIdNotYetScanned.txt"
+	scanStatus := repository.ScanStatusPending
+	file := repository.File{FilePath: &filePath, ScanStatus: &scanStatus}
+	fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	if status := rr.Code; status != http.StatusLocked {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusLocked)
+	}
+}
+
+func TestGetFileByIdExpired(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	fileId := int64(2)
+	req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d", fileId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	filePath := uploadDir + "TestGetFileByIdExpired.txt"
+	scanStatus := repository.ScanStatusClean
+	expiresDt := time.Now().Add(-time.Minute)
+	file := repository.File{FilePath: &filePath, ScanStatus: &scanStatus, ExpiresDt: &expiresDt}
+	fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusGone, rr.Code)
+	fileService.AssertNotCalled(t, "OpenFile", mock.Anything, mock.Anything)
 }
 
 func TestDeleteFileById(t *testing.T) {
@@ -115,7 +414,7 @@ func TestDeleteFileById(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	fileService.On("DeleteFileById", fileId).Return(nil).Once()
+	fileService.On("DeleteFileById", mock.Anything, config.DefaultBucket, fileId).Return(nil).Once()
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
 	// When
@@ -134,7 +433,42 @@ func TestDeleteFileById(t *testing.T) {
 		return
 	}
 	assert.Equal(t, expectedResponse, actualResponse)
-	fileService.AssertCalled(t, "DeleteFileById", fileId)
+	fileService.AssertCalled(t, "DeleteFileById", mock.Anything, config.DefaultBucket, fileId)
+}
+
+func TestDeleteFileByIdProtected(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := http.NewRequest("DELETE", "/files/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileService.On("DeleteFileById", mock.Anything, config.DefaultBucket, int64(1)).Return(services.ErrFileProtected).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusLocked, rr.Code)
+}
+
+func TestDeleteFileByIdInBucket(t *testing.T) {
+	// Given
+	fileService, appHandlers := createHandlers()
+	fileId := int64(1)
+	bucket := "reports"
+	url := fmt.Sprintf("/buckets/%s/files/%d", bucket, fileId)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileService.On("DeleteFileById", mock.Anything, bucket, fileId).Return(services.ErrFileNotFound).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %d want %d", status, http.StatusNotFound)
+	}
+	fileService.AssertCalled(t, "DeleteFileById", mock.Anything, bucket, fileId)
 }
 
 func newfileUploadRequest(uri string, filePath string, fileContents string) (*http.Request, error) {
@@ -155,3 +489,144 @@ func newfileUploadRequest(uri string, filePath string, fileContents string) (*ht
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	return req, err
 }
+
+func TestGetThumbnail(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	fileId := int64(6)
+	req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d/thumbnail?w=200&h=100&fit=cover", fileId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	contentType, createdDt := "image/jpeg", time.Now()
+	file := repository.File{Id: &fileId, ContentType: &contentType, CreatedDt: &createdDt}
+	fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+	thumbnailPath := uploadDir + "TestGetThumbnail.jpg"
+	err = ioutil.WriteFile(thumbnailPath, []byte("thumbnail"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnail, err := os.Open(thumbnailPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := services.ThumbnailOptions{Width: 200, Height: 100, Fit: "cover"}
+	fileService.On("GetThumbnail", mock.Anything, file, options).Return(thumbnail, "image/jpeg", nil).Once()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "thumbnail", rr.Body.String())
+}
+
+func TestGetThumbnailInvalidRequest(t *testing.T) {
+	tests := []struct {
+		query          string
+		serviceErr     error
+		expectedStatus int
+	}{
+		{"w=200", nil, http.StatusBadRequest},
+		{"w=200&h=abc", nil, http.StatusBadRequest},
+		{"w=200&h=200&fit=stretch", services.ErrInvalidThumbnail, http.StatusBadRequest},
+		{"w=200&h=200", services.ErrNotAnImage, http.StatusUnsupportedMediaType},
+		{"w=200&h=200", services.ErrImageTooLarge, http.StatusUnprocessableEntity},
+		{"w=200&h=200", errors.New("open /var/files/derivatives/6: permission denied"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		fileService, appHandlers := createHandlers()
+		fileId := int64(6)
+		req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d/thumbnail?%s", fileId, test.query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		file := repository.File{Id: &fileId}
+		fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+		if test.serviceErr != nil {
+			fileService.On("GetThumbnail", mock.Anything, file, mock.Anything).Return(nil, "", test.serviceErr).Once()
+		}
+		// When
+		appHandlers.ServeHTTP(rr, req)
+		// Then
+		assert.Equal(t, test.expectedStatus, rr.Code, test.query)
+		if test.expectedStatus == http.StatusInternalServerError {
+			actualResponse := handlers.Response{}
+			json.Unmarshal(rr.Body.Bytes(), &actualResponse)
+			assert.Equal(t, handlers.Response{false, "Failed to get thumbnail."}, actualResponse, "the internal error isn't disclosed")
+		}
+	}
+}
+
+func TestGetFileByIdTransformed(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	fileId := int64(7)
+	req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d?format=jpeg&quality=70&orient=auto&crop=10,20,200,100", fileId), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	contentType, createdDt := "image/png", time.Now()
+	file := repository.File{Id: &fileId, ContentType: &contentType, CreatedDt: &createdDt}
+	fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+	transformedPath := uploadDir + "TestGetFileByIdTransformed.jpg"
+	err = ioutil.WriteFile(transformedPath, []byte("transformed"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformed, err := os.Open(transformedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crop := image.Rect(10, 20, 210, 120)
+	transformation := services.ImageTransformation{AutoOrient: true, Crop: &crop, Format: "jpeg", Quality: 70}
+	fileService.On("TransformImage", mock.Anything, file, transformation).Return(transformed, "image/jpeg", nil).Once()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	fileService.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "transformed", rr.Body.String())
+}
+
+func TestGetFileByIdInvalidTransformation(t *testing.T) {
+	tests := []struct {
+		query          string
+		serviceErr     error
+		expectedStatus int
+	}{
+		{"quality=high", nil, http.StatusBadRequest},
+		{"orient=90", nil, http.StatusBadRequest},
+		{"crop=1,2,3", nil, http.StatusBadRequest},
+		{"crop=-1,0,10,10", nil, http.StatusBadRequest},
+		{"format=webp", services.ErrInvalidTransformation, http.StatusBadRequest},
+		{"format=png", services.ErrNotAnImage, http.StatusUnsupportedMediaType},
+		{"format=png", services.ErrImageTooLarge, http.StatusUnprocessableEntity},
+		{"format=png", errors.New("open /var/files/derivatives/7: permission denied"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		fileService, appHandlers := createHandlers()
+		fileId := int64(7)
+		req, err := http.NewRequest("GET", fmt.Sprintf("/files/%d?%s", fileId, test.query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		file := repository.File{Id: &fileId}
+		fileService.On("GetFileById", mock.Anything, config.DefaultBucket, fileId).Return(file, nil).Once()
+		if test.serviceErr != nil {
+			fileService.On("TransformImage", mock.Anything, file, mock.Anything).Return(nil, "", test.serviceErr).Once()
+		}
+		// When
+		appHandlers.ServeHTTP(rr, req)
+		// Then
+		assert.Equal(t, test.expectedStatus, rr.Code, test.query)
+		fileService.AssertNotCalled(t, "OpenFile", mock.Anything, mock.Anything)
+		if test.expectedStatus == http.StatusInternalServerError {
+			actualResponse := handlers.Response{}
+			json.Unmarshal(rr.Body.Bytes(), &actualResponse)
+			assert.Equal(t, handlers.Response{false, "Failed to transform image."}, actualResponse, "the internal error isn't disclosed")
+		}
+	}
+}
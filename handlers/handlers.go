@@ -2,34 +2,98 @@ package handlers
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+	"gocleancode/config"
 	"gocleancode/services"
 	"net/http"
 )
 
 type Handlers struct {
 	fileService services.FileService
+	dbStats     DbStats
+	adminToken  string
 }
 
+// OwnerHeader identifies the user that owns the uploaded files. Quotas are tracked per owner.
+const OwnerHeader = "X-User-Id"
+
 type Response struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 }
 
-func NewHandlers(fileService services.FileService) *mux.Router {
-	handlers := Handlers{fileService}
+func NewHandlers(fileService services.FileService, dbStats DbStats, adminToken string) *mux.Router {
+	handlers := Handlers{fileService, dbStats, adminToken}
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, http.StatusOK, Response{true, "UP"})
 	})
-	r.HandleFunc("/files", handlers.UploadFile).Methods("POST")
-	r.HandleFunc("/files/{fileId}", handlers.GetFileById).Methods("GET")
-	r.HandleFunc("/files/{fileId}", handlers.DeleteFileById).Methods("DELETE")
+	// Routes without a bucket are served from the default bucket.
+	for _, prefix := range []string{"", "/buckets/{bucket}"} {
+		r.HandleFunc(prefix+"/files", handlers.UploadFile).Methods("POST")
+		r.HandleFunc(prefix+"/files/{fileId}", handlers.GetFileById).Methods("GET")
+		r.HandleFunc(prefix+"/files/{fileId}/thumbnail", handlers.GetThumbnail).Methods("GET")
+		r.HandleFunc(prefix+"/files/{fileId}", handlers.DeleteFileById).Methods("DELETE")
+		r.HandleFunc(prefix+"/usage", handlers.GetUsage).Methods("GET")
+	}
+	r.HandleFunc("/admin/db/stats", handlers.requireAdmin(handlers.GetDbStats)).Methods("GET")
+	for _, prefix := range []string{"/admin", "/admin/buckets/{bucket}"} {
+		r.HandleFunc(prefix+"/files/{fileId}/retention", handlers.requireAdmin(handlers.SetRetention)).Methods("PUT")
+		r.HandleFunc(prefix+"/files/{fileId}/audit-log", handlers.requireAdmin(handlers.GetAuditLog)).Methods("GET")
+	}
+	// The expvar metrics, eg those of the scrubber
+	r.HandleFunc("/admin/metrics", handlers.requireAdmin(expvar.Handler().ServeHTTP)).Methods("GET")
+	r.Use(compressResponses)
 	return r
 }
 
+func bucketName(r *http.Request) string {
+	bucket := mux.Vars(r)["bucket"]
+	if bucket == "" {
+		return config.DefaultBucket
+	}
+	return bucket
+}
+
+// errorStatusCode maps the known service errors to http status codes.
+func errorStatusCode(err error) int {
+	switch err {
+	case services.ErrBucketNotFound, services.ErrFileNotFound:
+		return http.StatusNotFound
+	case services.ErrFileTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case services.ErrContentTypeNotAllowed, services.ErrContentTypeMismatch, services.ErrExtensionNotAllowed, services.ErrNotAnImage:
+		return http.StatusUnsupportedMediaType
+	case services.ErrQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case services.ErrInvalidTags, services.ErrInvalidExpiry, services.ErrInvalidThumbnail,
+		services.ErrInvalidTransformation, services.ErrOwnerRequired:
+		return http.StatusBadRequest
+	case services.ErrBackendUnavailable:
+		return http.StatusServiceUnavailable
+	case services.ErrFileProtected:
+		return http.StatusLocked
+	case services.ErrRetentionShortened:
+		return http.StatusConflict
+	case services.ErrImageTooLarge:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorMessage appends the error to the message of the error response if it's a known service error. The other errors
+// may reveal internals, eg paths or queries, they are only logged.
+func errorMessage(message string, err error) string {
+	if errorStatusCode(err) == http.StatusInternalServerError {
+		return message
+	}
+	return message + " " + err.Error()
+}
+
 func jsonResponse(w http.ResponseWriter, code int, response interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	jsonBytes, err := json.Marshal(response)
@@ -1,19 +1,37 @@
 package handlers_test
 
 import (
+	"database/sql"
 	"encoding/json"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gocleancode/config"
 	"gocleancode/handlers"
+	"gocleancode/repository"
+	"gocleancode/services"
 	mockServices "gocleancode/services/mocks"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
+const adminToken = "secret"
+
+type mockDbStats struct {
+	stats sql.DBStats
+}
+
+func (m mockDbStats) Stats() sql.DBStats {
+	return m.stats
+}
+
 func createHandlers() (*mockServices.FileService, *mux.Router) {
 	fileService := &mockServices.FileService{}
-	appHandlers := handlers.NewHandlers(fileService)
+	appHandlers := handlers.NewHandlers(fileService, mockDbStats{sql.DBStats{MaxOpenConnections: 10, OpenConnections: 3, InUse: 1, Idle: 2,
+		WaitDuration: 1500 * time.Millisecond}}, adminToken)
 	return fileService, appHandlers
 }
 
@@ -41,4 +59,136 @@ func TestStatus(t *testing.T) {
 		return
 	}
 	assert.Equal(t, expectedResponse, actualResponse)
+}
+
+func TestGetDbStats(t *testing.T) {
+	_, appHandlers := createHandlers()
+	req, err := http.NewRequest("GET", "/admin/db/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusOK, rr.Code)
+	actualResponse := handlers.DbStatsResponse{}
+	err = json.Unmarshal(rr.Body.Bytes(), &actualResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, handlers.DbStatsResponse{MaxOpenConnections: 10, OpenConnections: 3, InUse: 1, Idle: 2, WaitDurationMs: 1500}, actualResponse)
+}
+
+func TestGetDbStatsWithoutAdminToken(t *testing.T) {
+	_, appHandlers := createHandlers()
+	req, err := http.NewRequest("GET", "/admin/db/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestAdminEndpointsDisabled(t *testing.T) {
+	appHandlers := handlers.NewHandlers(&mockServices.FileService{}, mockDbStats{}, "")
+	req, err := http.NewRequest("GET", "/admin/db/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer ")
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestGetMetrics(t *testing.T) {
+	_, appHandlers := createHandlers()
+	req, err := http.NewRequest("GET", "/admin/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusOK, rr.Code)
+	metrics := map[string]interface{}{}
+	err = json.Unmarshal(rr.Body.Bytes(), &metrics)
+	assert.Nil(t, err)
+	assert.Contains(t, metrics, "scrubber")
+}
+
+func TestSetRetention(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := http.NewRequest("PUT", "/admin/buckets/reports/files/4/retention", strings.NewReader(`{"retentionUntil": "2030-01-02T15:04:05Z", "legalHold": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set(handlers.OwnerHeader, "admin1")
+	retentionUntil := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	hold := true
+	update := services.RetentionUpdate{RetentionUntil: &retentionUntil, LegalHold: &hold}
+	fileService.On("SetRetention", mock.Anything, "reports", int64(4), update, "admin token (unverified X-User-Id: admin1)").
+		Return(repository.File{RetentionUntilDt: &retentionUntil, LegalHold: &hold}, nil).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusOK, rr.Code)
+	fileService.AssertExpectations(t)
+	response := handlers.RetentionResponse{}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), response.FileId)
+	assert.True(t, response.LegalHold)
+	assert.True(t, retentionUntil.Equal(*response.RetentionUntil))
+}
+
+func TestSetRetentionShortened(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := http.NewRequest("PUT", "/admin/files/4/retention", strings.NewReader(`{"retentionUntil": "2020-01-02T15:04:05Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	fileService.On("SetRetention", mock.Anything, config.DefaultBucket, int64(4), mock.Anything, "admin token").
+		Return(repository.File{}, services.ErrRetentionShortened).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestGetAuditLog(t *testing.T) {
+	fileService, appHandlers := createHandlers()
+	req, err := http.NewRequest("GET", "/admin/files/4/audit-log", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	action, oldValue, newValue, actor := repository.AuditSetLegalHold, "false", "true", "admin token"
+	createdDt := time.Now()
+	fileService.On("GetAuditLog", mock.Anything, config.DefaultBucket, int64(4)).Return([]repository.AuditLogEntry{
+		{Action: &action, OldValue: &oldValue, NewValue: &newValue, Actor: &actor, CreatedDt: &createdDt}}, nil).Once()
+	rr := httptest.NewRecorder()
+	// When
+	appHandlers.ServeHTTP(rr, req)
+	// Then
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var entries []handlers.AuditLogEntryResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &entries)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, repository.AuditSetLegalHold, entries[0].Action)
+		assert.Equal(t, "admin token", *entries[0].Actor)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,90 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	exifOrientationTag = 0x0112
+	maxExifSegmentSize = 64 << 10
+)
+
+// Orientation returns the EXIF orientation of a JPEG image, from 1 to 8, and seeks back to the start of the contents.
+// Images without a valid orientation, including those of the other formats, have the normal orientation of 1.
+func Orientation(contents io.ReadSeeker) (int, error) {
+	orientation := readOrientation(bufio.NewReader(contents))
+	_, err := contents.Seek(0, io.SeekStart)
+	return orientation, err
+}
+
+// readOrientation looks for the orientation in the Exif APP1 segment, which precedes the image data.
+func readOrientation(r *bufio.Reader) int {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		if marker[1] == 0xd9 || marker[1] == 0xda { // End of image or start of scan
+			return 1
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+		size := int(length) - 2
+		if marker[1] != 0xe1 || size > maxExifSegmentSize {
+			if _, err := r.Discard(size); err != nil {
+				return 1
+			}
+			continue
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+	}
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of the TIFF structure of the Exif segment.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 1
+	}
+	entries := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
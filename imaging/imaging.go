@@ -0,0 +1,161 @@
+package imaging
+
+import (
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Formats of the images, named after the subtype of their content type.
+const (
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+	FormatGif  = "gif"
+)
+
+// How Resize fits an image in the requested dimensions.
+const (
+	FitContain = "contain" // Scaled down to fit within the dimensions, keeping the aspect ratio
+	FitCover   = "cover"   // Scaled to cover the dimensions, keeping the aspect ratio, and cropped to them
+	FitFill    = "fill"    // Stretched to the dimensions
+)
+
+const DefaultQuality = 85 // Of the JPEG images
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrTooManyPixels     = errors.New("the image has too many pixels")
+	ErrEmptyCrop         = errors.New("the crop is outside of the image")
+)
+
+// Decode decodes a JPEG, PNG or GIF image, the first frame of an animated GIF, and returns it along with its format.
+// The dimensions are read from the header first so that images of more than maxPixels are rejected with
+// ErrTooManyPixels before being decoded. maxPixels of 0 or less means unlimited.
+func Decode(contents io.ReadSeeker, maxPixels int64) (image.Image, string, error) {
+	imageConfig, format, err := image.DecodeConfig(contents)
+	if err == image.ErrFormat {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if format != FormatJpeg && format != FormatPng && format != FormatGif {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if maxPixels > 0 && int64(imageConfig.Width)*int64(imageConfig.Height) > maxPixels {
+		return nil, "", ErrTooManyPixels
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+	img, _, err := image.Decode(contents)
+	return img, format, err
+}
+
+// Resize scales the image to the dimensions as specified by fit. FitContain never enlarges the image.
+func Resize(img image.Image, width int, height int, fit string) image.Image {
+	bounds := img.Bounds()
+	source := bounds
+	switch fit {
+	case FitContain:
+		scale := min(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()), 1)
+		width, height = scaled(bounds.Dx(), scale), scaled(bounds.Dy(), scale)
+	case FitCover:
+		// Crops the center of the image to the aspect ratio of the dimensions
+		if bounds.Dx()*height > bounds.Dy()*width {
+			cropWidth := max(bounds.Dy()*width/height, 1)
+			source.Min.X += (bounds.Dx() - cropWidth) / 2
+			source.Max.X = source.Min.X + cropWidth
+		} else {
+			cropHeight := max(bounds.Dx()*height/width, 1)
+			source.Min.Y += (bounds.Dy() - cropHeight) / 2
+			source.Max.Y = source.Min.Y + cropHeight
+		}
+	}
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, source, draw.Src, nil)
+	return resized
+}
+
+func scaled(length int, scale float64) int {
+	return max(int(float64(length)*scale+0.5), 1)
+}
+
+// Orient rotates and flips the image as specified by its EXIF orientation, so that it displays upright.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	source := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(source, source.Bounds(), img, bounds.Min, draw.Src)
+	width, height := bounds.Dx(), bounds.Dy()
+	orientedWidth, orientedHeight := width, height
+	if orientation >= 5 { // Rotated by a quarter turn
+		orientedWidth, orientedHeight = height, width
+	}
+	oriented := image.NewRGBA(image.Rect(0, 0, orientedWidth, orientedHeight))
+	for y := 0; y < orientedHeight; y++ {
+		for x := 0; x < orientedWidth; x++ {
+			// The pixel of the source that goes to x, y
+			var sourceX, sourceY int
+			switch orientation {
+			case 2: // Flipped horizontally
+				sourceX, sourceY = width-1-x, y
+			case 3: // Rotated by a half turn
+				sourceX, sourceY = width-1-x, height-1-y
+			case 4: // Flipped vertically
+				sourceX, sourceY = x, height-1-y
+			case 5: // Transposed
+				sourceX, sourceY = y, x
+			case 6: // Needs a quarter turn clockwise
+				sourceX, sourceY = y, height-1-x
+			case 7: // Transversed
+				sourceX, sourceY = width-1-y, height-1-x
+			case 8: // Needs a quarter turn counterclockwise
+				sourceX, sourceY = width-1-y, x
+			}
+			copy(oriented.Pix[oriented.PixOffset(x, y):oriented.PixOffset(x, y)+4], source.Pix[source.PixOffset(sourceX, sourceY):])
+		}
+	}
+	return oriented
+}
+
+// Crop returns the part of the image within the rectangle, relative to the top left corner of the image. The
+// rectangle is clipped to the image, ErrEmptyCrop is returned if nothing is left of it.
+func Crop(img image.Image, rectangle image.Rectangle) (image.Image, error) {
+	bounds := img.Bounds()
+	rectangle = rectangle.Add(bounds.Min).Intersect(bounds)
+	if rectangle.Empty() {
+		return nil, ErrEmptyCrop
+	}
+	cropped := image.NewRGBA(image.Rect(0, 0, rectangle.Dx(), rectangle.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rectangle.Min, draw.Src)
+	return cropped, nil
+}
+
+// Encode writes the image in the format. The quality, from 1 to 100, only applies to JPEG. 0 means DefaultQuality.
+func Encode(w io.Writer, img image.Image, format string, quality int) error {
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+	switch format {
+	case FormatJpeg:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case FormatPng:
+		return png.Encode(w, img)
+	case FormatGif:
+		return gif.Encode(w, img, nil)
+	}
+	return ErrUnsupportedFormat
+}
+
+// ContentType returns the content type of the images of the format.
+func ContentType(format string) string {
+	return "image/" + format
+}
@@ -0,0 +1,137 @@
+package imaging_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"gocleancode/imaging"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	tests := []struct {
+		width          int
+		height         int
+		fit            string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{100, 100, imaging.FitContain, 100, 50},
+		{800, 800, imaging.FitContain, 400, 200}, // Not enlarged
+		{100, 100, imaging.FitCover, 100, 100},
+		{30, 100, imaging.FitCover, 30, 100},
+		{100, 100, imaging.FitFill, 100, 100},
+	}
+	for _, test := range tests {
+		resized := imaging.Resize(img, test.width, test.height, test.fit)
+		assert.Equal(t, test.expectedWidth, resized.Bounds().Dx(), test.fit)
+		assert.Equal(t, test.expectedHeight, resized.Bounds().Dy(), test.fit)
+	}
+}
+
+func TestResizeCoverCropsTheCenter(t *testing.T) {
+	// Red, green then blue thirds
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}[x/100])
+		}
+	}
+	resized := imaging.Resize(img, 10, 10, imaging.FitCover)
+	r, g, b, _ := resized.At(5, 5).RGBA()
+	assert.Equal(t, []uint32{0, 0xffff, 0}, []uint32{r, g, b})
+}
+
+func TestDecode(t *testing.T) {
+	var encoded bytes.Buffer
+	err := gif.Encode(&encoded, image.NewPaletted(image.Rect(0, 0, 20, 10), []color.Color{color.Black}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := imaging.Decode(bytes.NewReader(encoded.Bytes()), 200)
+	assert.Nil(t, err)
+	assert.Equal(t, imaging.FormatGif, format)
+	assert.Equal(t, image.Rect(0, 0, 20, 10), img.Bounds())
+	_, _, err = imaging.Decode(bytes.NewReader(encoded.Bytes()), 199)
+	assert.Equal(t, imaging.ErrTooManyPixels, err)
+	_, _, err = imaging.Decode(strings.NewReader("not an image"), 0)
+	assert.Equal(t, imaging.ErrUnsupportedFormat, err)
+}
+
+func TestEncode(t *testing.T) {
+	var encoded bytes.Buffer
+	err := imaging.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 20, 10)), imaging.FormatPng, 0)
+	assert.Nil(t, err)
+	imageConfig, err := png.DecodeConfig(&encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, imageConfig.Width)
+	assert.Equal(t, imaging.ErrUnsupportedFormat, imaging.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 1, 1)), "webp", 0))
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2 with a red top left corner
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		red         image.Point // Where the top left corner ends up
+	}{
+		{1, 3, 2, image.Pt(0, 0)},
+		{2, 3, 2, image.Pt(2, 0)},
+		{3, 3, 2, image.Pt(2, 1)},
+		{4, 3, 2, image.Pt(0, 1)},
+		{5, 2, 3, image.Pt(0, 0)},
+		{6, 2, 3, image.Pt(1, 0)},
+		{7, 2, 3, image.Pt(1, 2)},
+		{8, 2, 3, image.Pt(0, 2)},
+	}
+	for _, test := range tests {
+		oriented := imaging.Orient(img, test.orientation)
+		assert.Equal(t, image.Rect(0, 0, test.width, test.height), oriented.Bounds(), test.orientation)
+		r, _, _, _ := oriented.At(test.red.X, test.red.Y).RGBA()
+		assert.Equal(t, uint32(0xffff), r, test.orientation)
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 4, 2)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Big endian TIFF with a single entry in the first IFD: orientation, a short of 6
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(segment) + 2)}, segment...)
+	withExif := append(append(append([]byte{}, encoded.Bytes()[:2]...), app1...), encoded.Bytes()[2:]...)
+	contents := bytes.NewReader(withExif)
+	orientation, err := imaging.Orientation(contents)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, orientation)
+	img, _, err := imaging.Decode(contents, 0)
+	assert.Nil(t, err, "the contents are rewound")
+	assert.Equal(t, image.Rect(0, 0, 4, 2), img.Bounds())
+	orientation, err = imaging.Orientation(bytes.NewReader(encoded.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, orientation)
+}
+
+func TestCrop(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	cropped, err := imaging.Crop(img, image.Rect(10, 10, 40, 30))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 30, 20), cropped.Bounds())
+	cropped, err = imaging.Crop(img, image.Rect(90, 40, 200, 200))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 10, 10), cropped.Bounds(), "clipped to the image")
+	_, err = imaging.Crop(img, image.Rect(100, 0, 120, 10))
+	assert.Equal(t, imaging.ErrEmptyCrop, err)
+}
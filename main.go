@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gocleancode/config"
 	ivdnDb "gocleancode/db"
+	"gocleancode/db/migrations"
 	"gocleancode/handlers"
 	"gocleancode/repository"
+	"gocleancode/scanner"
 	ivdnService "gocleancode/services"
+	"gocleancode/storage"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -27,6 +34,42 @@ type Response struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if !rotateKeys(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-layout" {
+		if !migrateLayout(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-paths" {
+		if !migratePaths(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-storage" {
+		if !migrateStorage(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		if !reconcile(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if !migrate(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
 	server := NewServer()
 	// Graceful shutdown of the server on kill or CTRL+C
 	gracefulStop := make(chan os.Signal)
@@ -49,24 +92,372 @@ func main() {
 
 func NewServer() *http.Server {
 	appConfig := config.New()
-	if appConfig.DbUser == "" || appConfig.DbPass == "" || appConfig.DbName == "" {
-		panic("Database configs are required.")
-	}
-	mysqlDb, err := ivdnDb.NewMysqlDb(appConfig)
-	if err != nil {
-		panic("Failed to connect to database.")
-	}
-	fileRepo := repository.NewFileRepo(mysqlDb)
-	fileService := ivdnService.NewFileService(mysqlDb, fileRepo, appConfig)
-	appHandlers := handlers.NewHandlers(fileService)
+	appDb, fileService := newFileService(appConfig)
+	appHandlers := handlers.NewHandlers(fileService, appDb, appConfig.AdminToken)
 	serverUrl := fmt.Sprintf("%s:%d", appConfig.Host, appConfig.Port)
 	server := &http.Server{Addr: serverUrl, Handler: appHandlers}
+	purgeTicker := time.NewTicker(time.Hour)
+	// Cancelled on shutdown so the background jobs stop between batches
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	go func() {
+		// Resume the scans interrupted by a restart, then retry the failed ones hourly
+		err := fileService.ScanPendingFiles(jobsCtx)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to scan pending files - %v", err))
+		}
+		// Same for the copies to the secondary storage
+		err = fileService.ReplicatePendingFiles(jobsCtx)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to replicate pending files - %v", err))
+		}
+		for range purgeTicker.C {
+			// Delete the blobs left behind by the uploads and deletions interrupted by a crash
+			err = fileService.PurgePendingDeletions(jobsCtx)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to purge pending deletions - %v", err))
+			}
+			// Purge files that are past their expiry or their bucket's retention
+			err = fileService.PurgeExpiredFiles(jobsCtx)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to purge expired files - %v", err))
+			}
+			err = fileService.ScanPendingFiles(jobsCtx)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to scan pending files - %v", err))
+			}
+			err = fileService.ReplicatePendingFiles(jobsCtx)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to replicate pending files - %v", err))
+			}
+		}
+	}()
+	var reconcileTicker *time.Ticker
+	if appConfig.ReconcileInterval > 0 {
+		reconcileTicker = time.NewTicker(time.Duration(appConfig.ReconcileInterval) * time.Second)
+		go func() {
+			for range reconcileTicker.C {
+				_, err := fileService.Reconcile(jobsCtx, appConfig.ReconcileOrphans, appConfig.ReconcileDryRun)
+				if err != nil {
+					log.Error(fmt.Sprintf("Failed to reconcile the upload dir - %v", err))
+				}
+			}
+		}()
+	}
+	var lifecycleTicker *time.Ticker
+	if appConfig.LifecycleInterval > 0 && len(appConfig.LifecycleRules) > 0 {
+		lifecycleTicker = time.NewTicker(time.Duration(appConfig.LifecycleInterval) * time.Second)
+		go func() {
+			for range lifecycleTicker.C {
+				err := fileService.ApplyLifecycleRules(jobsCtx)
+				if err != nil {
+					log.Error(fmt.Sprintf("Failed to apply the lifecycle rules - %v", err))
+				}
+			}
+		}()
+	}
+	var scrubTicker *time.Ticker
+	if appConfig.ScrubInterval > 0 {
+		scrubTicker = time.NewTicker(time.Duration(appConfig.ScrubInterval) * time.Second)
+		go func() {
+			for range scrubTicker.C {
+				err := fileService.ScrubFiles(jobsCtx)
+				if err != nil {
+					log.Error(fmt.Sprintf("Failed to scrub files - %v", err))
+				}
+			}
+		}()
+	}
 	server.RegisterOnShutdown(func() {
-		err := mysqlDb.Close()
+		purgeTicker.Stop()
+		if scrubTicker != nil {
+			scrubTicker.Stop()
+		}
+		if reconcileTicker != nil {
+			reconcileTicker.Stop()
+		}
+		if lifecycleTicker != nil {
+			lifecycleTicker.Stop()
+		}
+		cancelJobs()
+		err := appDb.Close()
 		if err != nil {
-			log.Error(fmt.Sprintf("Failed to close %v db. %v", mysqlDb.DataSourceName, err))
+			log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, err))
 		}
 		log.Info("Server stopped")
 	})
 	return server
 }
+
+func newDb(appConfig config.Configuration) ivdnDb.DB {
+	// An embedded sqlite db only needs a file
+	if appConfig.DbDriver != "sqlite" && (appConfig.DbUser == "" || appConfig.DbPass == "" || appConfig.DbName == "") {
+		panic("Database configs are required.")
+	}
+	appDb, err := ivdnDb.NewDb(appConfig)
+	if err != nil {
+		panic("Failed to connect to database.")
+	}
+	return appDb
+}
+
+func newFileService(appConfig config.Configuration) (ivdnDb.DB, ivdnService.FileService) {
+	err := checkCompressionRules(appConfig.CompressionRules)
+	if err != nil {
+		panic(err)
+	}
+	appDb := newDb(appConfig)
+	// There's no one else to migrate an embedded sqlite db
+	if appConfig.DbAutoMigrate || appConfig.DbDriver == "sqlite" {
+		migrator, err := migrations.NewMigrator(appDb)
+		if err == nil {
+			err = migrator.Up()
+		}
+		if err != nil {
+			panic(fmt.Sprintf("Failed to migrate the database. %v", err))
+		}
+	}
+	fileRepo := repository.NewFileRepo(appDb)
+	var fileScanner scanner.Scanner
+	if appConfig.ClamdAddress != "" {
+		fileScanner, err = scanner.NewClamdScanner(appConfig.ClamdAddress, time.Duration(appConfig.ClamdTimeout)*time.Second)
+		if err != nil {
+			panic(err)
+		}
+	}
+	var encryptor *storage.Encryptor
+	if appConfig.ActiveMasterKeyId != "" {
+		encryptor, err = storage.NewEncryptor(appConfig.MasterKeys, appConfig.ActiveMasterKeyId)
+		if err != nil {
+			panic(err)
+		}
+	}
+	secondary, err := newSecondaryStorage(appConfig)
+	if err != nil {
+		panic(err)
+	}
+	cold, err := newStorage(appConfig, appConfig.ColdS3Bucket, appConfig.ColdDir)
+	if err != nil {
+		panic(err)
+	}
+	remote, err := newStorage(appConfig, appConfig.RemoteS3Bucket, "")
+	if err != nil {
+		panic(err)
+	}
+	fileService := ivdnService.NewFileService(appDb, fileRepo, storage.NewLocalStorage(), secondary, cold, remote, fileScanner, encryptor, appConfig)
+	return appDb, fileService
+}
+
+// checkCompressionRules rejects the rules with an unknown encoding, which would fail every matching upload.
+func checkCompressionRules(rules []config.CompressionRule) error {
+	for _, rule := range rules {
+		if rule.Encoding != storage.EncodingGzip && rule.Encoding != storage.EncodingZstd {
+			return fmt.Errorf("unknown compression encoding %s, must be %s or %s", rule.Encoding, storage.EncodingGzip, storage.EncodingZstd)
+		}
+	}
+	return nil
+}
+
+// newSecondaryStorage returns the storage that the uploads are replicated to, or nil if none is configured.
+func newSecondaryStorage(appConfig config.Configuration) (storage.Storage, error) {
+	if appConfig.ReplicationMode != ivdnService.ReplicationSync && appConfig.ReplicationMode != ivdnService.ReplicationAsync {
+		return nil, fmt.Errorf("unknown replication mode %s", appConfig.ReplicationMode)
+	}
+	return newStorage(appConfig, appConfig.S3Bucket, appConfig.ReplicaDir)
+}
+
+// newStorage returns a storage mirroring the upload dir in s3Bucket if set, else in dir if set, else nil.
+func newStorage(appConfig config.Configuration, s3Bucket string, dir string) (storage.Storage, error) {
+	if s3Bucket != "" {
+		s3Config := storage.S3Config{Endpoint: appConfig.S3Endpoint, AccessKeyId: appConfig.S3AccessKeyId, SecretAccessKey: appConfig.S3SecretKey,
+			Region: appConfig.S3Region, Bucket: s3Bucket, DisableTls: appConfig.S3DisableTls}
+		return storage.NewS3Storage(s3Config, appConfig.UploadDir)
+	}
+	if dir != "" {
+		return storage.NewLocalMirror(appConfig.UploadDir, dir), nil
+	}
+	return nil, nil
+}
+
+// rotateKeys rewraps the data keys of the encrypted files with the active master key. The retired master keys must
+// still be configured. Run it again with -after-id set to the reported last id to resume an interrupted rotation. It
+// returns false if any file failed.
+func rotateKeys(args []string) bool {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	afterId := flags.Int64("after-id", 0, "Only rewrap the files with a greater id")
+	batchSize := flags.Int("batch-size", 100, "Number of files fetched per query")
+	flags.Parse(args)
+	appConfig := config.New()
+	appDb, fileService := newFileService(appConfig)
+	report, err := fileService.RewrapDataKeys(context.Background(), *afterId, *batchSize)
+	closeErr := appDb.Close()
+	if closeErr != nil {
+		log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, closeErr))
+	}
+	for _, failure := range report.Failures {
+		fmt.Printf("Failed to rewrap file %d: %s\n", failure.FileId, failure.Reason)
+	}
+	fmt.Printf("Rewrapped %d data keys with master key %s. Last processed file id: %d\n", report.Rewrapped, appConfig.ActiveMasterKeyId, report.LastId)
+	if err != nil {
+		fmt.Printf("Rotation stopped: %v. Resume with -after-id %d\n", err, report.LastId)
+	}
+	return err == nil && len(report.Failures) == 0
+}
+
+// migrateLayout moves the blobs stored flat, or under another SHARD_DEPTH, to their sharded path. Run it again with
+// -after-id set to the reported last id to resume an interrupted migration. It returns false if any file failed.
+func migrateLayout(args []string) bool {
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	afterId := flags.Int64("after-id", 0, "Only move the files with a greater id")
+	batchSize := flags.Int("batch-size", 100, "Number of files fetched per query")
+	flags.Parse(args)
+	appDb, fileService := newFileService(config.New())
+	report, err := fileService.MigrateLayout(context.Background(), *afterId, *batchSize)
+	closeErr := appDb.Close()
+	if closeErr != nil {
+		log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, closeErr))
+	}
+	for _, failure := range report.Failures {
+		fmt.Printf("Failed to move file %d: %s\n", failure.FileId, failure.Reason)
+	}
+	fmt.Printf("Moved %d files to their sharded path. Last processed file id: %d\n", report.Migrated, report.LastId)
+	if err != nil {
+		fmt.Printf("Migration stopped: %v. Resume with -after-id %d\n", err, report.LastId)
+	}
+	return err == nil && len(report.Failures) == 0
+}
+
+// migratePaths replaces the absolute paths stored before the paths were relative to UPLOAD_DIR by their relative
+// path. -from-dir is the upload dir the absolute paths were built from, if it has changed since. It returns false if any
+// file failed.
+func migratePaths(args []string) bool {
+	flags := flag.NewFlagSet("migrate-paths", flag.ExitOnError)
+	fromDir := flags.String("from-dir", "", "Upload dir of the stored paths. Defaults to UPLOAD_DIR")
+	afterId := flags.Int64("after-id", 0, "Only migrate the files with a greater id")
+	batchSize := flags.Int("batch-size", 100, "Number of files fetched per query")
+	flags.Parse(args)
+	appDb, fileService := newFileService(config.New())
+	report, err := fileService.MigrateFilePaths(context.Background(), *fromDir, *afterId, *batchSize)
+	closeErr := appDb.Close()
+	if closeErr != nil {
+		log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, closeErr))
+	}
+	for _, failure := range report.Failures {
+		fmt.Printf("Failed to migrate file %d: %s\n", failure.FileId, failure.Reason)
+	}
+	fmt.Printf("Migrated the path of %d files. Last processed file id: %d\n", report.Migrated, report.LastId)
+	if err != nil {
+		fmt.Printf("Migration stopped: %v. Resume with -after-id %d\n", err, report.LastId)
+	}
+	return err == nil && len(report.Failures) == 0
+}
+
+// migrateStorage moves the files from one storage backend to another, eg from the upload dir to REMOTE_S3_BUCKET. Run
+// it again to retry the files that failed, or with -after-id set to the reported last id to resume. It returns false if
+// any file failed.
+func migrateStorage(args []string) bool {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	from := flags.String("from", repository.BackendHot, "Backend to move the files from: hot, cold or remote")
+	to := flags.String("to", repository.BackendRemote, "Backend to move the files to: hot, cold or remote")
+	afterId := flags.Int64("after-id", 0, "Only move the files with a greater id")
+	batchSize := flags.Int("batch-size", 100, "Number of files fetched per query")
+	concurrency := flags.Int("concurrency", 4, "Number of files copied at once")
+	keepSource := flags.Bool("keep-source", false, "Keep the source blobs once the files are moved")
+	flags.Parse(args)
+	appDb, fileService := newFileService(config.New())
+	options := ivdnService.StorageMigrationOptions{AfterId: *afterId, BatchSize: *batchSize, Concurrency: *concurrency, KeepSource: *keepSource}
+	report, err := fileService.MigrateStorage(context.Background(), *from, *to, options)
+	closeErr := appDb.Close()
+	if closeErr != nil {
+		log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, closeErr))
+	}
+	for _, failure := range report.Failures {
+		fmt.Printf("Failed to move file %d: %s\n", failure.FileId, failure.Reason)
+	}
+	fmt.Printf("Moved %d files to the %s storage. Last processed file id: %d\n", report.Migrated, *to, report.LastId)
+	if err != nil {
+		fmt.Printf("Migration stopped: %v. Resume with -after-id %d\n", err, report.LastId)
+	}
+	return err == nil && len(report.Failures) == 0
+}
+
+// reconcile reports the files whose blob is missing and the orphan blobs, which no file references, then handles the
+// orphans as asked. It returns false if it failed.
+func reconcile(args []string) bool {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	orphans := flags.String("orphans", ivdnService.OrphanReport, "What to do with the orphans: report, quarantine or delete")
+	dryRun := flags.Bool("dry-run", false, "Only print what would be done with the orphans")
+	flags.Parse(args)
+	appDb, fileService := newFileService(config.New())
+	report, err := fileService.Reconcile(context.Background(), *orphans, *dryRun)
+	closeErr := appDb.Close()
+	if closeErr != nil {
+		log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, closeErr))
+	}
+	for _, missingBlob := range report.MissingBlobs {
+		fmt.Printf("Missing blob of file %d: %s\n", missingBlob.FileId, missingBlob.FilePath)
+	}
+	for _, orphan := range report.Orphans {
+		fmt.Printf("Orphan: %s\n", orphan)
+	}
+	for _, failure := range report.Failures {
+		fmt.Printf("Failed to %s orphan %s: %s\n", *orphans, failure.Path, failure.Reason)
+	}
+	fmt.Printf("%d missing blobs, %d orphans\n", len(report.MissingBlobs), len(report.Orphans))
+	if err != nil {
+		fmt.Printf("Reconciliation failed: %v\n", err)
+	}
+	return err == nil
+}
+
+// migrate applies or rolls back the schema migrations, then prints their status. It returns false if it failed.
+// Usage: migrate up|down|to <version>|status
+func migrate(args []string) bool {
+	appDb := newDb(config.New())
+	defer func() {
+		err := appDb.Close()
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to close %v db. %v", appDb.DataSourceName, err))
+		}
+	}()
+	migrator, err := migrations.NewMigrator(appDb)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch {
+	case command == "up":
+		err = migrator.Up()
+	case command == "down":
+		err = migrator.Down()
+	case command == "to" && len(args) == 2:
+		var version int64
+		version, err = strconv.ParseInt(args[1], 10, 64)
+		if err == nil {
+			err = migrator.MigrateTo(version)
+		}
+	case command == "status":
+	default:
+		fmt.Println("Usage: migrate up|down|to <version>|status")
+		return false
+	}
+	if err != nil {
+		fmt.Printf("Migration failed: %v\n", err)
+	}
+	statuses, statusErr := migrator.Status()
+	if statusErr != nil {
+		fmt.Printf("Failed to get the migration status: %v\n", statusErr)
+		return false
+	}
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedDt != nil {
+			applied = "applied " + status.AppliedDt.Format(time.RFC3339)
+		}
+		fmt.Printf("%d_%s\t%s\n", status.Version, status.Name, applied)
+	}
+	return err == nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gocleancode/config"
+	"gocleancode/handlers"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileLifecycleWithSqlite runs the whole app against an embedded sqlite db, so no database server is needed.
+func TestFileLifecycleWithSqlite(t *testing.T) {
+	// Given
+	dataDir, err := ioutil.TempDir("", "main_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	env := map[string]string{"DB_DRIVER": "sqlite", "DB_NAME": filepath.Join(dataDir, "gocleancode.db"), "UPLOAD_DIR": dataDir}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	server := NewServer()
+	defer server.Shutdown(context.Background())
+	testServer := httptest.NewServer(server.Handler)
+	defer testServer.Close()
+	fileContents := "This is a test."
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "TestFileLifecycleWithSqlite.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(fileContents))
+	writer.Close()
+	// When
+	uploadResponse, err := http.Post(testServer.URL+"/files", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uploadResponse.Body.Close()
+	// Then
+	assert.Equal(t, http.StatusCreated, uploadResponse.StatusCode)
+	response := Response{}
+	json.NewDecoder(uploadResponse.Body).Decode(&response)
+	var fileId int64
+	fmt.Sscanf(response.Message, "Created file with id %d.", &fileId)
+	assert.NotZero(t, fileId)
+	fileUrl := fmt.Sprintf("%s/files/%d", testServer.URL, fileId)
+	getResponse, err := http.Get(fileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer getResponse.Body.Close()
+	downloadedContents, err := ioutil.ReadAll(getResponse.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, getResponse.StatusCode)
+	assert.Equal(t, fileContents, string(downloadedContents))
+	deleteRequest, _ := http.NewRequest(http.MethodDelete, fileUrl, nil)
+	deleteResponse, err := http.DefaultClient.Do(deleteRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteResponse.Body.Close()
+	assert.Equal(t, http.StatusOK, deleteResponse.StatusCode)
+	getDeletedResponse, err := http.Get(fileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getDeletedResponse.Body.Close()
+	assert.Equal(t, http.StatusNotFound, getDeletedResponse.StatusCode)
+}
+
+func TestCheckCompressionRules(t *testing.T) {
+	assert.Nil(t, checkCompressionRules([]config.CompressionRule{{ContentTypes: []string{"text/*"}, Encoding: "zstd"},
+		{ContentTypes: []string{"application/json"}, Encoding: "gzip"}}))
+	assert.NotNil(t, checkCompressionRules([]config.CompressionRule{{ContentTypes: []string{"text/*"}, Encoding: "br"}}))
+}
+
+// TestRetentionPast2038WithSqlite sets a retention beyond the range of the mysql TIMESTAMP columns.
+func TestRetentionPast2038WithSqlite(t *testing.T) {
+	// Given
+	dataDir, err := ioutil.TempDir("", "main_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	env := map[string]string{"DB_DRIVER": "sqlite", "DB_NAME": filepath.Join(dataDir, "gocleancode.db"), "UPLOAD_DIR": dataDir,
+		"ADMIN_TOKEN": "secret"}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	server := NewServer()
+	defer server.Shutdown(context.Background())
+	testServer := httptest.NewServer(server.Handler)
+	defer testServer.Close()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "TestRetentionPast2038WithSqlite.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("Kept for decades."))
+	writer.Close()
+	uploadResponse, err := http.Post(testServer.URL+"/files", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := Response{}
+	json.NewDecoder(uploadResponse.Body).Decode(&response)
+	uploadResponse.Body.Close()
+	var fileId int64
+	fmt.Sscanf(response.Message, "Created file with id %d.", &fileId)
+	// When
+	retentionRequest, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/admin/files/%d/retention", testServer.URL, fileId),
+		bytes.NewBufferString(`{"retentionUntil": "2100-01-01T00:00:00Z"}`))
+	retentionRequest.Header.Set("Authorization", "Bearer secret")
+	retentionResponse, err := http.DefaultClient.Do(retentionRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retentionResponse.Body.Close()
+	// Then
+	assert.Equal(t, http.StatusOK, retentionResponse.StatusCode)
+	retention := handlers.RetentionResponse{}
+	json.NewDecoder(retentionResponse.Body).Decode(&retention)
+	assert.Equal(t, 2100, retention.RetentionUntil.Year())
+	deleteRequest, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/files/%d", testServer.URL, fileId), nil)
+	deleteResponse, err := http.DefaultClient.Do(deleteRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteResponse.Body.Close()
+	assert.Equal(t, http.StatusLocked, deleteResponse.StatusCode)
+}
@@ -1,53 +1,214 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gocleancode/db"
+	"strings"
 	"time"
 )
 
 type FileRepo interface {
-	SaveFile(file File) (int64, error)
-	GetFileById(id int64) (File, error)
-	TxDeleteFileById(id int64, tx *sql.Tx) error
+	SaveFile(ctx context.Context, file File) (int64, error)
+	TxSaveFile(ctx context.Context, file File, tx *sql.Tx) (int64, error)
+	GetFileById(ctx context.Context, bucket string, id int64) (File, error)
+	GetFilesCreatedBefore(ctx context.Context, bucket string, createdBefore time.Time, afterId int64, limit int) ([]File, error)
+	TxDeleteFileById(ctx context.Context, bucket string, id int64, tx *sql.Tx) error
+	GetUsage(ctx context.Context, bucket string, owner *string) (Usage, error)
+	TxGetUsage(ctx context.Context, bucket string, owner *string, tx *sql.Tx) (Usage, error)
+	TxLockQuota(ctx context.Context, bucket string, tx *sql.Tx) error
+	GetUnscannedFiles(ctx context.Context, afterId int64, limit int) ([]File, error)
+	UpdateScanStatus(ctx context.Context, id int64, filePath string, scanStatus string, movedTo *string) (bool, error)
+	GetFilesNotWrappedBy(ctx context.Context, keyId string, afterId int64, limit int) ([]File, error)
+	UpdateWrappedKey(ctx context.Context, id int64, oldKeyId string, keyId string, wrappedKey string) (bool, error)
+	TxSavePendingDeletion(ctx context.Context, filePath string, backend *string, tx *sql.Tx) (int64, error)
+	TxDeletePendingDeletion(ctx context.Context, id int64, tx *sql.Tx) error
+	DeletePendingDeletion(ctx context.Context, id int64) error
+	GetPendingDeletions(ctx context.Context, createdBefore time.Time, afterId int64, limit int) ([]PendingDeletion, error)
+	GetFiles(ctx context.Context, afterId int64, limit int) ([]File, error)
+	GetReferencedFilePaths(ctx context.Context, filePaths []string) ([]string, error)
+	GetFilesScrubbedBefore(ctx context.Context, scrubbedBefore time.Time, afterId int64, limit int) ([]File, error)
+	UpdateIntegrity(ctx context.Context, id int64, checksum *string, integrityStatus string) error
+	GetUnreplicatedFiles(ctx context.Context, afterId int64, limit int) ([]File, error)
+	UpdateReplicationStatus(ctx context.Context, id int64, replicationStatus string) error
+	GetFilesOlderThan(ctx context.Context, createdBefore time.Time, afterId int64, limit int) ([]File, error)
+	TxUpdateBackend(ctx context.Context, id int64, fromBackend string, toBackend string, tx *sql.Tx) (bool, error)
+	GetExpiredFiles(ctx context.Context, expiredBefore time.Time, afterId int64, limit int) ([]File, error)
+	TxUpdateRetention(ctx context.Context, id int64, retentionUntil *time.Time, legalHold bool, tx *sql.Tx) (bool, error)
+	TxSaveAuditLogEntry(ctx context.Context, entry AuditLogEntry, tx *sql.Tx) (int64, error)
+	GetAuditLog(ctx context.Context, bucket string, fileId int64) ([]AuditLogEntry, error)
+	TxUpdateFilePath(ctx context.Context, id int64, fromPath string, toPath string, tx *sql.Tx) (bool, error)
 }
 
+// Scan statuses of the files. Only clean files can be downloaded.
+const (
+	ScanStatusPending  = "pending"
+	ScanStatusClean    = "clean"
+	ScanStatusInfected = "infected"
+	ScanStatusError    = "error"
+)
+
+// Integrity statuses of the files, as found by the last scrub.
+const (
+	IntegrityOk      = "ok"
+	IntegrityCorrupt = "corrupt"
+)
+
+// Storage backends of the blobs. The lifecycle rules move the files from the hot or remote to the cold one. The
+// migrate-storage command moves them between any two.
+const (
+	BackendHot    = "hot" // The upload dir
+	BackendCold   = "cold"
+	BackendRemote = "remote" // Hot storage in an S3 bucket
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditSetRetention = "set_retention"
+	AuditSetLegalHold = "set_legal_hold"
+)
+
+// Replication statuses of the files, when a secondary storage is configured.
+const (
+	ReplicationPending    = "pending"
+	ReplicationReplicated = "replicated"
+)
+
 type fileRepo struct {
 	Db db.DB
 }
 
 type File struct {
 	Id          *int64
+	Bucket      *string
+	Owner       *string
 	FileName    *string
-	FilePath    *string
+	FilePath    *string // Relative to the upload dir. Absolute if outside of it, or stored by earlier versions
 	ContentType *string
-	CreatedDt   *time.Time
+	Size        *int64
+	ScanStatus  *string
+	// Id of the master key that wrapped the data key. Both are nil if the file is not encrypted.
+	EncryptionKeyId *string
+	WrappedKey      *string
+	CreatedDt       *time.Time
+	// Hex encoded sha256 of the stored blob. Nil for the files stored before checksums were recorded.
+	Checksum        *string
+	IntegrityStatus *string // Nil until scrubbed
+	ScrubbedDt      *time.Time
+	// Whether the blob was copied to the secondary storage. Nil if there is none.
+	ReplicationStatus *string
+	Backend           *string    // Defaults to BackendHot
+	Tags              *string    // Comma separated
+	ExpiresDt         *time.Time // Nil if the file never expires
+	// The file can't be deleted before RetentionUntilDt, nor while on legal hold.
+	RetentionUntilDt *time.Time
+	LegalHold        *bool
+	ContentEncoding  *string // Of the stored blob, gzip or zstd. Nil if stored as is
+}
+
+// AuditLogEntry records a change to the retention or the legal hold of a file. The entries are kept after the file is
+// deleted.
+type AuditLogEntry struct {
+	Id        *int64
+	Bucket    *string
+	FileId    *int64
+	Action    *string
+	OldValue  *string // Nil if the value was not set
+	NewValue  *string
+	Actor     *string
+	CreatedDt *time.Time
+}
+
+// PendingDeletion is a blob to remove once the transaction that recorded it has committed. The rows left behind by a
+// crash are removed by a sweep.
+type PendingDeletion struct {
+	Id        *int64
+	FilePath  *string
+	CreatedDt *time.Time
+	Backend   *string // The blob is deleted from every backend if nil
+}
+
+// Usage is the storage consumed by a bucket or by an owner within a bucket.
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// fileColumns are the columns scanned by scanFile.
+const fileColumns = "id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, " +
+	"checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, " +
+	"retention_until_dt, legal_hold, content_encoding"
+
+// unprotected matches the files that can be deleted. Its arguments are false, for the legal hold, and the current time.
+const unprotected = "legal_hold = ? and (retention_until_dt is null or retention_until_dt < ?)"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row scanner) (File, error) {
+	file := File{}
+	err := row.Scan(&file.Id, &file.Bucket, &file.Owner, &file.FileName, &file.FilePath, &file.ContentType, &file.Size, &file.ScanStatus, &file.EncryptionKeyId,
+		&file.WrappedKey, &file.CreatedDt, &file.Checksum, &file.IntegrityStatus, &file.ScrubbedDt, &file.ReplicationStatus,
+		&file.Backend, &file.Tags, &file.ExpiresDt, &file.RetentionUntilDt, &file.LegalHold, &file.ContentEncoding)
+	return file, err
+}
+
+func scanFiles(rows *sql.Rows) ([]File, error) {
+	var files []File
+	defer rows.Close()
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			log.Error(err)
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
 }
 
 func NewFileRepo(db db.DB) FileRepo {
 	return fileRepo{Db: db}
 }
 
-func (repo fileRepo) SaveFile(file File) (int64, error) {
-	var generatedId int64
+const insertFileQuery = "INSERT INTO files(bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, " +
+	"replication_status, backend, tags, expires_dt, content_encoding) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+// insertFileArgs returns the values of insertFileQuery, defaulting the creation date, the scan status and the backend.
+func insertFileArgs(file File) []interface{} {
 	if file.CreatedDt == nil {
 		now := time.Now()
 		file.CreatedDt = &now
 	}
-	stmt, err := repo.Db.Prepare("INSERT INTO files(file_name, file_path, content_type, created_dt) VALUES(?, ?, ?, ?)")
-	if err != nil {
-		log.Error(err)
-		return generatedId, err
+	if file.ScanStatus == nil {
+		scanStatus := ScanStatusPending
+		file.ScanStatus = &scanStatus
 	}
-	defer stmt.Close()
-	res, err := stmt.Exec(file.FileName, file.FilePath, file.ContentType, file.CreatedDt)
+	if file.Backend == nil {
+		backend := BackendHot
+		file.Backend = &backend
+	}
+	return []interface{}{file.Bucket, file.Owner, file.FileName, file.FilePath, file.ContentType, file.Size, file.ScanStatus,
+		file.EncryptionKeyId, file.WrappedKey, file.CreatedDt, file.Checksum, file.ReplicationStatus, file.Backend, file.Tags, file.ExpiresDt,
+		file.ContentEncoding}
+}
+
+func (repo fileRepo) SaveFile(ctx context.Context, file File) (int64, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	generatedId, err := repo.Db.Insert(ctx, insertFileQuery, insertFileArgs(file)...)
 	if err != nil {
 		log.Error(err)
 		return generatedId, err
 	}
-	generatedId, err = res.LastInsertId()
+	return generatedId, nil
+}
+
+func (repo fileRepo) TxSaveFile(ctx context.Context, file File, tx *sql.Tx) (int64, error) {
+	generatedId, err := repo.Db.TxInsert(ctx, tx, insertFileQuery, insertFileArgs(file)...)
 	if err != nil {
 		log.Error(err)
 		return generatedId, err
@@ -55,28 +216,426 @@ func (repo fileRepo) SaveFile(file File) (int64, error) {
 	return generatedId, nil
 }
 
-func (repo fileRepo) GetFileById(id int64) (File, error) {
-	file := File{}
-	row := repo.Db.QueryRow("SELECT id, file_name, file_path, content_type, created_dt from files where id = ?", id)
-	err := row.Scan(&file.Id, &file.FileName, &file.FilePath, &file.ContentType, &file.CreatedDt)
+func (repo fileRepo) GetFileById(ctx context.Context, bucket string, id int64) (File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	row := repo.Db.QueryRowContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where id = ? and bucket = ?"), id, bucket)
+	file, err := scanFile(row)
 	if err != nil {
 		return file, err
 	}
 	return file, nil
 }
 
-func (repo fileRepo) TxDeleteFileById(id int64, tx *sql.Tx) error {
-	stmt, err := tx.Prepare("DELETE from files where id = ?")
+func (repo fileRepo) GetUnscannedFiles(ctx context.Context, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where scan_status in (?, ?) and id > ? order by id limit ?"), ScanStatusPending, ScanStatusError, afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+func (repo fileRepo) GetFiles(ctx context.Context, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where id > ? order by id limit ?"), afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// GetReferencedFilePaths returns the paths, among filePaths, of which a file exists.
+func (repo fileRepo) GetReferencedFilePaths(ctx context.Context, filePaths []string) ([]string, error) {
+	if len(filePaths) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	args := make([]interface{}, len(filePaths))
+	for i, filePath := range filePaths {
+		args[i] = filePath
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(filePaths)), ", ")
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT file_path from files where file_path in ("+placeholders+")"), args...)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var referencedPaths []string
+	for rows.Next() {
+		var filePath string
+		err = rows.Scan(&filePath)
+		if err != nil {
+			log.Error(err)
+			return referencedPaths, err
+		}
+		referencedPaths = append(referencedPaths, filePath)
+	}
+	return referencedPaths, rows.Err()
+}
+
+// GetFilesScrubbedBefore returns the files that were never scrubbed or not since scrubbedBefore.
+func (repo fileRepo) GetFilesScrubbedBefore(ctx context.Context, scrubbedBefore time.Time, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where (scrubbed_dt is null or scrubbed_dt < ?) and id > ? order by id limit ?"), scrubbedBefore, afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// UpdateIntegrity records the result of a scrub of the file.
+func (repo fileRepo) UpdateIntegrity(ctx context.Context, id int64, checksum *string, integrityStatus string) error {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	_, err := repo.Db.ExecContext(ctx, repo.Db.Rebind("UPDATE files set checksum = ?, integrity_status = ?, scrubbed_dt = ? where id = ?"), checksum, integrityStatus, time.Now(), id)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+// GetUnreplicatedFiles returns the files whose blob is still to be copied to the secondary storage.
+func (repo fileRepo) GetUnreplicatedFiles(ctx context.Context, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where replication_status = ? and id > ? order by id limit ?"), ReplicationPending, afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+func (repo fileRepo) UpdateReplicationStatus(ctx context.Context, id int64, replicationStatus string) error {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	_, err := repo.Db.ExecContext(ctx, repo.Db.Rebind("UPDATE files set replication_status = ? where id = ?"), replicationStatus, id)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+// GetFilesOlderThan returns the files of every bucket created before createdBefore.
+func (repo fileRepo) GetFilesOlderThan(ctx context.Context, createdBefore time.Time, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where created_dt < ? and id > ? order by id limit ?"), createdBefore, afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// TxUpdateBackend moves the file to toBackend only if it is still on fromBackend. It returns false if the file was
+// deleted or moved concurrently.
+func (repo fileRepo) TxUpdateBackend(ctx context.Context, id int64, fromBackend string, toBackend string, tx *sql.Tx) (bool, error) {
+	stmt, err := tx.PrepareContext(ctx, repo.Db.Rebind("UPDATE files set backend = ? where id = ? and backend = ?"))
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, toBackend, id, fromBackend)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// TxUpdateFilePath moves the file to toPath only if it is still at fromPath. It returns false if the file was deleted
+// or moved concurrently.
+func (repo fileRepo) TxUpdateFilePath(ctx context.Context, id int64, fromPath string, toPath string, tx *sql.Tx) (bool, error) {
+	stmt, err := tx.PrepareContext(ctx, repo.Db.Rebind("UPDATE files set file_path = ? where id = ? and file_path = ?"))
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
 	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, toPath, id, fromPath)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UpdateScanStatus sets the scan status of the file only if it is still at filePath, and moves it to movedTo unless
+// it's nil. It returns false if the file was deleted or moved concurrently.
+func (repo fileRepo) UpdateScanStatus(ctx context.Context, id int64, filePath string, scanStatus string, movedTo *string) (bool, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	query, args := "UPDATE files set scan_status = ? where id = ? and file_path = ?", []interface{}{scanStatus, id, filePath}
+	if movedTo != nil {
+		query, args = "UPDATE files set scan_status = ?, file_path = ? where id = ? and file_path = ?", []interface{}{scanStatus, *movedTo, id, filePath}
+	}
+	res, err := repo.Db.ExecContext(ctx, repo.Db.Rebind(query), args...)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetFilesNotWrappedBy returns the encrypted files whose data key is wrapped by a master key other than keyId.
+func (repo fileRepo) GetFilesNotWrappedBy(ctx context.Context, keyId string, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where encryption_key_id is not null and encryption_key_id <> ? and id > ? order by id limit ?"), keyId, afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// UpdateWrappedKey replaces the wrapped data key only if it is still wrapped by oldKeyId. It returns false if the file
+// was deleted or rewrapped concurrently.
+func (repo fileRepo) UpdateWrappedKey(ctx context.Context, id int64, oldKeyId string, keyId string, wrappedKey string) (bool, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	res, err := repo.Db.ExecContext(ctx, repo.Db.Rebind("UPDATE files set encryption_key_id = ?, wrapped_key = ? where id = ? and encryption_key_id = ?"), keyId, wrappedKey, id, oldKeyId)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (repo fileRepo) GetFilesCreatedBefore(ctx context.Context, bucket string, createdBefore time.Time, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where bucket = ? and created_dt < ? and "+unprotected+" and id > ? order by id limit ?"), bucket, createdBefore, false, time.Now(), afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// TxDeleteFileById deletes the file unless it is protected by a retention or a legal hold. sql.ErrNoRows is returned if
+// no file was deleted.
+func (repo fileRepo) TxDeleteFileById(ctx context.Context, bucket string, id int64, tx *sql.Tx) error {
+	stmt, err := tx.PrepareContext(ctx, repo.Db.Rebind("DELETE from files where id = ? and bucket = ? and "+unprotected))
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	res, err := stmt.Exec(id)
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, id, bucket, false, time.Now())
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 	log.Debug(fmt.Sprintf("TxDeleteFileById response = %v", res))
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
+
+// GetUsage sums the size and count of the files in the bucket. If owner is not nil, only the owner's files are counted.
+func (repo fileRepo) GetUsage(ctx context.Context, bucket string, owner *string) (Usage, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	query, args := usageQuery(bucket, owner)
+	return scanUsage(repo.Db.QueryRowContext(ctx, repo.Db.Rebind(query), args...))
+}
+
+// TxGetUsage is GetUsage within the transaction.
+func (repo fileRepo) TxGetUsage(ctx context.Context, bucket string, owner *string, tx *sql.Tx) (Usage, error) {
+	query, args := usageQuery(bucket, owner)
+	return scanUsage(tx.QueryRowContext(ctx, repo.Db.Rebind(query), args...))
+}
+
+func usageQuery(bucket string, owner *string) (string, []interface{}) {
+	if owner == nil {
+		return "SELECT COALESCE(SUM(size), 0), COUNT(*) from files where bucket = ?", []interface{}{bucket}
+	}
+	return "SELECT COALESCE(SUM(size), 0), COUNT(*) from files where bucket = ? and owner = ?", []interface{}{bucket, *owner}
+}
+
+func scanUsage(row *sql.Row) (Usage, error) {
+	usage := Usage{}
+	err := row.Scan(&usage.Bytes, &usage.Files)
+	if err != nil {
+		log.Error(err)
+		return usage, err
+	}
+	return usage, nil
+}
+
+// TxLockQuota locks the quotas of the bucket until the transaction ends, so that the uploads checking them are
+// serialized.
+func (repo fileRepo) TxLockQuota(ctx context.Context, bucket string, tx *sql.Tx) error {
+	err := repo.Db.TxLock(ctx, tx, "quota_"+bucket)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (repo fileRepo) TxSavePendingDeletion(ctx context.Context, filePath string, backend *string, tx *sql.Tx) (int64, error) {
+	generatedId, err := repo.Db.TxInsert(ctx, tx, "INSERT INTO pending_deletions(file_path, created_dt, backend) VALUES(?, ?, ?)", filePath, time.Now(), backend)
+	if err != nil {
+		log.Error(err)
+		return generatedId, err
+	}
+	return generatedId, nil
+}
+
+func (repo fileRepo) TxDeletePendingDeletion(ctx context.Context, id int64, tx *sql.Tx) error {
+	stmt, err := tx.PrepareContext(ctx, repo.Db.Rebind("DELETE from pending_deletions where id = ?"))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, id)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (repo fileRepo) DeletePendingDeletion(ctx context.Context, id int64) error {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	_, err := repo.Db.ExecContext(ctx, repo.Db.Rebind("DELETE from pending_deletions where id = ?"), id)
+	if err != nil {
+		log.Error(err)
+	}
+	return err
+}
+
+func (repo fileRepo) GetPendingDeletions(ctx context.Context, createdBefore time.Time, afterId int64, limit int) ([]PendingDeletion, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT id, file_path, created_dt, backend from pending_deletions where created_dt < ? and id > ? order by id limit ?"),
+		createdBefore, afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var pendingDeletions []PendingDeletion
+	for rows.Next() {
+		pendingDeletion := PendingDeletion{}
+		err = rows.Scan(&pendingDeletion.Id, &pendingDeletion.FilePath, &pendingDeletion.CreatedDt, &pendingDeletion.Backend)
+		if err != nil {
+			log.Error(err)
+			return pendingDeletions, err
+		}
+		pendingDeletions = append(pendingDeletions, pendingDeletion)
+	}
+	return pendingDeletions, rows.Err()
+}
+
+// GetExpiredFiles returns the files whose expiry is before expiredBefore with an id greater than afterId, ordered by id.
+// Protected files are left out.
+func (repo fileRepo) GetExpiredFiles(ctx context.Context, expiredBefore time.Time, afterId int64, limit int) ([]File, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT "+fileColumns+" from files where expires_dt < ? and "+unprotected+" and id > ? order by id limit ?"), expiredBefore, false, time.Now(), afterId, limit)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// TxUpdateRetention sets the retention and the legal hold of the file. The retention can only be extended: false is
+// returned if the file was deleted or has a later retention.
+func (repo fileRepo) TxUpdateRetention(ctx context.Context, id int64, retentionUntil *time.Time, legalHold bool, tx *sql.Tx) (bool, error) {
+	stmt, err := tx.PrepareContext(ctx, repo.Db.Rebind("UPDATE files set retention_until_dt = ?, legal_hold = ? where id = ? and (retention_until_dt is null or retention_until_dt <= ?)"))
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, retentionUntil, legalHold, id, retentionUntil)
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (repo fileRepo) TxSaveAuditLogEntry(ctx context.Context, entry AuditLogEntry, tx *sql.Tx) (int64, error) {
+	if entry.CreatedDt == nil {
+		now := time.Now()
+		entry.CreatedDt = &now
+	}
+	generatedId, err := repo.Db.TxInsert(ctx, tx, "INSERT INTO audit_log(bucket, file_id, action, old_value, new_value, actor, created_dt) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		entry.Bucket, entry.FileId, entry.Action, entry.OldValue, entry.NewValue, entry.Actor, entry.CreatedDt)
+	if err != nil {
+		log.Error(err)
+		return generatedId, err
+	}
+	return generatedId, nil
+}
+
+// GetAuditLog returns the audit log of the file of the bucket, the oldest entry first, whether the file still exists or
+// not.
+func (repo fileRepo) GetAuditLog(ctx context.Context, bucket string, fileId int64) ([]AuditLogEntry, error) {
+	ctx, cancel := repo.Db.WithTimeout(ctx)
+	defer cancel()
+	rows, err := repo.Db.QueryContext(ctx, repo.Db.Rebind("SELECT id, bucket, file_id, action, old_value, new_value, actor, created_dt from audit_log where bucket = ? and file_id = ? order by id"), bucket, fileId)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditLogEntry
+	for rows.Next() {
+		entry := AuditLogEntry{}
+		err = rows.Scan(&entry.Id, &entry.Bucket, &entry.FileId, &entry.Action, &entry.OldValue, &entry.NewValue, &entry.Actor, &entry.CreatedDt)
+		if err != nil {
+			log.Error(err)
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
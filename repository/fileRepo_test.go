@@ -1,6 +1,7 @@
 package repository_test
 
 import (
+	"context"
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
@@ -13,100 +14,732 @@ import (
 	"time"
 )
 
-func TestSaveFile(t *testing.T) {
-	// Given
-	mockDb, mock, err := sqlmock.New()
-	if err != nil {
-		log.Fatal("an error was not expected when opening a stub database connection", err)
-	}
-	defer mockDb.Close()
-	repo := repository.NewFileRepo(myDb.DB{mockDb, "mockdb"})
-
-	fileName := "fname"
-	filePath := "/some/file/path"
-	contentType := "contentType"
-	createdDt := time.Now()
-	expectedId := int64(1)
-	sqlRegexStr := regexp.QuoteMeta("INSERT INTO files(file_name, file_path, content_type, created_dt) VALUES(?, ?, ?, ?)")
-	mock.
-		ExpectPrepare(sqlRegexStr).
-		ExpectExec().
-		WithArgs(&fileName, &filePath, &contentType, &createdDt).
-		WillReturnResult(sqlmock.NewResult(expectedId, 1))
-	file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt}
-	// When
-	actualGeneratedId, err := repo.SaveFile(file)
-	// Then
-	if err != nil {
-		t.Errorf("Expected no error, but got %s instead", err)
+// forEachDialect runs the test against a mock db of each supported dialect.
+func forEachDialect(t *testing.T, test func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock)) {
+	for _, dialect := range []myDb.Dialect{myDb.MySQL, myDb.Postgres} {
+		t.Run(dialect.Name(), func(t *testing.T) {
+			mockDb, mock, err := sqlmock.New()
+			if err != nil {
+				log.Fatal("an error was not expected when opening a stub database connection", err)
+			}
+			defer mockDb.Close()
+			test(t, myDb.DB{DB: mockDb, DataSourceName: "mockdb", Dialect: dialect}, mock)
+		})
 	}
-	assert.Equal(t, expectedId, actualGeneratedId)
+}
+
+func TestSaveFile(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		bucket := "default"
+		owner := "user1"
+		fileName := "fname"
+		filePath := "/some/file/path"
+		contentType := "contentType"
+		size := int64(15)
+		scanStatus := repository.ScanStatusPending
+		createdDt := time.Now()
+		expectedId := int64(1)
+		keyId := "key1"
+		wrappedKey := "wrappedKey"
+		checksum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		replicationStatus := repository.ReplicationPending
+		backend := repository.BackendCold
+		tags := "export,monthly"
+		expiresDt := createdDt.Add(time.Hour)
+		contentEncoding := "gzip"
+		sqlRegexStr := regexp.QuoteMeta(mockmyDb.Rebind("INSERT INTO files(bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, " +
+			"replication_status, backend, tags, expires_dt, content_encoding) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+		if mockmyDb.Dialect == myDb.Postgres {
+			// Postgres doesn't support LastInsertId
+			mock.
+				ExpectPrepare(sqlRegexStr+regexp.QuoteMeta(" RETURNING id")).
+				ExpectQuery().
+				WithArgs(&bucket, &owner, &fileName, &filePath, &contentType, &size, &scanStatus, &keyId, &wrappedKey, &createdDt, &checksum, &replicationStatus, &backend, &tags, &expiresDt, &contentEncoding).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(expectedId))
+		} else {
+			mock.
+				ExpectPrepare(sqlRegexStr).
+				ExpectExec().
+				WithArgs(&bucket, &owner, &fileName, &filePath, &contentType, &size, &scanStatus, &keyId, &wrappedKey, &createdDt, &checksum, &replicationStatus, &backend, &tags, &expiresDt, &contentEncoding).
+				WillReturnResult(sqlmock.NewResult(expectedId, 1))
+		}
+		file := repository.File{Bucket: &bucket, Owner: &owner, FileName: &fileName, FilePath: &filePath, ContentType: &contentType, Size: &size,
+			ScanStatus: &scanStatus, EncryptionKeyId: &keyId, WrappedKey: &wrappedKey, CreatedDt: &createdDt, Checksum: &checksum,
+			ReplicationStatus: &replicationStatus, Backend: &backend, Tags: &tags, ExpiresDt: &expiresDt, ContentEncoding: &contentEncoding}
+		// When
+		actualGeneratedId, err := repo.SaveFile(context.Background(), file)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, expectedId, actualGeneratedId)
+	})
 }
 
 func TestGetFileById(t *testing.T) {
-	// Given
-	mockDb, mock, err := sqlmock.New()
-	if err != nil {
-		log.Fatal("an error was not expected when opening a stub database connection", err)
-	}
-	defer mockDb.Close()
-	repo := repository.NewFileRepo(myDb.DB{mockDb, "mockdb"})
-
-	id := int64(1)
-	fileName := "fname"
-	filePath := "/some/file/path"
-	contentType := "contentType"
-	createdDt := time.Now()
-	rows := sqlmock.NewRows([]string{"id", "file_name", "file_path", "content_type", "created_dt"}).
-		AddRow(&id, &fileName, &filePath, &contentType, &createdDt)
-
-	expectedFile := repository.File{Id: &id, FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt}
-
-	mock.
-		ExpectQuery("SELECT id, file_name, file_path, content_type, created_dt from files where id = ?").
-		WithArgs(id).
-		WillReturnRows(rows)
-	// When
-	actualFile, err := repo.GetFileById(id)
-	// Then
-	if err != nil {
-		t.Errorf("Expected no error, but got %s instead", err)
-	}
-	// we make sure that all expectations were met
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
-	}
-	assert.Equal(t, expectedFile, actualFile)
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		id := int64(1)
+		bucket := "default"
+		owner := "user1"
+		fileName := "fname"
+		filePath := "/some/file/path"
+		contentType := "contentType"
+		size := int64(15)
+		scanStatus := repository.ScanStatusClean
+		createdDt := time.Now()
+		rows := sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+			"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}).
+			AddRow(&id, &bucket, &owner, &fileName, &filePath, &contentType, &size, &scanStatus, nil, nil, &createdDt, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+
+		expectedFile := repository.File{Id: &id, Bucket: &bucket, Owner: &owner, FileName: &fileName, FilePath: &filePath, ContentType: &contentType, Size: &size,
+			ScanStatus: &scanStatus, CreatedDt: &createdDt}
+
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where id = ? and bucket = ?"))).
+			WithArgs(id, bucket).
+			WillReturnRows(rows)
+		// When
+		actualFile, err := repo.GetFileById(context.Background(), bucket, id)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, expectedFile, actualFile)
+	})
+}
+
+func TestGetFilesCreatedBefore(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		id := int64(1)
+		bucket := "reports"
+		owner := "user1"
+		fileName := "fname"
+		filePath := "/some/file/path"
+		contentType := "contentType"
+		size := int64(15)
+		scanStatus := repository.ScanStatusClean
+		createdDt := time.Now().AddDate(0, 0, -2)
+		createdBefore := time.Now().AddDate(0, 0, -1)
+		rows := sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+			"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}).
+			AddRow(&id, &bucket, &owner, &fileName, &filePath, &contentType, &size, &scanStatus, nil, nil, &createdDt, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+
+		expectedFiles := []repository.File{{Id: &id, Bucket: &bucket, Owner: &owner, FileName: &fileName, FilePath: &filePath, ContentType: &contentType, Size: &size,
+			ScanStatus: &scanStatus, CreatedDt: &createdDt}}
+
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where bucket = ? and created_dt < ? and legal_hold = ? and (retention_until_dt is null or retention_until_dt < ?) and id > ? order by id limit ?"))).
+			WithArgs(bucket, createdBefore, false, sqlmock.AnyArg(), int64(5), 10).
+			WillReturnRows(rows)
+		// When
+		actualFiles, err := repo.GetFilesCreatedBefore(context.Background(), bucket, createdBefore, 5, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, expectedFiles, actualFiles)
+	})
+}
+
+func TestGetUsage(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		bucket := "reports"
+		owner := "user1"
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT COALESCE(SUM(size), 0), COUNT(*) from files where bucket = ?"))).
+			WithArgs(bucket).
+			WillReturnRows(sqlmock.NewRows([]string{"bytes", "files"}).AddRow(100, 3))
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT COALESCE(SUM(size), 0), COUNT(*) from files where bucket = ? and owner = ?"))).
+			WithArgs(bucket, owner).
+			WillReturnRows(sqlmock.NewRows([]string{"bytes", "files"}).AddRow(40, 1))
+		// When
+		bucketUsage, err := repo.GetUsage(context.Background(), bucket, nil)
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		ownerUsage, err := repo.GetUsage(context.Background(), bucket, &owner)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, repository.Usage{Bytes: 100, Files: 3}, bucketUsage)
+		assert.Equal(t, repository.Usage{Bytes: 40, Files: 1}, ownerUsage)
+	})
+}
+
+func TestTxLockQuotaAndGetUsage(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		bucket := "reports"
+		mock.ExpectBegin()
+		if mockmyDb.Dialect == myDb.Postgres {
+			mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_xact_lock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+		} else {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transaction_locks(name) VALUES(?) ON DUPLICATE KEY UPDATE name = name")).
+				WithArgs("quota_" + bucket).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT COALESCE(SUM(size), 0), COUNT(*) from files where bucket = ?"))).
+			WithArgs(bucket).
+			WillReturnRows(sqlmock.NewRows([]string{"bytes", "files"}).AddRow(100, 3))
+		mock.ExpectCommit()
+		// When
+		var usage repository.Usage
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			err := repo.TxLockQuota(context.Background(), bucket, tx)
+			if err != nil {
+				return err
+			}
+			usage, err = repo.TxGetUsage(context.Background(), bucket, nil, tx)
+			return err
+		})
+		// Then
+		assert.Nil(t, err)
+		assert.Equal(t, repository.Usage{Bytes: 100, Files: 3}, usage)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestGetUnscannedFiles(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where scan_status in (?, ?) and id > ? order by id limit ?"))).
+			WithArgs(repository.ScanStatusPending, repository.ScanStatusError, int64(5), 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+				"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}))
+		// When
+		files, err := repo.GetUnscannedFiles(context.Background(), 5, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Empty(t, files)
+	})
+}
+
+func TestUpdateScanStatus(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		id := int64(1)
+		filePath, quarantinePath := "default/ab/cd/blob", "/some/quarantine/path"
+		mock.
+			ExpectExec(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set scan_status = ?, file_path = ? where id = ? and file_path = ?"))).
+			WithArgs(repository.ScanStatusInfected, quarantinePath, id, filePath).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.
+			ExpectExec(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set scan_status = ? where id = ? and file_path = ?"))).
+			WithArgs(repository.ScanStatusClean, id, filePath).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		// When
+		quarantined, err := repo.UpdateScanStatus(context.Background(), id, filePath, repository.ScanStatusInfected, &quarantinePath)
+		cleaned, cleanErr := repo.UpdateScanStatus(context.Background(), id, filePath, repository.ScanStatusClean, nil)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.True(t, quarantined)
+		assert.Nil(t, cleanErr)
+		assert.False(t, cleaned, "the file was moved concurrently")
+	})
+}
+
+func TestGetFilesNotWrappedBy(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where encryption_key_id is not null and encryption_key_id <> ? and id > ? order by id limit ?"))).
+			WithArgs("key2", int64(5), 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+				"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}).AddRow(6, "default", nil, "a.txt", "/a.txt", "text/plain", 1, repository.ScanStatusClean, "key1", "d3JhcHBlZA==", time.Now(), nil, nil, nil, nil, repository.BackendHot, nil, nil, nil, false, nil))
+		// When
+		files, err := repo.GetFilesNotWrappedBy(context.Background(), "key2", 5, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Len(t, files, 1)
+		assert.Equal(t, "key1", *files[0].EncryptionKeyId)
+	})
+}
+
+func TestUpdateWrappedKey(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+
+		id := int64(1)
+		mock.
+			ExpectExec(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set encryption_key_id = ?, wrapped_key = ? where id = ? and encryption_key_id = ?"))).
+			WithArgs("key2", "cmV3cmFwcGVk", id, "key1").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		// When
+		updated, err := repo.UpdateWrappedKey(context.Background(), id, "key1", "key2", "cmV3cmFwcGVk")
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.False(t, updated)
+	})
 }
 
 func TestTxDeleteFileById(t *testing.T) {
-	// Given
-	mockDb, mock, err := sqlmock.New()
-	if err != nil {
-		log.Fatal("an error was not expected when opening a stub database connection", err)
-	}
-	defer mockDb.Close()
-	mockmyDb := myDb.DB{mockDb, "mockdb"}
-	id := int64(1)
-
-	mock.ExpectBegin()
-	mock.
-		ExpectPrepare("DELETE from files where id = ?").
-		ExpectExec().
-		WithArgs(id).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
-	// When
-	err = mockmyDb.Transact(func(tx *sql.Tx) error {
-		repo := repository.NewFileRepo(mockmyDb)
-		return repo.TxDeleteFileById(id, tx)
-	})
-	// Then
-	if err != nil {
-		t.Errorf("Expected no error, but got %s instead", err)
-	}
-	// we make sure that all expectations were met
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
-	}
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		id := int64(1)
+		bucket := "default"
+
+		mock.ExpectBegin()
+		mock.
+			ExpectPrepare(regexp.QuoteMeta(mockmyDb.Rebind("DELETE from files where id = ? and bucket = ? and legal_hold = ? and (retention_until_dt is null or retention_until_dt < ?)"))).
+			ExpectExec().
+			WithArgs(id, bucket, false, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		// When
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			return repo.TxDeleteFileById(context.Background(), bucket, id, tx)
+		})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestTxDeleteFileByIdProtected(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		mock.ExpectBegin()
+		mock.
+			ExpectPrepare(regexp.QuoteMeta(mockmyDb.Rebind("DELETE from files where id = ? and bucket = ? and legal_hold = ? and (retention_until_dt is null or retention_until_dt < ?)"))).
+			ExpectExec().
+			WithArgs(int64(1), "default", false, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+		// When
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			return repo.TxDeleteFileById(context.Background(), "default", 1, tx)
+		})
+		// Then
+		assert.Equal(t, sql.ErrNoRows, err)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestTxSavePendingDeletion(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		filePath := "/some/file/path"
+		backend := repository.BackendHot
+		expectedId := int64(3)
+		sqlRegexStr := regexp.QuoteMeta(mockmyDb.Rebind("INSERT INTO pending_deletions(file_path, created_dt, backend) VALUES(?, ?, ?)"))
+		mock.ExpectBegin()
+		if mockmyDb.Dialect == myDb.Postgres {
+			mock.
+				ExpectPrepare(sqlRegexStr+regexp.QuoteMeta(" RETURNING id")).
+				ExpectQuery().
+				WithArgs(filePath, sqlmock.AnyArg(), &backend).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(expectedId))
+		} else {
+			mock.
+				ExpectPrepare(sqlRegexStr).
+				ExpectExec().
+				WithArgs(filePath, sqlmock.AnyArg(), &backend).
+				WillReturnResult(sqlmock.NewResult(expectedId, 1))
+		}
+		mock.
+			ExpectPrepare(regexp.QuoteMeta(mockmyDb.Rebind("DELETE from pending_deletions where id = ?"))).
+			ExpectExec().
+			WithArgs(expectedId).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		// When
+		var actualId int64
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			var err error
+			actualId, err = repo.TxSavePendingDeletion(context.Background(), filePath, &backend, tx)
+			if err != nil {
+				return err
+			}
+			return repo.TxDeletePendingDeletion(context.Background(), actualId, tx)
+		})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, expectedId, actualId)
+	})
+}
+
+func TestGetPendingDeletions(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		createdBefore := time.Now()
+		createdDt := createdBefore.Add(-time.Hour)
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, file_path, created_dt, backend from pending_deletions where created_dt < ? and id > ? order by id limit ?"))).
+			WithArgs(createdBefore, 2, 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "file_path", "created_dt", "backend"}).AddRow(int64(3), "/some/file/path", createdDt, nil))
+		// When
+		pendingDeletions, err := repo.GetPendingDeletions(context.Background(), createdBefore, 2, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Len(t, pendingDeletions, 1)
+		assert.Equal(t, "/some/file/path", *pendingDeletions[0].FilePath)
+	})
+}
+
+func TestGetReferencedFilePaths(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT file_path from files where file_path in (?, ?)"))).
+			WithArgs("/a", "/b").
+			WillReturnRows(sqlmock.NewRows([]string{"file_path"}).AddRow("/b"))
+		// When
+		referencedPaths, err := repo.GetReferencedFilePaths(context.Background(), []string{"/a", "/b"})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, []string{"/b"}, referencedPaths)
+	})
+}
+
+func TestUpdateIntegrity(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		checksum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		mock.
+			ExpectExec(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set checksum = ?, integrity_status = ?, scrubbed_dt = ? where id = ?"))).
+			WithArgs(&checksum, repository.IntegrityCorrupt, sqlmock.AnyArg(), int64(4)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		// When
+		err := repo.UpdateIntegrity(context.Background(), 4, &checksum, repository.IntegrityCorrupt)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestGetUnreplicatedFiles(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where replication_status = ? and id > ? order by id limit ?"))).
+			WithArgs(repository.ReplicationPending, int64(5), 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+				"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}).AddRow(6, "default", nil, "a.txt", "/a.txt", "text/plain", 1, repository.ScanStatusClean, nil, nil, time.Now(), nil, nil, nil, repository.ReplicationPending, repository.BackendHot, nil, nil, nil, false, nil))
+		// When
+		files, err := repo.GetUnreplicatedFiles(context.Background(), 5, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Len(t, files, 1)
+		assert.Equal(t, repository.ReplicationPending, *files[0].ReplicationStatus)
+	})
+}
+
+func TestUpdateReplicationStatus(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		mock.
+			ExpectExec(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set replication_status = ? where id = ?"))).
+			WithArgs(repository.ReplicationReplicated, int64(4)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		// When
+		err := repo.UpdateReplicationStatus(context.Background(), 4, repository.ReplicationReplicated)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestGetFilesOlderThan(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		createdBefore := time.Now()
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where created_dt < ? and id > ? order by id limit ?"))).
+			WithArgs(createdBefore, int64(5), 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+				"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}).AddRow(6, "default", nil, "a.txt", "/a.txt", "text/plain", 1, repository.ScanStatusClean, nil, nil, createdBefore.Add(-time.Hour), nil, nil, nil, nil, repository.BackendHot, "export", nil, nil, false, nil))
+		// When
+		files, err := repo.GetFilesOlderThan(context.Background(), createdBefore, 5, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Len(t, files, 1)
+		assert.Equal(t, "export", *files[0].Tags)
+	})
+}
+
+func TestTxUpdateBackend(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		mock.ExpectBegin()
+		mock.
+			ExpectPrepare(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set backend = ? where id = ? and backend = ?"))).
+			ExpectExec().
+			WithArgs(repository.BackendCold, int64(4), repository.BackendHot).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		// When
+		var updated bool
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			var err error
+			updated, err = repo.TxUpdateBackend(context.Background(), 4, repository.BackendHot, repository.BackendCold, tx)
+			return err
+		})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.False(t, updated, "the file was moved concurrently")
+	})
+}
+
+func TestGetExpiredFiles(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		expiredBefore := time.Now()
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, owner, file_name, file_path, content_type, size, scan_status, encryption_key_id, wrapped_key, created_dt, checksum, integrity_status, scrubbed_dt, replication_status, backend, tags, expires_dt, retention_until_dt, legal_hold, content_encoding from files where expires_dt < ? and legal_hold = ? and (retention_until_dt is null or retention_until_dt < ?) and id > ? order by id limit ?"))).
+			WithArgs(expiredBefore, false, sqlmock.AnyArg(), int64(5), 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "bucket", "owner", "file_name", "file_path", "content_type", "size", "scan_status", "encryption_key_id", "wrapped_key",
+				"created_dt", "checksum", "integrity_status", "scrubbed_dt", "replication_status", "backend", "tags", "expires_dt", "retention_until_dt", "legal_hold", "content_encoding"}).AddRow(6, "default", nil, "a.txt", "/a.txt", "text/plain", 1, repository.ScanStatusClean, nil, nil, expiredBefore.Add(-time.Hour), nil, nil, nil, nil, repository.BackendHot, nil, expiredBefore.Add(-time.Minute), nil, false, nil))
+		// When
+		files, err := repo.GetExpiredFiles(context.Background(), expiredBefore, 5, 10)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Len(t, files, 1)
+		assert.True(t, files[0].ExpiresDt.Before(expiredBefore))
+	})
+}
+
+func TestTxUpdateRetention(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		retentionUntil := time.Now().AddDate(1, 0, 0)
+		mock.ExpectBegin()
+		mock.
+			ExpectPrepare(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set retention_until_dt = ?, legal_hold = ? where id = ? and (retention_until_dt is null or retention_until_dt <= ?)"))).
+			ExpectExec().
+			WithArgs(&retentionUntil, true, int64(4), &retentionUntil).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		// When
+		var updated bool
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			var err error
+			updated, err = repo.TxUpdateRetention(context.Background(), 4, &retentionUntil, true, tx)
+			return err
+		})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.True(t, updated)
+	})
+}
+
+func TestTxSaveAuditLogEntry(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		bucket, fileId, action, newValue, actor := "reports", int64(4), repository.AuditSetLegalHold, "true", "admin1"
+		oldValue := "false"
+		expectedId := int64(2)
+		sqlRegexStr := regexp.QuoteMeta(mockmyDb.Rebind("INSERT INTO audit_log(bucket, file_id, action, old_value, new_value, actor, created_dt) VALUES(?, ?, ?, ?, ?, ?, ?)"))
+		mock.ExpectBegin()
+		if mockmyDb.Dialect == myDb.Postgres {
+			mock.
+				ExpectPrepare(sqlRegexStr+regexp.QuoteMeta(" RETURNING id")).
+				ExpectQuery().
+				WithArgs(&bucket, &fileId, &action, &oldValue, &newValue, &actor, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(expectedId))
+		} else {
+			mock.
+				ExpectPrepare(sqlRegexStr).
+				ExpectExec().
+				WithArgs(&bucket, &fileId, &action, &oldValue, &newValue, &actor, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(expectedId, 1))
+		}
+		mock.ExpectCommit()
+		// When
+		var actualId int64
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			var err error
+			actualId, err = repo.TxSaveAuditLogEntry(context.Background(), repository.AuditLogEntry{Bucket: &bucket, FileId: &fileId, Action: &action, OldValue: &oldValue,
+				NewValue: &newValue, Actor: &actor}, tx)
+			return err
+		})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Equal(t, expectedId, actualId)
+	})
+}
+
+func TestGetAuditLog(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		repo := repository.NewFileRepo(mockmyDb)
+		createdDt := time.Now()
+		mock.
+			ExpectQuery(regexp.QuoteMeta(mockmyDb.Rebind("SELECT id, bucket, file_id, action, old_value, new_value, actor, created_dt from audit_log where bucket = ? and file_id = ? order by id"))).
+			WithArgs("reports", int64(4)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "bucket", "file_id", "action", "old_value", "new_value", "actor", "created_dt"}).
+				AddRow(1, "reports", 4, repository.AuditSetLegalHold, "false", "true", "admin1", createdDt))
+		// When
+		entries, err := repo.GetAuditLog(context.Background(), "reports", 4)
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.Len(t, entries, 1)
+		assert.Equal(t, repository.AuditSetLegalHold, *entries[0].Action)
+		assert.Equal(t, "true", *entries[0].NewValue)
+	})
+}
+
+func TestTxUpdateFilePath(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, mockmyDb myDb.DB, mock sqlmock.Sqlmock) {
+		// Given
+		mock.ExpectBegin()
+		mock.
+			ExpectPrepare(regexp.QuoteMeta(mockmyDb.Rebind("UPDATE files set file_path = ? where id = ? and file_path = ?"))).
+			ExpectExec().
+			WithArgs("/uploads/default/ab/cd/a.txt", int64(4), "/uploads/default/a.txt").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		// When
+		var updated bool
+		err := mockmyDb.Transact(context.Background(), func(tx *sql.Tx) error {
+			repo := repository.NewFileRepo(mockmyDb)
+			var err error
+			updated, err = repo.TxUpdateFilePath(context.Background(), 4, "/uploads/default/a.txt", "/uploads/default/ab/cd/a.txt", tx)
+			return err
+		})
+		// Then
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		assert.True(t, updated)
+	})
 }
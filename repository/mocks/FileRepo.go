@@ -5,26 +5,295 @@ package mocks
 import "github.com/stretchr/testify/mock"
 import "gocleancode/repository"
 import "database/sql"
+import "time"
+import "context"
 
 // FileRepo is an autogenerated mock type for the FileRepo type
 type FileRepo struct {
 	mock.Mock
 }
 
-// GetFileById provides a mock function with given fields: id
-func (_m *FileRepo) GetFileById(id int64) (repository.File, error) {
-	ret := _m.Called(id)
+// DeletePendingDeletion provides a mock function with given fields: ctx, id
+func (_m *FileRepo) DeletePendingDeletion(ctx context.Context, id int64) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetAuditLog provides a mock function with given fields: ctx, bucket, fileId
+func (_m *FileRepo) GetAuditLog(ctx context.Context, bucket string, fileId int64) ([]repository.AuditLogEntry, error) {
+	ret := _m.Called(ctx, bucket, fileId)
+
+	var r0 []repository.AuditLogEntry
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) []repository.AuditLogEntry); ok {
+		r0 = rf(ctx, bucket, fileId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.AuditLogEntry)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, bucket, fileId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetExpiredFiles provides a mock function with given fields: ctx, expiredBefore, afterId, limit
+func (_m *FileRepo) GetExpiredFiles(ctx context.Context, expiredBefore time.Time, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, expiredBefore, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, int64, int) []repository.File); ok {
+		r0 = rf(ctx, expiredBefore, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, int64, int) error); ok {
+		r1 = rf(ctx, expiredBefore, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFileById provides a mock function with given fields: ctx, bucket, id
+func (_m *FileRepo) GetFileById(ctx context.Context, bucket string, id int64) (repository.File, error) {
+	ret := _m.Called(ctx, bucket, id)
 
 	var r0 repository.File
-	if rf, ok := ret.Get(0).(func(int64) repository.File); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) repository.File); ok {
+		r0 = rf(ctx, bucket, id)
 	} else {
 		r0 = ret.Get(0).(repository.File)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(int64) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, bucket, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFiles provides a mock function with given fields: ctx, afterId, limit
+func (_m *FileRepo) GetFiles(ctx context.Context, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int) []repository.File); ok {
+		r0 = rf(ctx, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int) error); ok {
+		r1 = rf(ctx, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFilesCreatedBefore provides a mock function with given fields: ctx, bucket, createdBefore, afterId, limit
+func (_m *FileRepo) GetFilesCreatedBefore(ctx context.Context, bucket string, createdBefore time.Time, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, bucket, createdBefore, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time, int64, int) []repository.File); ok {
+		r0 = rf(ctx, bucket, createdBefore, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Time, int64, int) error); ok {
+		r1 = rf(ctx, bucket, createdBefore, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFilesNotWrappedBy provides a mock function with given fields: ctx, keyId, afterId, limit
+func (_m *FileRepo) GetFilesNotWrappedBy(ctx context.Context, keyId string, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, keyId, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64, int) []repository.File); ok {
+		r0 = rf(ctx, keyId, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64, int) error); ok {
+		r1 = rf(ctx, keyId, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFilesOlderThan provides a mock function with given fields: ctx, createdBefore, afterId, limit
+func (_m *FileRepo) GetFilesOlderThan(ctx context.Context, createdBefore time.Time, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, createdBefore, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, int64, int) []repository.File); ok {
+		r0 = rf(ctx, createdBefore, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, int64, int) error); ok {
+		r1 = rf(ctx, createdBefore, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFilesScrubbedBefore provides a mock function with given fields: ctx, scrubbedBefore, afterId, limit
+func (_m *FileRepo) GetFilesScrubbedBefore(ctx context.Context, scrubbedBefore time.Time, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, scrubbedBefore, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, int64, int) []repository.File); ok {
+		r0 = rf(ctx, scrubbedBefore, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, int64, int) error); ok {
+		r1 = rf(ctx, scrubbedBefore, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetPendingDeletions provides a mock function with given fields: ctx, createdBefore, afterId, limit
+func (_m *FileRepo) GetPendingDeletions(ctx context.Context, createdBefore time.Time, afterId int64, limit int) ([]repository.PendingDeletion, error) {
+	ret := _m.Called(ctx, createdBefore, afterId, limit)
+
+	var r0 []repository.PendingDeletion
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time, int64, int) []repository.PendingDeletion); ok {
+		r0 = rf(ctx, createdBefore, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.PendingDeletion)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time, int64, int) error); ok {
+		r1 = rf(ctx, createdBefore, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetReferencedFilePaths provides a mock function with given fields: ctx, filePaths
+func (_m *FileRepo) GetReferencedFilePaths(ctx context.Context, filePaths []string) ([]string, error) {
+	ret := _m.Called(ctx, filePaths)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, []string) []string); ok {
+		r0 = rf(ctx, filePaths)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = rf(ctx, filePaths)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUnreplicatedFiles provides a mock function with given fields: ctx, afterId, limit
+func (_m *FileRepo) GetUnreplicatedFiles(ctx context.Context, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int) []repository.File); ok {
+		r0 = rf(ctx, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int) error); ok {
+		r1 = rf(ctx, afterId, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUnscannedFiles provides a mock function with given fields: ctx, afterId, limit
+func (_m *FileRepo) GetUnscannedFiles(ctx context.Context, afterId int64, limit int) ([]repository.File, error) {
+	ret := _m.Called(ctx, afterId, limit)
+
+	var r0 []repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int) []repository.File); ok {
+		r0 = rf(ctx, afterId, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.File)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int) error); ok {
+		r1 = rf(ctx, afterId, limit)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -32,20 +301,90 @@ func (_m *FileRepo) GetFileById(id int64) (repository.File, error) {
 	return r0, r1
 }
 
-// SaveFile provides a mock function with given fields: file
-func (_m *FileRepo) SaveFile(file repository.File) (int64, error) {
-	ret := _m.Called(file)
+// GetUsage provides a mock function with given fields: ctx, bucket, owner
+func (_m *FileRepo) GetUsage(ctx context.Context, bucket string, owner *string) (repository.Usage, error) {
+	ret := _m.Called(ctx, bucket, owner)
+
+	var r0 repository.Usage
+	if rf, ok := ret.Get(0).(func(context.Context, string, *string) repository.Usage); ok {
+		r0 = rf(ctx, bucket, owner)
+	} else {
+		r0 = ret.Get(0).(repository.Usage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, *string) error); ok {
+		r1 = rf(ctx, bucket, owner)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SaveFile provides a mock function with given fields: ctx, file
+func (_m *FileRepo) SaveFile(ctx context.Context, file repository.File) (int64, error) {
+	ret := _m.Called(ctx, file)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func(repository.File) int64); ok {
-		r0 = rf(file)
+	if rf, ok := ret.Get(0).(func(context.Context, repository.File) int64); ok {
+		r0 = rf(ctx, file)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(repository.File) error); ok {
-		r1 = rf(file)
+	if rf, ok := ret.Get(1).(func(context.Context, repository.File) error); ok {
+		r1 = rf(ctx, file)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TxDeleteFileById provides a mock function with given fields: ctx, bucket, id, tx
+func (_m *FileRepo) TxDeleteFileById(ctx context.Context, bucket string, id int64, tx *sql.Tx) error {
+	ret := _m.Called(ctx, bucket, id, tx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64, *sql.Tx) error); ok {
+		r0 = rf(ctx, bucket, id, tx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TxDeletePendingDeletion provides a mock function with given fields: ctx, id, tx
+func (_m *FileRepo) TxDeletePendingDeletion(ctx context.Context, id int64, tx *sql.Tx) error {
+	ret := _m.Called(ctx, id, tx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64, *sql.Tx) error); ok {
+		r0 = rf(ctx, id, tx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TxGetUsage provides a mock function with given fields: ctx, bucket, owner, tx
+func (_m *FileRepo) TxGetUsage(ctx context.Context, bucket string, owner *string, tx *sql.Tx) (repository.Usage, error) {
+	ret := _m.Called(ctx, bucket, owner, tx)
+
+	var r0 repository.Usage
+	if rf, ok := ret.Get(0).(func(context.Context, string, *string, *sql.Tx) repository.Usage); ok {
+		r0 = rf(ctx, bucket, owner, tx)
+	} else {
+		r0 = ret.Get(0).(repository.Usage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, *string, *sql.Tx) error); ok {
+		r1 = rf(ctx, bucket, owner, tx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -53,16 +392,212 @@ func (_m *FileRepo) SaveFile(file repository.File) (int64, error) {
 	return r0, r1
 }
 
-// TxDeleteFileById provides a mock function with given fields: id, tx
-func (_m *FileRepo) TxDeleteFileById(id int64, tx *sql.Tx) error {
-	ret := _m.Called(id, tx)
+// TxLockQuota provides a mock function with given fields: ctx, bucket, tx
+func (_m *FileRepo) TxLockQuota(ctx context.Context, bucket string, tx *sql.Tx) error {
+	ret := _m.Called(ctx, bucket, tx)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(int64, *sql.Tx) error); ok {
-		r0 = rf(id, tx)
+	if rf, ok := ret.Get(0).(func(context.Context, string, *sql.Tx) error); ok {
+		r0 = rf(ctx, bucket, tx)
 	} else {
 		r0 = ret.Error(0)
 	}
 
 	return r0
 }
+
+// TxSaveAuditLogEntry provides a mock function with given fields: ctx, entry, tx
+func (_m *FileRepo) TxSaveAuditLogEntry(ctx context.Context, entry repository.AuditLogEntry, tx *sql.Tx) (int64, error) {
+	ret := _m.Called(ctx, entry, tx)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, repository.AuditLogEntry, *sql.Tx) int64); ok {
+		r0 = rf(ctx, entry, tx)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, repository.AuditLogEntry, *sql.Tx) error); ok {
+		r1 = rf(ctx, entry, tx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TxSaveFile provides a mock function with given fields: ctx, file, tx
+func (_m *FileRepo) TxSaveFile(ctx context.Context, file repository.File, tx *sql.Tx) (int64, error) {
+	ret := _m.Called(ctx, file, tx)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, repository.File, *sql.Tx) int64); ok {
+		r0 = rf(ctx, file, tx)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, repository.File, *sql.Tx) error); ok {
+		r1 = rf(ctx, file, tx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TxSavePendingDeletion provides a mock function with given fields: ctx, filePath, backend, tx
+func (_m *FileRepo) TxSavePendingDeletion(ctx context.Context, filePath string, backend *string, tx *sql.Tx) (int64, error) {
+	ret := _m.Called(ctx, filePath, backend, tx)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, *string, *sql.Tx) int64); ok {
+		r0 = rf(ctx, filePath, backend, tx)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, *string, *sql.Tx) error); ok {
+		r1 = rf(ctx, filePath, backend, tx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TxUpdateBackend provides a mock function with given fields: ctx, id, fromBackend, toBackend, tx
+func (_m *FileRepo) TxUpdateBackend(ctx context.Context, id int64, fromBackend string, toBackend string, tx *sql.Tx) (bool, error) {
+	ret := _m.Called(ctx, id, fromBackend, toBackend, tx)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string, string, *sql.Tx) bool); ok {
+		r0 = rf(ctx, id, fromBackend, toBackend, tx)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, string, string, *sql.Tx) error); ok {
+		r1 = rf(ctx, id, fromBackend, toBackend, tx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TxUpdateFilePath provides a mock function with given fields: ctx, id, fromPath, toPath, tx
+func (_m *FileRepo) TxUpdateFilePath(ctx context.Context, id int64, fromPath string, toPath string, tx *sql.Tx) (bool, error) {
+	ret := _m.Called(ctx, id, fromPath, toPath, tx)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string, string, *sql.Tx) bool); ok {
+		r0 = rf(ctx, id, fromPath, toPath, tx)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, string, string, *sql.Tx) error); ok {
+		r1 = rf(ctx, id, fromPath, toPath, tx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TxUpdateRetention provides a mock function with given fields: ctx, id, retentionUntil, legalHold, tx
+func (_m *FileRepo) TxUpdateRetention(ctx context.Context, id int64, retentionUntil *time.Time, legalHold bool, tx *sql.Tx) (bool, error) {
+	ret := _m.Called(ctx, id, retentionUntil, legalHold, tx)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, int64, *time.Time, bool, *sql.Tx) bool); ok {
+		r0 = rf(ctx, id, retentionUntil, legalHold, tx)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, *time.Time, bool, *sql.Tx) error); ok {
+		r1 = rf(ctx, id, retentionUntil, legalHold, tx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateIntegrity provides a mock function with given fields: ctx, id, checksum, integrityStatus
+func (_m *FileRepo) UpdateIntegrity(ctx context.Context, id int64, checksum *string, integrityStatus string) error {
+	ret := _m.Called(ctx, id, checksum, integrityStatus)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64, *string, string) error); ok {
+		r0 = rf(ctx, id, checksum, integrityStatus)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateReplicationStatus provides a mock function with given fields: ctx, id, replicationStatus
+func (_m *FileRepo) UpdateReplicationStatus(ctx context.Context, id int64, replicationStatus string) error {
+	ret := _m.Called(ctx, id, replicationStatus)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string) error); ok {
+		r0 = rf(ctx, id, replicationStatus)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateScanStatus provides a mock function with given fields: ctx, id, filePath, scanStatus, movedTo
+func (_m *FileRepo) UpdateScanStatus(ctx context.Context, id int64, filePath string, scanStatus string, movedTo *string) (bool, error) {
+	ret := _m.Called(ctx, id, filePath, scanStatus, movedTo)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string, string, *string) bool); ok {
+		r0 = rf(ctx, id, filePath, scanStatus, movedTo)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, string, string, *string) error); ok {
+		r1 = rf(ctx, id, filePath, scanStatus, movedTo)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateWrappedKey provides a mock function with given fields: ctx, id, oldKeyId, keyId, wrappedKey
+func (_m *FileRepo) UpdateWrappedKey(ctx context.Context, id int64, oldKeyId string, keyId string, wrappedKey string) (bool, error) {
+	ret := _m.Called(ctx, id, oldKeyId, keyId, wrappedKey)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, int64, string, string, string) bool); ok {
+		r0 = rf(ctx, id, oldKeyId, keyId, wrappedKey)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, string, string, string) error); ok {
+		r1 = rf(ctx, id, oldKeyId, keyId, wrappedKey)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
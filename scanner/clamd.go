@@ -0,0 +1,102 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 64 << 10
+
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamdScanner creates a scanner that streams the contents to clamd using the INSTREAM command.
+// The address is either tcp://host:port or unix:///path/to/clamd.sock.
+func NewClamdScanner(address string, timeout time.Duration) (Scanner, error) {
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		return clamdScanner{"tcp", strings.TrimPrefix(address, "tcp://"), timeout}, nil
+	case strings.HasPrefix(address, "unix://"):
+		return clamdScanner{"unix", strings.TrimPrefix(address, "unix://"), timeout}, nil
+	default:
+		return nil, errors.New("Unsupported clamd address " + address)
+	}
+}
+
+func (s clamdScanner) Scan(contents io.Reader) (Result, error) {
+	result := Result{}
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	if s.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	// The z prefix means the command and the reply are terminated by a null character
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return result, err
+	}
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, readErr := contents.Read(chunk)
+		if n > 0 {
+			err = writeChunk(conn, chunk[:n])
+			if err != nil {
+				return result, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return result, readErr
+		}
+	}
+	err = writeChunk(conn, nil) // A zero length chunk marks the end of the stream
+	if err != nil {
+		return result, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return result, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+func writeChunk(w io.Writer, data []byte) error {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)))
+	_, err := w.Write(size)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// parseClamdReply parses replies like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (Result, error) {
+	result := Result{}
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return result, nil
+	case strings.HasSuffix(status, " FOUND"):
+		result.Infected = true
+		result.Signature = strings.TrimSuffix(status, " FOUND")
+		return result, nil
+	default:
+		return result, fmt.Errorf("clamd failed to scan the stream: %s", reply)
+	}
+}
@@ -0,0 +1,114 @@
+package scanner_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"gocleancode/scanner"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd accepts INSTREAM commands and reports the eicar test string as infected.
+func fakeClamd(t *testing.T, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return // Listener closed
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			command, err := reader.ReadString(0)
+			if err != nil || command != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				return
+			}
+			contents := &bytes.Buffer{}
+			for {
+				var size uint32
+				err = binary.Read(reader, binary.BigEndian, &size)
+				if err != nil {
+					t.Errorf("Failed to read chunk size %v", err)
+					return
+				}
+				if size == 0 {
+					break
+				}
+				_, err = io.CopyN(contents, reader, int64(size))
+				if err != nil {
+					t.Errorf("Failed to read chunk %v", err)
+					return
+				}
+			}
+			if strings.Contains(contents.String(), eicar) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else if contents.Len() > 1<<20 {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+		}(conn)
+	}
+}
+
+func TestClamdScannerOverTcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go fakeClamd(t, listener)
+	clamd, err := scanner.NewClamdScanner("tcp://"+listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// When
+	cleanResult, cleanErr := clamd.Scan(strings.NewReader("This is a test."))
+	infectedResult, infectedErr := clamd.Scan(strings.NewReader(eicar))
+	_, tooLargeErr := clamd.Scan(bytes.NewReader(make([]byte, 2<<20)))
+	// Then
+	assert.Nil(t, cleanErr)
+	assert.Equal(t, scanner.Result{}, cleanResult)
+	assert.Nil(t, infectedErr)
+	assert.Equal(t, scanner.Result{Infected: true, Signature: "Eicar-Test-Signature"}, infectedResult)
+	assert.NotNil(t, tooLargeErr)
+}
+
+func TestClamdScannerOverUnixSocket(t *testing.T) {
+	socketDir, err := ioutil.TempDir("", "clamd_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(socketDir)
+	socketPath := filepath.Join(socketDir, "clamd.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go fakeClamd(t, listener)
+	clamd, err := scanner.NewClamdScanner("unix://"+socketPath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// When
+	result, err := clamd.Scan(strings.NewReader(eicar))
+	// Then
+	assert.Nil(t, err)
+	assert.True(t, result.Infected)
+}
+
+func TestNewClamdScannerWithUnsupportedAddress(t *testing.T) {
+	_, err := scanner.NewClamdScanner("localhost:3310", time.Second)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,15 @@
+package scanner
+
+import (
+	"io"
+)
+
+// Scanner checks file contents for malware.
+type Scanner interface {
+	Scan(contents io.Reader) (Result, error)
+}
+
+type Result struct {
+	Infected  bool
+	Signature string // Name of the detected malware. Empty if not infected.
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const genericContentType = "application/octet-stream"
+
+type signature struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+// signatures covers the formats that http.DetectContentType does not recognize.
+var signatures = []signature{
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypheix"), "image/heic"},
+	{4, []byte("ftypmif1"), "image/heif"},
+	{4, []byte("ftypavif"), "image/avif"},
+	{4, []byte("ftypqt  "), "video/quicktime"},
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+	{0, []byte("\x28\xB5\x2F\xFD"), "application/zstd"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{0, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"), "application/x-ole-storage"}, // Legacy office documents
+	{0, []byte("\x7FELF"), "application/x-executable"},
+	{0, []byte("MZ"), "application/x-msdownload"},
+}
+
+// zipBasedTypes are the formats stored as zip archives. These are detected as application/zip.
+var zipBasedTypes = []string{
+	"application/vnd.openxmlformats-officedocument.*",
+	"application/vnd.oasis.opendocument.*",
+	"application/java-archive",
+	"application/epub+zip",
+	"application/vnd.android.package-archive",
+}
+
+// oleBasedTypes are the legacy office formats. These are detected as application/x-ole-storage.
+var oleBasedTypes = []string{
+	"application/msword",
+	"application/vnd.ms-excel",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.ms-outlook",
+}
+
+// textBasedTypes are the formats that can't be told apart from plain text by their contents.
+var textBasedTypes = []string{
+	"text/*",
+	"application/json",
+	"application/x-ndjson",
+	"application/x-yaml",
+	"application/yaml",
+}
+
+// activeTextTypes are rendered or executed by browsers, so they must be detected rather than trusted.
+var activeTextTypes = []string{
+	"text/html",
+	"text/xml",
+	"text/javascript",
+	"image/svg+xml",
+}
+
+// signedTypes always start with a signature, so failing to detect them means the contents are not of that type.
+var signedTypes = []string{
+	"image/*",
+	"audio/*",
+	"video/*",
+	"font/*",
+	"application/pdf",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+}
+
+// detectContentType returns the media type, without parameters, of the given file contents.
+func detectContentType(data []byte) string {
+	for _, s := range signatures {
+		if len(data) >= s.offset+len(s.magic) && bytes.Equal(data[s.offset:s.offset+len(s.magic)], s.magic) {
+			return s.contentType
+		}
+	}
+	return mediaType(http.DetectContentType(data))
+}
+
+// resolveContentType compares the content type claimed by the client with the detected one. It returns the content
+// type to store and whether the two are consistent. The claimed type is kept when it is a more specific form of the
+// detected type, eg a docx is detected as application/zip.
+func resolveContentType(claimedType string, detectedType string) (string, bool) {
+	claimedType = mediaType(claimedType)
+	if claimedType == "" || claimedType == genericContentType || claimedType == detectedType {
+		return detectedType, true
+	}
+	switch detectedType {
+	case genericContentType:
+		// Unknown binary contents can't contradict the claim unless the claimed type has a signature
+		return detectedType, !matchesContentType(claimedType, signedTypes) && !matchesContentType(claimedType, activeTextTypes)
+	case "application/zip":
+		if matchesContentType(claimedType, zipBasedTypes) {
+			return claimedType, true
+		}
+	case "application/x-ole-storage":
+		if matchesContentType(claimedType, oleBasedTypes) {
+			return claimedType, true
+		}
+	case "text/plain":
+		if matchesContentType(claimedType, textBasedTypes) && !matchesContentType(claimedType, activeTextTypes) {
+			return claimedType, true
+		}
+	}
+	return detectedType, false
+}
+
+func mediaType(contentType string) string {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return parsed
+}
+
+// matchesContentType checks the content type against the patterns. Wildcard subtypes like image/* are supported.
+func matchesContentType(contentType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if strings.HasSuffix(pattern, ".*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
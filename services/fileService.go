@@ -1,97 +1,946 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gocleancode/config"
 	"gocleancode/db"
 	"gocleancode/repository"
+	"gocleancode/scanner"
+	"gocleancode/storage"
+	"gocleancode/utils"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+var (
+	ErrBucketNotFound        = errors.New("bucket not found")
+	ErrFileNotFound          = errors.New("file not found")
+	ErrFileTooLarge          = errors.New("file exceeds the maximum allowed size")
+	ErrContentTypeNotAllowed = errors.New("content type is not allowed")
+	ErrContentTypeMismatch   = errors.New("content type does not match the file contents")
+	ErrExtensionNotAllowed   = errors.New("file extension is not allowed")
+	ErrQuotaExceeded         = errors.New("storage quota exceeded")
+	ErrOwnerRequired         = errors.New("the bucket has owner quotas, the owner of the upload must be identified")
+	ErrEncryptionDisabled    = errors.New("encryption at rest is not enabled")
+	ErrInvalidTags           = errors.New("tags must be at most 255 characters and can't contain commas")
+	ErrBackendUnavailable    = errors.New("the storage backend of the file is not configured")
+	ErrInvalidExpiry         = errors.New("the expiry must be in the future")
+	ErrFileProtected         = errors.New("the file is under retention or legal hold")
+	ErrRetentionShortened    = errors.New("the retention of a file can only be extended")
+	purgeBatchSize           = 100
+)
+
+const (
+	stagedSuffix         = ".staged"      // Suffix of the uploads until their transaction commits
+	quarantineDirName    = ".quarantine"  // Of the upload dir, the default quarantine dir
+	pendingDeletionGrace = 24 * time.Hour // Longer than any upload, so that PurgePendingDeletions skips those in progress
+)
+
 type FileService interface {
-	SaveFile(file multipart.File, handle *multipart.FileHeader) (int64, error)
-	GetFileById(id int64) (repository.File, error)
-	DeleteFileById(fileId int64) error
+	SaveFile(ctx context.Context, bucket string, owner string, file multipart.File, handle *multipart.FileHeader, options UploadOptions) (int64, error)
+	GetFileById(ctx context.Context, bucket string, id int64) (repository.File, error)
+	OpenFile(ctx context.Context, file repository.File) (io.ReadSeekCloser, error)
+	OpenEncodedFile(ctx context.Context, file repository.File) (io.ReadSeekCloser, error)
+	DeleteFileById(ctx context.Context, bucket string, fileId int64) error
+	PurgeExpiredFiles(ctx context.Context) error
+	PurgePendingDeletions(ctx context.Context) error
+	ScanPendingFiles(ctx context.Context) error
+	RemainingQuota(ctx context.Context, bucket string, owner string) (int64, error)
+	GetUsage(ctx context.Context, bucket string, owner string) (UsageReport, error)
+	RewrapDataKeys(ctx context.Context, afterId int64, batchSize int) (KeyRotationReport, error)
+	Reconcile(ctx context.Context, orphanAction string, dryRun bool) (ReconcileReport, error)
+	ScrubFiles(ctx context.Context) error
+	ReplicatePendingFiles(ctx context.Context) error
+	ApplyLifecycleRules(ctx context.Context) error
+	SetRetention(ctx context.Context, bucket string, id int64, update RetentionUpdate, actor string) (repository.File, error)
+	GetAuditLog(ctx context.Context, bucket string, id int64) ([]repository.AuditLogEntry, error)
+	MigrateLayout(ctx context.Context, afterId int64, batchSize int) (MigrationReport, error)
+	MigrateFilePaths(ctx context.Context, fromDir string, afterId int64, batchSize int) (MigrationReport, error)
+	MigrateStorage(ctx context.Context, fromBackend string, toBackend string, options StorageMigrationOptions) (MigrationReport, error)
+	GetThumbnail(ctx context.Context, file repository.File, options ThumbnailOptions) (io.ReadSeekCloser, string, error)
+	TransformImage(ctx context.Context, file repository.File, transformation ImageTransformation) (io.ReadSeekCloser, string, error)
+}
+
+// UploadOptions are the optional settings of an upload.
+type UploadOptions struct {
+	Tags      []string   // Matched by the lifecycle rules
+	ExpiresAt *time.Time // The file is no longer served after this time, and is deleted by PurgeExpiredFiles
+}
+
+// Usage reports the consumption versus the limits. A limit of 0 means unlimited.
+type Usage struct {
+	Bytes      int64 `json:"bytes"`
+	Files      int64 `json:"files"`
+	QuotaBytes int64 `json:"quotaBytes"`
+	QuotaFiles int64 `json:"quotaFiles"`
+}
+
+type UsageReport struct {
+	Bucket     string `json:"bucket"`
+	Usage      Usage  `json:"usage"`
+	Owner      string `json:"owner,omitempty"`
+	OwnerUsage *Usage `json:"ownerUsage,omitempty"`
+}
+
+// KeyRotationReport summarizes a run of RewrapDataKeys.
+type KeyRotationReport struct {
+	Rewrapped int
+	LastId    int64 // Id of the last processed file. Pass it as afterId to resume an interrupted rotation.
+	Failures  []KeyRotationFailure
+}
+
+type KeyRotationFailure struct {
+	FileId int64
+	Reason string
 }
 
 type fileService struct {
-	db      db.Db
-	repo    repository.FileRepo
-	config  config.Configuration
-	fileDir string
+	db            db.Db
+	repo          repository.FileRepo
+	storage       storage.Storage
+	scanner       scanner.Scanner    // nil if scanning is disabled
+	encryptor     *storage.Encryptor // nil if encryption is disabled
+	secondary     storage.Storage    // Mirror of the uploads. nil if not configured
+	cold          storage.Storage    // Where the lifecycle rules transition the files to. nil if not configured
+	remote        storage.Storage    // Where MigrateStorage can move the hot files to. nil if not configured
+	config        config.Configuration
+	fileDir       string
+	quarantineDir string
+	derivativeDir string // Cache of the thumbnails and transformed images
 }
 
-func NewFileService(db db.Db, repo repository.FileRepo, config config.Configuration) FileService {
-	fileDir := config.UploadDir
-	if !strings.HasPrefix(fileDir, os.TempDir()) {
-		workingDir, _ := os.Getwd()
-		fileDir = workingDir + "/" + config.UploadDir
-	}
+// NewFileService creates the service. secondary, if not nil, gets a copy of every upload. See ReplicatePendingFiles.
+// cold, if not nil, receives the files transitioned by the lifecycle rules. remote, if not nil, serves the files moved
+// there by MigrateStorage.
+func NewFileService(db db.Db, repo repository.FileRepo, fileStorage storage.Storage, secondary storage.Storage, cold storage.Storage,
+	remote storage.Storage, fileScanner scanner.Scanner, encryptor *storage.Encryptor, config config.Configuration) FileService {
+	fileDir, _ := filepath.Abs(config.UploadDir)
 	if _, err := os.Stat(config.UploadDir); os.IsNotExist(err) {
 		fmt.Println("Creating upload file dir: " + fileDir)
 		os.MkdirAll(fileDir, os.ModePerm)
 	}
-	return fileService{db, repo, config, fileDir}
+	quarantineDir := config.QuarantineDir
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(fileDir, quarantineDirName)
+	}
+	derivativeDir := filepath.Join(fileDir, ".derivatives")
+	return fileService{db, repo, fileStorage, fileScanner, encryptor, secondary, cold, remote, config, fileDir, quarantineDir, derivativeDir}
 }
 
-func (f fileService) SaveFile(multiPartFile multipart.File, fileHeader *multipart.FileHeader) (int64, error) {
+func (f fileService) SaveFile(ctx context.Context, bucket string, owner string, multiPartFile multipart.File, fileHeader *multipart.FileHeader,
+	options UploadOptions) (int64, error) {
 	var generatedId int64
-	t := time.Now()
-	formattedDate := t.Format(time.RFC3339) // Eg output -> 2018-12-06T05:46:29+09:00
+	bucketConfig, ok := f.config.Bucket(bucket)
+	if !ok {
+		return generatedId, ErrBucketNotFound
+	}
+	tags, err := joinTags(options.Tags)
+	if err != nil {
+		return generatedId, err
+	}
+	if options.ExpiresAt != nil && !options.ExpiresAt.After(time.Now()) {
+		return generatedId, ErrInvalidExpiry
+	}
+	if f.config.UploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.config.UploadTimeout)*time.Second)
+		defer cancel()
+	}
+	policy := uploadPolicy{f.config.UploadPolicy, bucketConfig}
+	err = policy.checkSize(fileHeader.Size)
+	if err != nil {
+		return generatedId, err
+	}
+	err = policy.checkFileName(fileHeader.Filename)
+	if err != nil {
+		return generatedId, err
+	}
+	remainingQuota, err := f.RemainingQuota(ctx, bucket, owner)
+	if err != nil {
+		return generatedId, err
+	}
+	if remainingQuota >= 0 && fileHeader.Size > remainingQuota {
+		return generatedId, ErrQuotaExceeded
+	}
+	data, err := ioutil.ReadAll(multiPartFile)
+	if err != nil {
+		return generatedId, err
+	}
+	err = policy.checkSize(int64(len(data)))
+	if err != nil {
+		return generatedId, err
+	}
+	// Store the type detected from the contents rather than the client's claim
+	contentType, err := policy.checkContent(fileHeader.Header.Get("Content-Type"), data)
+	if err != nil {
+		return generatedId, err
+	}
+	bucketDir := filepath.Join(f.fileDir, bucketConfig.StoragePrefix)
 	fileName := fileHeader.Filename
-	filePath := f.fileDir + "/" + formattedDate + "_" + fileName
+	blobName, err := storage.NewBlobName()
+	if err != nil {
+		return generatedId, err
+	}
+	filePath := storage.ShardedPath(bucketDir, blobName, f.config.ShardDepth)
 	log.Info("Saving file " + filePath)
-	data, err := ioutil.ReadAll(multiPartFile)
+	stored := data
+	var contentEncoding *string
+	if encoding := f.compressionEncoding(contentType); encoding != "" {
+		compressed, err := storage.Compress(data, encoding)
+		if err != nil {
+			return generatedId, err
+		}
+		if len(compressed) < len(data) { // Else stored as is
+			stored, contentEncoding = compressed, &encoding
+		}
+	}
+	var contents io.Reader = bytes.NewReader(stored)
+	var encryptionKeyId, wrappedKey *string
+	if f.encryptor != nil {
+		dataKey, wrapped, err := f.encryptor.NewDataKey()
+		if err != nil {
+			return generatedId, err
+		}
+		contents, err = storage.Encrypt(contents, dataKey)
+		if err != nil {
+			return generatedId, err
+		}
+		keyId := f.encryptor.ActiveKeyId()
+		encryptionKeyId, wrappedKey = &keyId, &wrapped
+	}
+	// The contents are staged next to the final path and renamed on commit. Both paths are recorded as pending
+	// deletions beforehand and the records are removed by the transaction inserting the file, so a crash at any point
+	// leaves either a complete file or blobs that PurgePendingDeletions removes.
+	stagedPath := filePath + stagedSuffix
+	pendingIds, err := f.recordPendingDeletions(ctx, stagedPath, filePath)
 	if err != nil {
 		return generatedId, err
 	}
-	err = ioutil.WriteFile(filePath, data, 0666)
+	hash := sha256.New() // Of the stored blob, so that scrubbing doesn't need to decrypt it
+	err = f.storage.Put(ctx, stagedPath, io.TeeReader(contents, hash))
 	if err != nil {
+		f.deleteBlobs(context.Background(), pendingIds, stagedPath, filePath)
 		return generatedId, err
 	}
-	contentType := strings.ToLower(fileHeader.Header.Get("Content-Type"))
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	var replicationStatus *string
+	if f.secondary != nil {
+		status := repository.ReplicationPending
+		if f.config.ReplicationMode == ReplicationSync {
+			// Copied to the final path before the commit. A failure deletes it along with the primary blobs.
+			err = f.copyToSecondary(ctx, f.storage, stagedPath, filePath)
+			if err != nil {
+				replicationMetrics.Add("failed", 1)
+				f.deleteBlobs(context.Background(), pendingIds, stagedPath, filePath)
+				return generatedId, err
+			}
+			replicationMetrics.Add("replicated", 1)
+			status = repository.ReplicationReplicated
+		}
+		replicationStatus = &status
+	}
 	now := time.Now()
-	file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &now}
-	generatedId, err = f.repo.SaveFile(file)
+	size := int64(len(data))
+	scanStatus := repository.ScanStatusClean
+	if f.scanner != nil {
+		scanStatus = repository.ScanStatusPending // Not downloadable until scanned
+	}
+	fileKey := f.blobKey(filePath)
+	file := repository.File{Bucket: &bucket, FileName: &fileName, FilePath: &fileKey, ContentType: &contentType, Size: &size,
+		ScanStatus: &scanStatus, EncryptionKeyId: encryptionKeyId, WrappedKey: wrappedKey, CreatedDt: &now, Checksum: &checksum,
+		ReplicationStatus: replicationStatus, Tags: tags, ExpiresDt: options.ExpiresAt, ContentEncoding: contentEncoding}
+	if owner != "" {
+		file.Owner = &owner
+	}
+	_, err = f.transactMove(ctx, f.storage, stagedPath, filePath, func(tx *sql.Tx) (bool, error) {
+		// Checked again now that the size is known, and atomically with the insert
+		err := f.checkQuota(ctx, bucket, owner, size, tx)
+		if err != nil {
+			return false, err
+		}
+		generatedId, err = f.repo.TxSaveFile(ctx, file, tx)
+		if err != nil {
+			return false, err
+		}
+		for _, id := range pendingIds {
+			err = f.repo.TxDeletePendingDeletion(ctx, id, tx)
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
 	if err != nil {
-		log.Debug(fmt.Sprintf("Failed to save file %v to DB.", file.FilePath))
-		os.Remove(filePath) // If an error encountered while saving, delete the created file.
-	} else {
-		log.Debug(fmt.Sprintf("Successfully saved file %v to DB. Generated id is %d.", file.FilePath, generatedId))
+		log.Debug(fmt.Sprintf("Failed to save file %v to DB.", filePath))
+		// Delete the blobs now rather than on the next purge
+		f.deleteBlobs(context.Background(), pendingIds, stagedPath, filePath)
+		return 0, err
+	}
+	log.Debug(fmt.Sprintf("Successfully saved file %v to DB. Generated id is %d.", filePath, generatedId))
+	file.Id = &generatedId
+	if replicationStatus != nil && *replicationStatus == repository.ReplicationPending {
+		go f.replicateFile(context.Background(), file) // Outlives the request. ReplicatePendingFiles retries failures
+	}
+	if f.scanner != nil {
+		go f.scanFile(context.Background(), file) // Outlives the request
+	}
+	return generatedId, nil
+}
+
+// compressionEncoding returns the encoding of the first compression rule matching the content type, or "" if the blobs
+// of the type are stored as is.
+func (f fileService) compressionEncoding(contentType string) string {
+	for _, rule := range f.config.CompressionRules {
+		if matchesContentType(mediaType(contentType), rule.ContentTypes) {
+			return rule.Encoding
+		}
 	}
-	return generatedId, err
+	return ""
 }
 
-func (f fileService) DeleteFileById(fileId int64) error {
-	file, err := f.repo.GetFileById(fileId)
+// joinTags validates the tags and returns them comma separated, or nil if there are none.
+func joinTags(tags []string) (*string, error) {
+	var cleaned []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if strings.Contains(tag, ",") {
+			return nil, ErrInvalidTags
+		}
+		if tag != "" {
+			cleaned = append(cleaned, tag)
+		}
+	}
+	if len(cleaned) == 0 {
+		return nil, nil
+	}
+	joined := strings.Join(cleaned, ",")
+	if len(joined) > 255 {
+		return nil, ErrInvalidTags
+	}
+	return &joined, nil
+}
+
+// recordPendingDeletions commits a pending deletion for each path and returns their ids, in the same order. The blobs
+// are deleted from every backend.
+func (f fileService) recordPendingDeletions(ctx context.Context, filePaths ...string) ([]int64, error) {
+	var ids []int64
+	err := f.db.Transact(ctx, func(tx *sql.Tx) error {
+		for _, filePath := range filePaths {
+			id, err := f.repo.TxSavePendingDeletion(ctx, f.blobKey(filePath), nil, tx)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// transactMove commits the changes of txFunc together with the move of the blob from fromPath to toPath in the storage.
+// The blob is moved inside the transaction, after every other change, so that only the commit itself can fail once it
+// has moved. txFunc returns false to commit without moving the blob. It returns whether the blob was moved. If the
+// transaction failed, the caller cleans up with context.Background() rather than ctx, so that a cancelled request or
+// job doesn't leave the blob behind.
+func (f fileService) transactMove(ctx context.Context, blobStorage storage.Storage, fromPath string, toPath string,
+	txFunc func(tx *sql.Tx) (bool, error)) (bool, error) {
+	moved := false
+	err := f.db.Transact(ctx, func(tx *sql.Tx) error {
+		move, err := txFunc(tx)
+		if err != nil || !move {
+			return err
+		}
+		err = blobStorage.Move(ctx, fromPath, toPath)
+		moved = err == nil
+		return err
+	})
+	return moved, err
+}
+
+// deleteBlobs deletes the blobs of the pending deletions returned by recordPendingDeletions. Failures are left to
+// PurgePendingDeletions.
+func (f fileService) deleteBlobs(ctx context.Context, ids []int64, filePaths ...string) {
+	for i, id := range ids {
+		f.deleteBlob(ctx, id, filePaths[i], nil)
+	}
+}
+
+// deleteBlob deletes the blob of a pending deletion, then the pending deletion itself. The blob is deleted from the
+// given backend, or from every backend and the secondary storage if backend is nil. A blob that doesn't exist counts as
+// deleted.
+func (f fileService) deleteBlob(ctx context.Context, id int64, filePath string, backend *string) error {
+	storages := map[string]storage.Storage{repository.BackendHot: f.storage, repository.BackendCold: f.cold, repository.BackendRemote: f.remote,
+		"secondary": f.secondary}
+	for name, fileStorage := range storages {
+		if fileStorage == nil || (backend != nil && *backend != name) {
+			continue
+		}
+		err := fileStorage.Delete(ctx, filePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error(fmt.Sprintf("Failed to delete file %v from the %s storage. Reason: %v", filePath, name, err))
+			return err
+		}
+	}
+	return f.repo.DeletePendingDeletion(ctx, id)
+}
+
+func (f fileService) DeleteFileById(ctx context.Context, bucket string, fileId int64) error {
+	file, err := f.GetFileById(ctx, bucket, fileId)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	return f.db.Transact(func(tx *sql.Tx) error {
-		err = f.repo.TxDeleteFileById(fileId, tx)
+	return f.deleteFile(ctx, file)
+}
+
+// deleteFile deletes the file, then its blob. ErrFileProtected is returned if the file is under retention or legal hold.
+func (f fileService) deleteFile(ctx context.Context, file repository.File) error {
+	if isProtected(file, time.Now()) {
+		return ErrFileProtected
+	}
+	fileId := *file.Id
+	var pendingId int64
+	err := f.db.Transact(ctx, func(tx *sql.Tx) error {
+		err := f.repo.TxDeleteFileById(ctx, *file.Bucket, fileId, tx)
+		if err == sql.ErrNoRows {
+			return ErrFileNotFound // Deleted, or protected, since it was read
+		}
 		if err != nil {
 			log.Error(err)
 			return err
-		} else {
-			// Delete the item
-			err = os.Remove(*file.FilePath)
+		}
+		pendingId, err = f.repo.TxSavePendingDeletion(ctx, *file.FilePath, nil, tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Successfully deleted file with id %v", fileId))
+	// The blob is only deleted once the transaction has committed. If that fails, PurgePendingDeletions retries.
+	f.deleteBlob(ctx, pendingId, f.blobPath(*file.FilePath), nil)
+	f.deleteDerivatives(ctx, fileId)
+	return nil
+}
+
+// PurgePendingDeletions deletes the blobs left behind by the uploads and deletions interrupted by a crash. Only the
+// pending deletions older than pendingDeletionGrace are processed, so that the uploads in progress are left alone.
+// Blobs that fail to be deleted are logged and retried on the next run, the returned error counts them.
+func (f fileService) PurgePendingDeletions(ctx context.Context) error {
+	createdBefore := time.Now().Add(-pendingDeletionGrace)
+	afterId := int64(0)
+	failed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pendingDeletions, err := f.repo.GetPendingDeletions(ctx, createdBefore, afterId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, pendingDeletion := range pendingDeletions {
+			afterId = *pendingDeletion.Id
+			err = f.deleteBlob(ctx, *pendingDeletion.Id, f.blobPath(*pendingDeletion.FilePath), pendingDeletion.Backend)
 			if err != nil {
-				log.Error(fmt.Sprintf("Failed to file %v. Reason: %v", file.FilePath, err))
-				return err
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				failed++
+				log.Error(fmt.Sprintf("Failed to delete the pending blob %s. Reason: %v", *pendingDeletion.FilePath, err))
 			}
 		}
-		log.Info(fmt.Sprintf("Successfully deleted file with id %v", fileId))
-		return nil
+		if len(pendingDeletions) < purgeBatchSize {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d pending blobs", failed)
+	}
+	return nil
+}
+
+func (f fileService) GetFileById(ctx context.Context, bucket string, id int64) (repository.File, error) {
+	if _, ok := f.config.Bucket(bucket); !ok {
+		return repository.File{}, ErrBucketNotFound
+	}
+	file, err := f.repo.GetFileById(ctx, bucket, id)
+	if err == sql.ErrNoRows {
+		return file, ErrFileNotFound
+	}
+	return file, err
+}
+
+// OpenFile opens the contents of the file, decrypting them if the file is encrypted and decompressing them if it's
+// compressed. Reading fails once the context is done or the download timeout is reached.
+func (f fileService) OpenFile(ctx context.Context, file repository.File) (io.ReadSeekCloser, error) {
+	return f.openWithTimeout(ctx, file, true)
+}
+
+// OpenEncodedFile is like OpenFile but leaves the contents compressed with the ContentEncoding of the file, to serve
+// them as is to the clients accepting the encoding.
+func (f fileService) OpenEncodedFile(ctx context.Context, file repository.File) (io.ReadSeekCloser, error) {
+	return f.openWithTimeout(ctx, file, false)
+}
+
+func (f fileService) openWithTimeout(ctx context.Context, file repository.File, decompress bool) (io.ReadSeekCloser, error) {
+	if f.config.DownloadTimeout <= 0 {
+		return f.openFile(ctx, file, decompress)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(f.config.DownloadTimeout)*time.Second)
+	contents, err := f.openFile(ctx, file, decompress)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancelOnClose{contents, cancel}, nil
+}
+
+// cancelOnClose releases the context of the reader when it's closed.
+type cancelOnClose struct {
+	io.ReadSeekCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadSeekCloser.Close()
+}
+
+func (f fileService) openFile(ctx context.Context, file repository.File, decompress bool) (io.ReadSeekCloser, error) {
+	contents, err := f.openDecrypted(ctx, file)
+	if err != nil || !decompress || file.ContentEncoding == nil {
+		return contents, err
+	}
+	decompressed, err := storage.Decompress(contents, *file.ContentEncoding, *file.Size)
+	if err != nil {
+		utils.CloseFile(contents)
+		return nil, err
+	}
+	return decompressed, nil
+}
+
+// openDecrypted opens the blob of the file, decrypting it if the file is encrypted.
+func (f fileService) openDecrypted(ctx context.Context, file repository.File) (io.ReadSeekCloser, error) {
+	contents, err := f.openBlob(ctx, file)
+	if err != nil || file.WrappedKey == nil {
+		return contents, err
+	}
+	dataKey, err := f.dataKey(file)
+	if err == nil {
+		var decrypted io.ReadSeekCloser
+		decrypted, err = storage.Decrypt(contents, dataKey)
+		if err == nil {
+			return decrypted, nil
+		}
+	}
+	utils.CloseFile(contents)
+	return nil, err
+}
+
+// dataKey unwraps the data key of the file, nil if the file is not encrypted.
+func (f fileService) dataKey(file repository.File) ([]byte, error) {
+	if file.WrappedKey == nil {
+		return nil, nil
+	}
+	if f.encryptor == nil {
+		return nil, storage.ErrUnknownMasterKey
+	}
+	return f.encryptor.UnwrapKey(*file.EncryptionKeyId, *file.WrappedKey)
+}
+
+// blobPath resolves the key of a blob, as stored in the db, to its path in the storages. Keys are relative to the upload
+// dir so that it can be moved. Absolute keys, stored before that or for blobs outside of the upload dir, are used as is.
+func (f fileService) blobPath(key string) string {
+	if filepath.IsAbs(key) {
+		return key
+	}
+	return filepath.Join(f.fileDir, filepath.FromSlash(key))
+}
+
+// blobKey returns the key stored in the db for the blob at the path. See blobPath.
+func (f fileService) blobKey(path string) string {
+	relativePath, err := filepath.Rel(f.fileDir, path)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+// backendStorage returns the storage holding the blob of the file.
+func (f fileService) backendStorage(file repository.File) (storage.Storage, error) {
+	if file.Backend == nil {
+		return f.storage, nil
+	}
+	return f.storageOf(*file.Backend)
+}
+
+// storageOf returns the storage of the backend, or ErrBackendUnavailable if it's unknown or not configured.
+func (f fileService) storageOf(backend string) (storage.Storage, error) {
+	switch {
+	case backend == repository.BackendHot:
+		return f.storage, nil
+	case backend == repository.BackendCold && f.cold != nil:
+		return f.cold, nil
+	case backend == repository.BackendRemote && f.remote != nil:
+		return f.remote, nil
+	}
+	return nil, ErrBackendUnavailable
+}
+
+// openBlob opens the stored blob of the file, falling back to the secondary storage if the backend fails.
+func (f fileService) openBlob(ctx context.Context, file repository.File) (io.ReadSeekCloser, error) {
+	backendStorage, err := f.backendStorage(file)
+	if err != nil {
+		return nil, err
+	}
+	filePath := f.blobPath(*file.FilePath)
+	contents, err := backendStorage.Open(ctx, filePath)
+	if err == nil || f.secondary == nil || ctx.Err() != nil {
+		return contents, err
+	}
+	secondaryContents, secondaryErr := f.secondary.Open(ctx, filePath)
+	if secondaryErr != nil {
+		return nil, err // The primary error is the relevant one, the secondary copy may not be written yet
+	}
+	replicationMetrics.Add("fallbackReads", 1)
+	log.Warn(fmt.Sprintf("Read file %s from the secondary storage. Reason: %v", filePath, err))
+	return secondaryContents, nil
+}
+
+// PurgeExpiredFiles deletes the files that are past the expiry set on upload, then those that are older than the
+// retention of their bucket. Files that fail to be deleted are logged and retried on the next run, the returned error
+// counts them.
+func (f fileService) PurgeExpiredFiles(ctx context.Context) error {
+	expiredBefore := time.Now()
+	failed, err := f.purgeFiles(ctx, func(afterId int64) ([]repository.File, error) {
+		return f.repo.GetExpiredFiles(ctx, expiredBefore, afterId, purgeBatchSize)
 	})
+	if err != nil {
+		return err
+	}
+	for bucket := range f.config.Buckets {
+		bucketConfig, _ := f.config.Bucket(bucket)
+		if bucketConfig.RetentionDays <= 0 {
+			continue
+		}
+		createdBefore := time.Now().AddDate(0, 0, -bucketConfig.RetentionDays)
+		bucketFailed, err := f.purgeFiles(ctx, func(afterId int64) ([]repository.File, error) {
+			return f.repo.GetFilesCreatedBefore(ctx, bucket, createdBefore, afterId, purgeBatchSize)
+		})
+		failed += bucketFailed
+		if err != nil {
+			return err
+		}
+		log.Info(fmt.Sprintf("Purged files of bucket %s created before %v", bucket, createdBefore))
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to purge %d expired files", failed)
+	}
+	return nil
 }
 
-func (f fileService) GetFileById(id int64) (repository.File, error) {
-	return f.repo.GetFileById(id)
+// purgeFiles deletes the files returned by list, which pages through them by id, and returns how many failed to be
+// deleted. The files deleted or protected since they were listed are skipped.
+func (f fileService) purgeFiles(ctx context.Context, list func(afterId int64) ([]repository.File, error)) (int, error) {
+	afterId := int64(0)
+	failed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return failed, err
+		}
+		files, err := list(afterId)
+		if err != nil {
+			return failed, err
+		}
+		for _, file := range files {
+			afterId = *file.Id
+			err = f.deleteFile(ctx, file)
+			if err == ErrFileNotFound || err == ErrFileProtected {
+				continue
+			}
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return failed, ctxErr
+				}
+				failed++
+				log.Error(fmt.Sprintf("Failed to purge file %d. Reason: %v", *file.Id, err))
+			}
+		}
+		if len(files) < purgeBatchSize {
+			return failed, nil
+		}
+	}
+}
+
+// ScanPendingFiles scans the files that were not scanned yet or whose scan failed, eg due to a restart.
+func (f fileService) ScanPendingFiles(ctx context.Context) error {
+	if f.scanner == nil {
+		return nil
+	}
+	afterId := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		files, err := f.repo.GetUnscannedFiles(ctx, afterId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			f.scanFile(ctx, file) // Failures are recorded in the scan status
+			afterId = *file.Id
+		}
+		if len(files) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// scanFile updates the scan status of the file. Infected files are moved to the quarantine dir. The status is only
+// recorded if the file wasn't moved or deleted during the scan, otherwise the quarantined blob is moved back and the
+// file is scanned again by the next ScanPendingFiles.
+func (f fileService) scanFile(ctx context.Context, file repository.File) error {
+	fileKey, filePath := *file.FilePath, f.blobPath(*file.FilePath)
+	scanStatus, err := f.scan(ctx, file)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to scan file %s. Reason: %v", filePath, err))
+	}
+	var backendStorage storage.Storage
+	var quarantinePath string
+	var quarantineKey *string // Set if the blob was moved to the quarantine dir
+	if scanStatus == repository.ScanStatusInfected {
+		quarantinePath, err = f.quarantinePath(file)
+		if err == nil {
+			backendStorage, err = f.backendStorage(file)
+		}
+		if err == nil {
+			err = backendStorage.Move(ctx, filePath, quarantinePath)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to quarantine file %s. Reason: %v", filePath, err))
+		} else {
+			f.moveSecondaryCopy(ctx, filePath, quarantinePath)
+			key := f.blobKey(quarantinePath)
+			quarantineKey = &key
+		}
+	}
+	updated, err := f.repo.UpdateScanStatus(ctx, *file.Id, fileKey, scanStatus, quarantineKey)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to update scan status of file %d. Reason: %v", *file.Id, err))
+	} else if !updated {
+		log.Warn(fmt.Sprintf("File %d was moved or deleted during its scan", *file.Id))
+	}
+	if (err != nil || !updated) && quarantineKey != nil {
+		moveErr := backendStorage.Move(ctx, quarantinePath, filePath)
+		if moveErr != nil {
+			log.Error(fmt.Sprintf("Failed to move file %s back from the quarantine dir. Reason: %v", filePath, moveErr))
+		} else {
+			f.moveSecondaryCopy(ctx, quarantinePath, filePath)
+		}
+	}
+	return err
+}
+
+// quarantinePath returns where the infected blob of the file is moved to, in the storage of its backend. The paths of
+// the cold and remote storages are relative to the upload dir, so their blobs are quarantined under it even if the
+// quarantine dir of the hot storage is elsewhere.
+func (f fileService) quarantinePath(file repository.File) (string, error) {
+	bucketConfig, ok := f.config.Bucket(*file.Bucket)
+	if !ok {
+		return "", ErrBucketNotFound
+	}
+	quarantineDir := f.quarantineDir
+	if file.Backend != nil && *file.Backend != repository.BackendHot {
+		quarantineDir = filepath.Join(f.fileDir, quarantineDirName)
+	}
+	return filepath.Join(quarantineDir, bucketConfig.StoragePrefix, filepath.Base(f.blobPath(*file.FilePath))), nil
+}
+
+func (f fileService) scan(ctx context.Context, file repository.File) (string, error) {
+	contents, err := f.openFile(ctx, file, true)
+	if err != nil {
+		return repository.ScanStatusError, err
+	}
+	defer utils.CloseFile(contents)
+	result, err := f.scanner.Scan(contents)
+	if err != nil {
+		return repository.ScanStatusError, err
+	}
+	if result.Infected {
+		log.Warn(fmt.Sprintf("File %s is infected with %s", *file.FilePath, result.Signature))
+		return repository.ScanStatusInfected, nil
+	}
+	return repository.ScanStatusClean, nil
+}
+
+// RemainingQuota returns the bytes that the owner can still upload to the bucket, or -1 if there's no byte quota.
+// ErrQuotaExceeded is returned if either the byte or the file count quota is used up, and ErrOwnerRequired if the
+// bucket has owner quotas and owner is empty.
+func (f fileService) RemainingQuota(ctx context.Context, bucket string, owner string) (int64, error) {
+	return f.remainingQuota(ctx, bucket, owner, nil)
+}
+
+// checkQuota checks that the upload fits in the quotas, within the transaction inserting it. The quotas of the bucket
+// are locked until the transaction ends, so that the concurrent uploads can't exceed them together.
+func (f fileService) checkQuota(ctx context.Context, bucket string, owner string, size int64, tx *sql.Tx) error {
+	bucketConfig, ok := f.config.Bucket(bucket)
+	if !ok {
+		return ErrBucketNotFound
+	}
+	if !hasQuota(bucketConfig) {
+		return nil
+	}
+	err := f.repo.TxLockQuota(ctx, bucket, tx)
+	if err != nil {
+		return err
+	}
+	remainingQuota, err := f.remainingQuota(ctx, bucket, owner, tx)
+	if err != nil {
+		return err
+	}
+	if remainingQuota >= 0 && size > remainingQuota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// remainingQuota is RemainingQuota, within the transaction if tx is not nil.
+func (f fileService) remainingQuota(ctx context.Context, bucket string, owner string, tx *sql.Tx) (int64, error) {
+	bucketConfig, ok := f.config.Bucket(bucket)
+	if !ok {
+		return 0, ErrBucketNotFound
+	}
+	if owner == "" && (bucketConfig.OwnerQuotaBytes > 0 || bucketConfig.OwnerQuotaFiles > 0) {
+		return 0, ErrOwnerRequired
+	}
+	if !hasQuota(bucketConfig) {
+		return -1, nil // Skip the usage queries
+	}
+	report, err := f.usageReport(ctx, bucket, owner, tx)
+	if err != nil {
+		return 0, err
+	}
+	remaining := int64(-1)
+	usages := []Usage{report.Usage}
+	if report.OwnerUsage != nil {
+		usages = append(usages, *report.OwnerUsage)
+	}
+	for _, usage := range usages {
+		if usage.QuotaFiles > 0 && usage.Files >= usage.QuotaFiles {
+			return 0, ErrQuotaExceeded
+		}
+		if usage.QuotaBytes > 0 {
+			if usage.Bytes >= usage.QuotaBytes {
+				return 0, ErrQuotaExceeded
+			}
+			if remaining < 0 || usage.QuotaBytes-usage.Bytes < remaining {
+				remaining = usage.QuotaBytes - usage.Bytes
+			}
+		}
+	}
+	return remaining, nil
+}
+
+func hasQuota(bucketConfig config.BucketConfig) bool {
+	return bucketConfig.QuotaBytes > 0 || bucketConfig.QuotaFiles > 0 || bucketConfig.OwnerQuotaBytes > 0 ||
+		bucketConfig.OwnerQuotaFiles > 0
+}
+
+// GetUsage reports the consumption of the bucket and, if owner is not empty, of the owner within the bucket.
+func (f fileService) GetUsage(ctx context.Context, bucket string, owner string) (UsageReport, error) {
+	return f.usageReport(ctx, bucket, owner, nil)
+}
+
+// usageReport is GetUsage, within the transaction if tx is not nil.
+func (f fileService) usageReport(ctx context.Context, bucket string, owner string, tx *sql.Tx) (UsageReport, error) {
+	report := UsageReport{Bucket: bucket, Owner: owner}
+	bucketConfig, ok := f.config.Bucket(bucket)
+	if !ok {
+		return report, ErrBucketNotFound
+	}
+	getUsage := func(owner *string) (repository.Usage, error) {
+		if tx == nil {
+			return f.repo.GetUsage(ctx, bucket, owner)
+		}
+		return f.repo.TxGetUsage(ctx, bucket, owner, tx)
+	}
+	usage, err := getUsage(nil)
+	if err != nil {
+		return report, err
+	}
+	report.Usage = Usage{usage.Bytes, usage.Files, bucketConfig.QuotaBytes, bucketConfig.QuotaFiles}
+	if owner != "" {
+		usage, err = getUsage(&owner)
+		if err != nil {
+			return report, err
+		}
+		report.OwnerUsage = &Usage{usage.Bytes, usage.Files, bucketConfig.OwnerQuotaBytes, bucketConfig.OwnerQuotaFiles}
+	}
+	return report, nil
+}
+
+// RewrapDataKeys wraps the data keys of the files encrypted under a retired master key with the active master key.
+// Only the wrapped keys in the files table are updated, the blobs are left untouched. Files that fail are reported and
+// skipped, so the rotation can be run again once the cause is fixed.
+func (f fileService) RewrapDataKeys(ctx context.Context, afterId int64, batchSize int) (KeyRotationReport, error) {
+	report := KeyRotationReport{LastId: afterId}
+	if f.encryptor == nil {
+		return report, ErrEncryptionDisabled
+	}
+	if batchSize <= 0 {
+		batchSize = purgeBatchSize
+	}
+	activeKeyId := f.encryptor.ActiveKeyId()
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		files, err := f.repo.GetFilesNotWrappedBy(ctx, activeKeyId, report.LastId, batchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			err = f.rewrapDataKey(ctx, file)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to rewrap the data key of file %d. Reason: %v", *file.Id, err))
+				report.Failures = append(report.Failures, KeyRotationFailure{*file.Id, err.Error()})
+			} else {
+				report.Rewrapped++
+			}
+			report.LastId = *file.Id
+		}
+		log.Info(fmt.Sprintf("Rewrapped %d data keys with master key %s, up to file %d", report.Rewrapped, activeKeyId, report.LastId))
+		if len(files) < batchSize {
+			return report, nil
+		}
+	}
+}
+
+func (f fileService) rewrapDataKey(ctx context.Context, file repository.File) error {
+	if file.WrappedKey == nil {
+		return errors.New("missing wrapped key")
+	}
+	wrappedKey, err := f.encryptor.RewrapKey(*file.EncryptionKeyId, *file.WrappedKey)
+	if err != nil {
+		return err
+	}
+	updated, err := f.repo.UpdateWrappedKey(ctx, *file.Id, *file.EncryptionKeyId, f.encryptor.ActiveKeyId(), wrappedKey)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		log.Info(fmt.Sprintf("File %d was deleted or rewrapped during the rotation", *file.Id))
+	}
+	return nil
 }
@@ -1,19 +1,34 @@
 package services_test
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"gocleancode/config"
 	mockDb "gocleancode/db/mocks"
 	"gocleancode/repository"
 	mockRepos "gocleancode/repository/mocks"
+	"gocleancode/scanner"
+	mockScanner "gocleancode/scanner/mocks"
 	"gocleancode/services"
+	"gocleancode/storage"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/textproto"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,18 +38,37 @@ var uploadDir = os.TempDir() + "fileService_test/"
 func createFileService() (*mockDb.Db, *mockRepos.FileRepo, services.FileService) {
 	fileRepo := &mockRepos.FileRepo{}
 	db := &mockDb.Db{}
-	appConfig := config.Configuration{UploadDir: uploadDir}
-	fileService := services.NewFileService(db, fileRepo, appConfig)
+	appConfig := config.Configuration{UploadDir: uploadDir, ShardDepth: 2, Buckets: map[string]config.BucketConfig{
+		"images": {MaxFileSize: 10, AllowedTypes: []string{"image/*"}, RetentionDays: 7},
+		"shared": {QuotaBytes: 100, QuotaFiles: 10, OwnerQuotaBytes: 50},
+	}, UploadPolicy: config.UploadPolicy{MaxFileSize: 1 << 20, DeniedTypes: []string{"application/x-msdownload"},
+		DeniedExtensions: []string{".exe"}}, ThumbnailSizes: []int{50, 100}, MaxDerivativesPerFile: 2}
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, appConfig)
 	return db, fileRepo, fileService
 }
 
+// runTransactions makes the mock db run the transactions, which succeed unless their function fails.
+func runTransactions(db *mockDb.Db) {
+	db.On("Transact", mock.Anything, mock.Anything).Return(func(ctx context.Context, f func(*sql.Tx) error) error {
+		return f(&sql.Tx{})
+	})
+}
+
+// recordPendingDeletions makes the mock repo record the pending deletions of an upload.
+func recordPendingDeletions(fileRepo *mockRepos.FileRepo) {
+	fileRepo.On("TxSavePendingDeletion", mock.Anything, mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(int64(1), nil)
+	fileRepo.On("TxDeletePendingDeletion", mock.Anything, int64(1), mock.Anything).Return(nil)
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(1)).Return(nil)
+}
+
+type MockFile struct {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
 func TestSaveFile(t *testing.T) {
-	type MockFile struct {
-		io.Reader
-		io.ReaderAt
-		io.Seeker
-		io.Closer
-	}
 	fileContents := "This is a test."
 	fileToSave := &MockFile{}
 	fileToSave.Reader = strings.NewReader(fileContents)
@@ -43,51 +77,466 @@ func TestSaveFile(t *testing.T) {
 	header := textproto.MIMEHeader{}
 	header.Add("Content-Type", contentType)
 	fileHeader := &multipart.FileHeader{Filename: fileName, Header: header}
-	_, fileRepo, fileService := createFileService()
+	db, fileRepo, fileService := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
 	fileParamMatcher := mock.MatchedBy(func(f repository.File) bool {
+		bucketMatched := *f.Bucket == config.DefaultBucket
 		fileNameMatched := *f.FileName == fileName
-		filePath := *f.FilePath
-		filePathMatched := strings.HasPrefix(filePath, uploadDir) && strings.HasSuffix(filePath, fileName)
+		// Relative to the upload dir, eg default/ab/cd/<blob name>
+		filePathMatched := len(strings.Split(*f.FilePath, "/")) == 4 && strings.HasPrefix(*f.FilePath, config.DefaultBucket+"/")
 		contentTypeMatched := *f.ContentType == contentType
-		return fileNameMatched && filePathMatched && contentTypeMatched
+		return bucketMatched && fileNameMatched && filePathMatched && contentTypeMatched
 	})
 	expectedGeneratedId := int64(8)
-	fileRepo.On("SaveFile", fileParamMatcher).Return(expectedGeneratedId, nil).Once()
-	actualGeneratedId, err := fileService.SaveFile(fileToSave, fileHeader)
+	var filePath, checksum string
+	fileRepo.On("TxSaveFile", mock.Anything, fileParamMatcher, mock.Anything).Run(func(args mock.Arguments) {
+		filePath = filepath.Join(uploadDir, *args.Get(1).(repository.File).FilePath)
+		checksum = *args.Get(1).(repository.File).Checksum
+	}).Return(expectedGeneratedId, nil).Once()
+	actualGeneratedId, err := fileService.SaveFile(context.Background(), config.DefaultBucket, "", fileToSave, fileHeader, services.UploadOptions{})
 	assert.Nil(t, err)
 	assert.Equal(t, expectedGeneratedId, actualGeneratedId)
-	fileRepo.AssertCalled(t, "SaveFile", fileParamMatcher)
+	fileRepo.AssertCalled(t, "TxSaveFile", mock.Anything, fileParamMatcher, mock.Anything)
+	// The staged contents are renamed to the saved path, and their pending deletions are removed with the insert
+	savedContents, err := ioutil.ReadFile(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, fileContents, string(savedContents))
+	expectedChecksum := sha256.Sum256([]byte(fileContents))
+	assert.Equal(t, hex.EncodeToString(expectedChecksum[:]), checksum)
+	_, err = os.Stat(filePath + ".staged")
+	assert.True(t, os.IsNotExist(err))
+	fileRepo.AssertNumberOfCalls(t, "TxSavePendingDeletion", 2)
+	fileRepo.AssertNumberOfCalls(t, "TxDeletePendingDeletion", 2)
+	fileRepo.AssertNotCalled(t, "DeletePendingDeletion", mock.Anything, mock.Anything)
+}
+
+func TestSaveFileDeletesBlobsWhenInsertFails(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	fileHeader := &multipart.FileHeader{Filename: "TestSaveFileDeletesBlobsWhenInsertFails.txt", Header: header}
+	var filePath string
+	insertErr := errors.New("insert failed")
+	fileRepo.On("TxSaveFile", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		filePath = filepath.Join(uploadDir, *args.Get(1).(repository.File).FilePath)
+	}).Return(int64(0), insertErr).Once()
+	// When
+	_, err := fileService.SaveFile(context.Background(), config.DefaultBucket, "", &MockFile{Reader: strings.NewReader("hello")}, fileHeader, services.UploadOptions{})
+	// Then
+	assert.Equal(t, insertErr, err)
+	_, err = os.Stat(filePath + ".staged")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(err))
+	fileRepo.AssertNotCalled(t, "TxDeletePendingDeletion", mock.Anything, mock.Anything, mock.Anything)
+	fileRepo.AssertNumberOfCalls(t, "DeletePendingDeletion", 2)
+}
+
+func TestSaveFileWithPastExpiry(t *testing.T) {
+	_, fileRepo, fileService := createFileService()
+	fileHeader := &multipart.FileHeader{Filename: "TestSaveFileWithPastExpiry.txt", Header: textproto.MIMEHeader{}}
+	expiresAt := time.Now().Add(-time.Second)
+	_, err := fileService.SaveFile(context.Background(), config.DefaultBucket, "", &MockFile{Reader: strings.NewReader("hello")}, fileHeader,
+		services.UploadOptions{ExpiresAt: &expiresAt})
+	assert.Equal(t, services.ErrInvalidExpiry, err)
+	fileRepo.AssertNotCalled(t, "TxSaveFile", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSaveAndOpenEncryptedFile(t *testing.T) {
+	// Given
+	fileRepo := &mockRepos.FileRepo{}
+	encryptor, err := storage.NewEncryptor(map[string]string{"key1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := config.Configuration{UploadDir: uploadDir}
+	db := &mockDb.Db{}
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, encryptor, appConfig)
+	fileContents := "This is a secret."
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	fileHeader := &multipart.FileHeader{Filename: "TestSaveAndOpenEncryptedFile.txt", Header: header, Size: int64(len(fileContents))}
+	var savedFile repository.File
+	fileRepo.On("TxSaveFile", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		savedFile = args.Get(1).(repository.File)
+	}).Return(int64(1), nil).Once()
+	// When
+	_, err = fileService.SaveFile(context.Background(), config.DefaultBucket, "", &MockFile{Reader: strings.NewReader(fileContents)}, fileHeader, services.UploadOptions{})
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, "key1", *savedFile.EncryptionKeyId)
+	assert.NotEmpty(t, *savedFile.WrappedKey)
+	storedContents, err := ioutil.ReadFile(filepath.Join(uploadDir, *savedFile.FilePath))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(storedContents), fileContents)
+	contents, err := fileService.OpenFile(context.Background(), savedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	decryptedContents, err := ioutil.ReadAll(contents)
+	assert.Nil(t, err)
+	assert.Equal(t, fileContents, string(decryptedContents))
+}
+
+func TestSaveAndOpenCompressedFile(t *testing.T) {
+	// Given
+	fileRepo := &mockRepos.FileRepo{}
+	db := &mockDb.Db{}
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	appConfig := config.Configuration{UploadDir: uploadDir,
+		CompressionRules: []config.CompressionRule{{ContentTypes: []string{"text/*"}, Encoding: storage.EncodingZstd}}}
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, appConfig)
+	fileContents := strings.Repeat("id,name,amount\n1,alice,10\n", 100)
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	var savedFiles []repository.File
+	fileRepo.On("TxSaveFile", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		savedFiles = append(savedFiles, args.Get(1).(repository.File))
+	}).Return(int64(1), nil).Twice()
+	// When
+	for _, contents := range []string{fileContents, "hi"} {
+		fileHeader := &multipart.FileHeader{Filename: "TestSaveAndOpenCompressedFile.txt", Header: header}
+		_, err := fileService.SaveFile(context.Background(), config.DefaultBucket, "", &MockFile{Reader: strings.NewReader(contents)}, fileHeader, services.UploadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Then
+	savedFile := savedFiles[0]
+	assert.Equal(t, storage.EncodingZstd, *savedFile.ContentEncoding)
+	assert.Equal(t, int64(len(fileContents)), *savedFile.Size)
+	assert.Nil(t, savedFiles[1].ContentEncoding, "contents that don't compress are stored as is")
+	storedContents, err := ioutil.ReadFile(filepath.Join(uploadDir, *savedFile.FilePath))
+	assert.Nil(t, err)
+	assert.Less(t, len(storedContents), len(fileContents))
+	contents, err := fileService.OpenFile(context.Background(), savedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	_, err = contents.Seek(15, io.SeekStart)
+	assert.Nil(t, err)
+	part := make([]byte, 11)
+	_, err = io.ReadFull(contents, part)
+	assert.Nil(t, err)
+	assert.Equal(t, "1,alice,10\n", string(part))
+	encodedContents, err := fileService.OpenEncodedFile(context.Background(), savedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encodedContents.Close()
+	readEncoded, err := ioutil.ReadAll(encodedContents)
+	assert.Nil(t, err)
+	assert.Equal(t, storedContents, readEncoded)
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	// Given
+	fileRepo := &mockRepos.FileRepo{}
+	masterKeys := map[string]string{"key1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", "key2": "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="}
+	oldEncryptor, err := storage.NewEncryptor(masterKeys, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor, err := storage.NewEncryptor(masterKeys, "key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := config.Configuration{UploadDir: uploadDir}
+	fileService := services.NewFileService(&mockDb.Db{}, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, encryptor, appConfig)
+	dataKey, wrappedKey, err := oldEncryptor.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrappedId, unknownKeyId := int64(3), int64(4)
+	oldKeyId, unknownKey := "key1", "key0"
+	files := []repository.File{{Id: &rewrappedId, EncryptionKeyId: &oldKeyId, WrappedKey: &wrappedKey},
+		{Id: &unknownKeyId, EncryptionKeyId: &unknownKey, WrappedKey: &wrappedKey}}
+	fileRepo.On("GetFilesNotWrappedBy", mock.Anything, "key2", int64(2), 2).Return(files, nil).Once()
+	fileRepo.On("GetFilesNotWrappedBy", mock.Anything, "key2", unknownKeyId, 2).Return([]repository.File{}, nil).Once()
+	var rewrappedKey string
+	fileRepo.On("UpdateWrappedKey", mock.Anything, rewrappedId, "key1", "key2", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		rewrappedKey = args.String(4)
+	}).Return(true, nil).Once()
+	// When
+	report, err := fileService.RewrapDataKeys(context.Background(), 2, 2)
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	assert.Equal(t, 1, report.Rewrapped)
+	assert.Equal(t, unknownKeyId, report.LastId)
+	assert.Equal(t, []services.KeyRotationFailure{{FileId: unknownKeyId, Reason: storage.ErrUnknownMasterKey.Error()}}, report.Failures)
+	unwrappedKey, err := encryptor.UnwrapKey("key2", rewrappedKey)
+	assert.Nil(t, err)
+	assert.Equal(t, dataKey, unwrappedKey)
+}
+
+func TestRewrapDataKeysWithoutEncryption(t *testing.T) {
+	_, _, fileService := createFileService()
+	_, err := fileService.RewrapDataKeys(context.Background(), 0, 100)
+	assert.Equal(t, services.ErrEncryptionDisabled, err)
+}
+
+func TestSaveFileRejectedByBucket(t *testing.T) {
+	_, fileRepo, fileService := createFileService()
+	tests := []struct {
+		bucket      string
+		contentType string
+		size        int64
+		expectedErr error
+	}{
+		{"unknown", "image/png", 1, services.ErrBucketNotFound},
+		{"images", "image/png", 11, services.ErrFileTooLarge},
+		{"images", "text/plain", 1, services.ErrContentTypeNotAllowed},
+	}
+	for _, test := range tests {
+		header := textproto.MIMEHeader{}
+		header.Add("Content-Type", test.contentType)
+		fileHeader := &multipart.FileHeader{Filename: "TestSaveFileRejectedByBucket", Header: header, Size: test.size}
+		_, err := fileService.SaveFile(context.Background(), test.bucket, "", &MockFile{Reader: strings.NewReader("")}, fileHeader, services.UploadOptions{})
+		assert.Equal(t, test.expectedErr, err)
+	}
+	fileRepo.AssertNotCalled(t, "TxSaveFile", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSaveFileDetectsContentType(t *testing.T) {
+	pngContents := "\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR"
+	tests := []struct {
+		fileName            string
+		claimedType         string
+		contents            string
+		expectedContentType string
+		expectedErr         error
+	}{
+		{"image.png", "application/octet-stream", pngContents, "image/png", nil},
+		{"notes.csv", "text/csv", "a,b\n1,2\n", "text/csv", nil},
+		{"report.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", "PK\x03\x04",
+			"application/vnd.openxmlformats-officedocument.wordprocessingml.document", nil},
+		{"fake.png", "image/png", "<html><script></script></html>", "", services.ErrContentTypeMismatch},
+		{"page.csv", "text/csv", "<html><script></script></html>", "", services.ErrContentTypeMismatch},
+		{"setup.bin", "application/octet-stream", "MZ\x90\x00", "", services.ErrContentTypeNotAllowed},
+		{"setup.exe", "application/octet-stream", "", "", services.ErrExtensionNotAllowed},
+	}
+	for _, test := range tests {
+		db, fileRepo, fileService := createFileService()
+		runTransactions(db)
+		recordPendingDeletions(fileRepo)
+		header := textproto.MIMEHeader{}
+		header.Add("Content-Type", test.claimedType)
+		fileHeader := &multipart.FileHeader{Filename: test.fileName, Header: header, Size: int64(len(test.contents))}
+		fileParamMatcher := mock.MatchedBy(func(f repository.File) bool {
+			return *f.ContentType == test.expectedContentType
+		})
+		fileRepo.On("TxSaveFile", mock.Anything, fileParamMatcher, mock.Anything).Return(int64(1), nil).Once()
+		// When
+		_, err := fileService.SaveFile(context.Background(), config.DefaultBucket, "", &MockFile{Reader: strings.NewReader(test.contents)}, fileHeader, services.UploadOptions{})
+		// Then
+		assert.Equal(t, test.expectedErr, err, test.fileName)
+		if test.expectedErr == nil {
+			fileRepo.AssertCalled(t, "TxSaveFile", mock.Anything, fileParamMatcher, mock.Anything)
+		} else {
+			fileRepo.AssertNotCalled(t, "TxSaveFile", mock.Anything, mock.Anything, mock.Anything)
+		}
+	}
+}
+
+func TestSaveFileExceedingQuota(t *testing.T) {
+	_, fileRepo, fileService := createFileService()
+	bucket := "shared"
+	owner := "user1"
+	fileRepo.On("GetUsage", mock.Anything, bucket, (*string)(nil)).Return(repository.Usage{Bytes: 60, Files: 2}, nil)
+	fileRepo.On("GetUsage", mock.Anything, bucket, &owner).Return(repository.Usage{Bytes: 45, Files: 1}, nil)
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	fileHeader := &multipart.FileHeader{Filename: "TestSaveFileExceedingQuota.txt", Header: header, Size: 6}
+	// When
+	_, err := fileService.SaveFile(context.Background(), bucket, owner, &MockFile{Reader: strings.NewReader("")}, fileHeader, services.UploadOptions{})
+	// Then
+	assert.Equal(t, services.ErrQuotaExceeded, err)
+	fileRepo.AssertNotCalled(t, "TxSaveFile", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSaveFileExceedingQuotaWhenInserted(t *testing.T) {
+	db, fileRepo, fileService := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	bucket := "shared"
+	owner := "user1"
+	fileRepo.On("GetUsage", mock.Anything, bucket, (*string)(nil)).Return(repository.Usage{Bytes: 60, Files: 2}, nil)
+	fileRepo.On("GetUsage", mock.Anything, bucket, &owner).Return(repository.Usage{Bytes: 40, Files: 1}, nil)
+	// A concurrent upload was inserted meanwhile
+	fileRepo.On("TxLockQuota", mock.Anything, bucket, mock.Anything).Return(nil).Once()
+	fileRepo.On("TxGetUsage", mock.Anything, bucket, (*string)(nil), mock.Anything).Return(repository.Usage{Bytes: 70, Files: 3}, nil)
+	fileRepo.On("TxGetUsage", mock.Anything, bucket, &owner, mock.Anything).Return(repository.Usage{Bytes: 48, Files: 2}, nil)
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	fileHeader := &multipart.FileHeader{Filename: "TestSaveFileExceedingQuotaWhenInserted.txt", Header: header, Size: 6}
+	// When
+	_, err := fileService.SaveFile(context.Background(), bucket, owner, &MockFile{Reader: strings.NewReader("hello!")}, fileHeader, services.UploadOptions{})
+	// Then
+	assert.Equal(t, services.ErrQuotaExceeded, err)
+	fileRepo.AssertCalled(t, "TxLockQuota", mock.Anything, bucket, mock.Anything)
+	fileRepo.AssertNotCalled(t, "TxSaveFile", mock.Anything, mock.Anything, mock.Anything)
+	fileRepo.AssertNumberOfCalls(t, "DeletePendingDeletion", 2)
+}
+
+func TestSaveFileWithoutOwnerToBucketWithOwnerQuotas(t *testing.T) {
+	_, fileRepo, fileService := createFileService()
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	fileHeader := &multipart.FileHeader{Filename: "TestSaveFileWithoutOwner.txt", Header: header, Size: 5}
+	// When
+	_, err := fileService.SaveFile(context.Background(), "shared", "", &MockFile{Reader: strings.NewReader("hello")}, fileHeader, services.UploadOptions{})
+	// Then
+	assert.Equal(t, services.ErrOwnerRequired, err)
+	fileRepo.AssertNotCalled(t, "GetUsage", mock.Anything, mock.Anything, mock.Anything)
+	fileRepo.AssertNotCalled(t, "TxSaveFile", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestGetUsage(t *testing.T) {
+	_, fileRepo, fileService := createFileService()
+	bucket := "shared"
+	owner := "user1"
+	fileRepo.On("GetUsage", mock.Anything, bucket, (*string)(nil)).Return(repository.Usage{Bytes: 60, Files: 2}, nil)
+	fileRepo.On("GetUsage", mock.Anything, bucket, &owner).Return(repository.Usage{Bytes: 45, Files: 1}, nil)
+	// When
+	report, err := fileService.GetUsage(context.Background(), bucket, owner)
+	remainingQuota, remainingErr := fileService.RemainingQuota(context.Background(), bucket, owner)
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, services.Usage{Bytes: 60, Files: 2, QuotaBytes: 100, QuotaFiles: 10}, report.Usage)
+	assert.Equal(t, &services.Usage{Bytes: 45, Files: 1, QuotaBytes: 50}, report.OwnerUsage)
+	assert.Nil(t, remainingErr)
+	assert.Equal(t, int64(5), remainingQuota)
+}
+
+func TestScanPendingFiles(t *testing.T) {
+	// Given
+	fileRepo := &mockRepos.FileRepo{}
+	fileScanner := &mockScanner.Scanner{}
+	quarantineDir := uploadDir + "quarantine"
+	appConfig := config.Configuration{UploadDir: uploadDir, QuarantineDir: quarantineDir}
+	fileService := services.NewFileService(&mockDb.Db{}, fileRepo, storage.NewLocalStorage(), nil, nil, nil, fileScanner, nil, appConfig)
+	cleanId, infectedId := int64(1), int64(2)
+	bucket := config.DefaultBucket
+	// A key relative to the upload dir, and an absolute path stored before the keys were relative
+	cleanKey, infectedPath := "TestScanPendingFiles.txt", uploadDir+"TestScanPendingFiles.exe"
+	for _, filePath := range []string{uploadDir + cleanKey, infectedPath} {
+		err := ioutil.WriteFile(filePath, []byte(filePath), 0666)
+		if err != nil {
+			t.Errorf("Expected no error in creating file, but got %s instead", err)
+		}
+	}
+	files := []repository.File{{Id: &cleanId, Bucket: &bucket, FilePath: &cleanKey}, {Id: &infectedId, Bucket: &bucket, FilePath: &infectedPath}}
+	fileRepo.On("GetUnscannedFiles", mock.Anything, int64(0), mock.AnythingOfType("int")).Return(files, nil).Once()
+	fileScanner.On("Scan", mock.Anything).Return(scanner.Result{}, nil).Once()
+	fileScanner.On("Scan", mock.Anything).Return(scanner.Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil).Once()
+	expectedQuarantinePath := filepath.Join(quarantineDir, bucket, "TestScanPendingFiles.exe")
+	expectedQuarantineKey := "quarantine/default/TestScanPendingFiles.exe"
+	fileRepo.On("UpdateScanStatus", mock.Anything, cleanId, cleanKey, repository.ScanStatusClean, (*string)(nil)).Return(true, nil).Once()
+	fileRepo.On("UpdateScanStatus", mock.Anything, infectedId, infectedPath, repository.ScanStatusInfected, &expectedQuarantineKey).Return(true, nil).Once()
+	// When
+	err := fileService.ScanPendingFiles(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	_, err = os.Stat(infectedPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(expectedQuarantinePath)
+	assert.Nil(t, err)
+}
+
+func TestScanPendingFilesOfColdStorage(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hotDir, coldDir := filepath.Join(dir, "uploads"), filepath.Join(dir, "cold")
+	fileRepo := &mockRepos.FileRepo{}
+	fileScanner := &mockScanner.Scanner{}
+	// The quarantine dir of the hot storage is outside of the upload dir, which the cold storage can't hold
+	appConfig := config.Configuration{UploadDir: hotDir, QuarantineDir: filepath.Join(dir, "quarantine")}
+	fileService := services.NewFileService(&mockDb.Db{}, fileRepo, storage.NewLocalStorage(), nil, storage.NewLocalMirror(hotDir, coldDir), nil,
+		fileScanner, nil, appConfig)
+	movedId, infectedId := int64(1), int64(2)
+	bucket, backend := config.DefaultBucket, repository.BackendCold
+	movedKey, infectedKey := "default/ab/cd/moved", "default/ab/cd/infected"
+	for _, key := range []string{movedKey, infectedKey} {
+		coldPath := filepath.Join(coldDir, filepath.FromSlash(key))
+		err = os.MkdirAll(filepath.Dir(coldPath), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(coldPath, []byte(key), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []repository.File{{Id: &movedId, Bucket: &bucket, FilePath: &movedKey, Backend: &backend},
+		{Id: &infectedId, Bucket: &bucket, FilePath: &infectedKey, Backend: &backend}}
+	fileRepo.On("GetUnscannedFiles", mock.Anything, int64(0), mock.AnythingOfType("int")).Return(files, nil).Once()
+	fileScanner.On("Scan", mock.Anything).Return(scanner.Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil).Twice()
+	movedQuarantineKey, infectedQuarantineKey := ".quarantine/default/moved", ".quarantine/default/infected"
+	// The first file was moved during its scan
+	fileRepo.On("UpdateScanStatus", mock.Anything, movedId, movedKey, repository.ScanStatusInfected, &movedQuarantineKey).Return(false, nil).Once()
+	fileRepo.On("UpdateScanStatus", mock.Anything, infectedId, infectedKey, repository.ScanStatusInfected, &infectedQuarantineKey).Return(true, nil).Once()
+	// When
+	err = fileService.ScanPendingFiles(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	_, err = os.Stat(filepath.Join(coldDir, "default", "ab", "cd", "moved"))
+	assert.Nil(t, err, "the blob of the moved file is put back")
+	_, err = os.Stat(filepath.Join(coldDir, ".quarantine", "default", "moved"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(coldDir, "default", "ab", "cd", "infected"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(coldDir, ".quarantine", "default", "infected"))
+	assert.Nil(t, err, "the infected blob is quarantined in the cold storage")
 }
 
 func TestDeleteFileById(t *testing.T) {
 	// Given
 	db, fileRepo, fileService := createFileService()
 	fileId := int64(1)
+	bucket := config.DefaultBucket
 	fileName := "fname"
 	filePath := uploadDir + "TestDeleteFileById.txt"
 	contentType := "contentType"
 	createdDt := time.Now()
-	file := repository.File{FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt}
-	fileRepo.On("GetFileById", fileId).Return(file, nil).Once()
+	file := repository.File{Id: &fileId, Bucket: &bucket, FileName: &fileName, FilePath: &filePath, ContentType: &contentType, CreatedDt: &createdDt}
+	fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(file, nil).Once()
 	tx := &sql.Tx{}
-	db.On("Transact", mock.Anything).Return(func(f func(*sql.Tx) error) error {
+	db.On("Transact", mock.Anything, mock.Anything).Return(func(ctx context.Context, f func(*sql.Tx) error) error {
 		return f(tx)
 	}).Once()
-	fileRepo.On("TxDeleteFileById", fileId, tx).Return(nil).Once()
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, fileId, tx).Return(nil).Once()
+	fileRepo.On("TxSavePendingDeletion", mock.Anything, filePath, (*string)(nil), tx).Return(int64(5), nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(5)).Return(nil).Once()
 	_, err := os.Create(filePath)
 	if err != nil {
 		t.Errorf("Expected no error in creating file, but got %s instead", err)
 	}
 	// When
-	err = fileService.DeleteFileById(fileId)
+	err = fileService.DeleteFileById(context.Background(), bucket, fileId)
 	// Then
 	if err != nil {
 		t.Errorf("Expected no error, but got %s instead", err)
 		return
 	}
-	fileRepo.AssertCalled(t, "GetFileById", fileId)
-	db.AssertCalled(t, "Transact", mock.Anything)
-	fileRepo.AssertCalled(t, "TxDeleteFileById", fileId, mock.AnythingOfType("*sql.Tx"))
+	fileRepo.AssertCalled(t, "GetFileById", mock.Anything, bucket, fileId)
+	db.AssertCalled(t, "Transact", mock.Anything, mock.Anything)
+	fileRepo.AssertCalled(t, "TxDeleteFileById", mock.Anything, bucket, fileId, mock.AnythingOfType("*sql.Tx"))
+	fileRepo.AssertCalled(t, "DeletePendingDeletion", mock.Anything, int64(5))
 	_, err = os.Stat(filePath)
 	assert.True(t, os.IsNotExist(err))
 }
@@ -96,9 +545,1004 @@ func TestGetFileById(t *testing.T) {
 	id := int64(1)
 	_, fileRepo, fileService := createFileService()
 	expectedFile := repository.File{}
-	fileRepo.On("GetFileById", id).Return(expectedFile, nil, nil).Once()
-	actualFile, err := fileService.GetFileById(id)
+	fileRepo.On("GetFileById", mock.Anything, config.DefaultBucket, id).Return(expectedFile, nil, nil).Once()
+	actualFile, err := fileService.GetFileById(context.Background(), config.DefaultBucket, id)
 	assert.Nil(t, err)
 	assert.Equal(t, expectedFile, actualFile)
-	fileRepo.AssertCalled(t, "GetFileById", id)
+	fileRepo.AssertCalled(t, "GetFileById", mock.Anything, config.DefaultBucket, id)
+}
+
+func TestGetFileByIdFromAnotherBucket(t *testing.T) {
+	id := int64(1)
+	_, fileRepo, fileService := createFileService()
+	fileRepo.On("GetFileById", mock.Anything, "images", id).Return(repository.File{}, sql.ErrNoRows).Once()
+	_, err := fileService.GetFileById(context.Background(), "images", id)
+	assert.Equal(t, services.ErrFileNotFound, err)
+}
+
+func TestPurgeExpiredFiles(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	fileId := int64(2)
+	bucket := "images"
+	filePath := uploadDir + "TestPurgeExpiredFiles.png"
+	file := repository.File{Id: &fileId, Bucket: &bucket, FilePath: &filePath}
+	fileRepo.On("GetExpiredFiles", mock.Anything, mock.AnythingOfType("time.Time"), int64(0), mock.AnythingOfType("int")).Return([]repository.File(nil), nil).Once()
+	fileRepo.On("GetFilesCreatedBefore", mock.Anything, bucket, mock.AnythingOfType("time.Time"), int64(0), mock.AnythingOfType("int")).
+		Return([]repository.File{file}, nil).Once()
+	tx := &sql.Tx{}
+	db.On("Transact", mock.Anything, mock.Anything).Return(func(ctx context.Context, f func(*sql.Tx) error) error {
+		return f(tx)
+	}).Once()
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, fileId, tx).Return(nil).Once()
+	fileRepo.On("TxSavePendingDeletion", mock.Anything, filePath, (*string)(nil), tx).Return(int64(5), nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(5)).Return(nil).Once()
+	_, err := os.Create(filePath)
+	if err != nil {
+		t.Errorf("Expected no error in creating file, but got %s instead", err)
+	}
+	// When
+	err = fileService.PurgeExpiredFiles(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertCalled(t, "TxDeleteFileById", mock.Anything, bucket, fileId, mock.AnythingOfType("*sql.Tx"))
+	fileRepo.AssertCalled(t, "DeletePendingDeletion", mock.Anything, int64(5))
+	_, err = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPurgeExpiredFilesPastTheirExpiry(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	fileId := int64(3)
+	bucket := "default"
+	filePath := uploadDir + "TestPurgeExpiredFilesPastTheirExpiry.csv"
+	expiresDt := time.Now().Add(-time.Minute)
+	file := repository.File{Id: &fileId, Bucket: &bucket, FilePath: &filePath, ExpiresDt: &expiresDt}
+	fileRepo.On("GetExpiredFiles", mock.Anything, mock.MatchedBy(func(expiredBefore time.Time) bool {
+		return !expiredBefore.Before(expiresDt)
+	}), int64(0), mock.AnythingOfType("int")).Return([]repository.File{file}, nil).Once()
+	fileRepo.On("GetFilesCreatedBefore", mock.Anything, "images", mock.AnythingOfType("time.Time"), int64(0), mock.AnythingOfType("int")).
+		Return([]repository.File(nil), nil).Once()
+	runTransactions(db)
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, fileId, mock.Anything).Return(nil).Once()
+	fileRepo.On("TxSavePendingDeletion", mock.Anything, filePath, (*string)(nil), mock.Anything).Return(int64(6), nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(6)).Return(nil).Once()
+	_, err := os.Create(filePath)
+	if err != nil {
+		t.Errorf("Expected no error in creating file, but got %s instead", err)
+	}
+	// When
+	err = fileService.PurgeExpiredFiles(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	_, err = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPurgeExpiredFilesContinuesAfterFailures(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	bucket := config.DefaultBucket
+	newFile := func(id int64) repository.File {
+		filePath := fmt.Sprintf("%sTestPurgeExpiredFilesContinuesAfterFailures%d.txt", uploadDir, id)
+		return repository.File{Id: &id, Bucket: &bucket, FilePath: &filePath}
+	}
+	failing, deleted, purged := newFile(4), newFile(5), newFile(6)
+	fileRepo.On("GetExpiredFiles", mock.Anything, mock.AnythingOfType("time.Time"), int64(0), mock.AnythingOfType("int")).
+		Return([]repository.File{failing, deleted, purged}, nil).Once()
+	fileRepo.On("GetFilesCreatedBefore", mock.Anything, "images", mock.AnythingOfType("time.Time"), int64(0), mock.AnythingOfType("int")).
+		Return([]repository.File(nil), nil).Once()
+	runTransactions(db)
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, int64(4), mock.Anything).Return(errors.New("database is locked")).Once()
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, int64(5), mock.Anything).Return(sql.ErrNoRows).Once() // Deleted by its owner meanwhile
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, int64(6), mock.Anything).Return(nil).Once()
+	fileRepo.On("TxSavePendingDeletion", mock.Anything, *purged.FilePath, (*string)(nil), mock.Anything).Return(int64(7), nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(7)).Return(nil).Once()
+	// When
+	err := fileService.PurgeExpiredFiles(context.Background())
+	// Then the other files and the buckets are still purged, and only the failure is reported
+	assert.Equal(t, "failed to purge 1 expired files", err.Error())
+	fileRepo.AssertExpectations(t)
+}
+
+func TestPurgePendingDeletions(t *testing.T) {
+	// Given
+	_, fileRepo, fileService := createFileService()
+	id, missingId := int64(3), int64(4)
+	filePath := uploadDir + "TestPurgePendingDeletions.txt.staged"
+	missingPath := uploadDir + "TestPurgePendingDeletionsMissing.txt"
+	fileRepo.On("GetPendingDeletions", mock.Anything, mock.MatchedBy(func(createdBefore time.Time) bool {
+		return createdBefore.Before(time.Now().Add(-time.Hour))
+	}), int64(0), mock.AnythingOfType("int")).Return([]repository.PendingDeletion{{Id: &id, FilePath: &filePath}, {Id: &missingId, FilePath: &missingPath}}, nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, id).Return(nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, missingId).Return(nil).Once()
+	_, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// When
+	err = fileService.PurgePendingDeletions(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	_, err = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPurgePendingDeletionsContinuesAfterFailures(t *testing.T) {
+	// Given a full batch whose first pending deletion fails
+	_, fileRepo, fileService := createFileService()
+	var batch []repository.PendingDeletion
+	for id := int64(1); id <= 100; id++ {
+		id := id
+		filePath := fmt.Sprintf("%sTestPurgePendingDeletionsContinuesAfterFailures%d.txt", uploadDir, id)
+		batch = append(batch, repository.PendingDeletion{Id: &id, FilePath: &filePath})
+	}
+	fileRepo.On("GetPendingDeletions", mock.Anything, mock.Anything, int64(0), mock.AnythingOfType("int")).Return(batch, nil).Once()
+	fileRepo.On("GetPendingDeletions", mock.Anything, mock.Anything, int64(100), mock.AnythingOfType("int")).Return(nil, nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(1)).Return(errors.New("connection reset")).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, mock.Anything).Return(nil)
+	// When
+	err := fileService.PurgePendingDeletions(context.Background())
+	// Then the others are deleted, and the next batch starts after them
+	assert.EqualError(t, err, "failed to delete 1 pending blobs")
+	fileRepo.AssertNumberOfCalls(t, "DeletePendingDeletion", 100)
+	fileRepo.AssertExpectations(t)
+}
+
+func TestReconcile(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileRepo := &mockRepos.FileRepo{}
+	fileService := services.NewFileService(&mockDb.Db{}, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, config.Configuration{UploadDir: dir})
+	referencedPath := filepath.Join(dir, "default", "a.txt")
+	orphanPath := filepath.Join(dir, "default", "b.txt")
+	recentPath := filepath.Join(dir, "default", "c.txt")
+	stagedPath := filepath.Join(dir, "default", "d.txt.staged")
+	quarantinedPath := filepath.Join(dir, ".quarantine", "e.txt")
+	missingPath := filepath.Join(dir, "default", "missing.txt")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, path := range []string{referencedPath, orphanPath, recentPath, stagedPath, quarantinedPath} {
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte("contents"), 0666)
+		}
+		if err == nil && path != recentPath {
+			err = os.Chtimes(path, old, old)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Blobs are looked up by key and, for the rows stored before the keys were relative, by absolute path
+	referencedId, missingId, referencedKey := int64(1), int64(2), "default/a.txt"
+	fileRepo.On("GetFiles", mock.Anything, int64(0), mock.AnythingOfType("int")).
+		Return([]repository.File{{Id: &referencedId, FilePath: &referencedKey}, {Id: &missingId, FilePath: &missingPath}}, nil)
+	fileRepo.On("GetReferencedFilePaths", mock.Anything, []string{referencedKey, referencedPath, "default/b.txt", orphanPath}).
+		Return([]string{referencedKey}, nil)
+	expectedReport := services.ReconcileReport{MissingBlobs: []services.MissingBlob{{FileId: missingId, FilePath: missingPath}},
+		Orphans: []string{orphanPath}}
+	// When
+	dryRunReport, dryRunErr := fileService.Reconcile(context.Background(), services.OrphanDelete, true)
+	_, dryRunStatErr := os.Stat(orphanPath)
+	report, err := fileService.Reconcile(context.Background(), services.OrphanQuarantine, false)
+	// Then
+	assert.Nil(t, dryRunErr)
+	assert.Equal(t, expectedReport, dryRunReport)
+	assert.Nil(t, dryRunStatErr, "the dry run leaves the orphan")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedReport, report)
+	_, err = os.Stat(orphanPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, ".quarantine", "orphans", "default", "b.txt"))
+	assert.Nil(t, err)
+	_, err = fileService.Reconcile(context.Background(), "archive", false)
+	assert.Equal(t, services.ErrUnknownOrphanAction, err)
+}
+
+func TestReconcileContinuesAfterFailures(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileRepo := &mockRepos.FileRepo{}
+	fileService := services.NewFileService(&mockDb.Db{}, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, config.Configuration{UploadDir: dir})
+	failingPath := filepath.Join(dir, "a", "x.txt")
+	orphanPath := filepath.Join(dir, "b", "y.txt")
+	// A file in place of the quarantine dir of the first orphan
+	blockingPath := filepath.Join(dir, ".quarantine", "orphans", "a")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, path := range []string{failingPath, orphanPath, blockingPath} {
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte("contents"), 0666)
+		}
+		if err == nil {
+			err = os.Chtimes(path, old, old)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileRepo.On("GetFiles", mock.Anything, int64(0), mock.AnythingOfType("int")).Return([]repository.File{}, nil)
+	fileRepo.On("GetReferencedFilePaths", mock.Anything, mock.Anything).Return([]string{}, nil)
+	// When
+	report, err := fileService.Reconcile(context.Background(), services.OrphanQuarantine, false)
+	// Then
+	assert.EqualError(t, err, "failed to quarantine 1 orphans")
+	assert.Equal(t, []string{failingPath, orphanPath}, report.Orphans)
+	if assert.Len(t, report.Failures, 1) {
+		assert.Equal(t, failingPath, report.Failures[0].Path)
+	}
+	_, err = os.Stat(failingPath)
+	assert.Nil(t, err, "the failed orphan is left in place")
+	_, err = os.Stat(filepath.Join(dir, ".quarantine", "orphans", "b", "y.txt"))
+	assert.Nil(t, err, "the next orphan is still quarantined")
+}
+
+func TestScrubFiles(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replicaDir := filepath.Join(dir, "replica")
+	uploadDir := filepath.Join(dir, "uploads")
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), storage.NewLocalMirror(uploadDir, replicaDir), nil, nil, nil, nil,
+		config.Configuration{UploadDir: uploadDir, ScrubInterval: 3600})
+	// sha256 of "hello"
+	checksum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	blobs := map[string]string{
+		filepath.Join(uploadDir, "default", "intact.txt"):      "hello",
+		filepath.Join(uploadDir, "default", "unchecked.txt"):   "hello",
+		filepath.Join(uploadDir, "default", "restorable.txt"):  "jello",
+		filepath.Join(replicaDir, "default", "restorable.txt"): "hello",
+		filepath.Join(uploadDir, "default", "corrupt.txt"):     "jello",
+		filepath.Join(replicaDir, "default", "corrupt.txt"):    "jello",
+	}
+	for path, contents := range blobs {
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bucket := config.DefaultBucket
+	newFile := func(id int64, name string, checksum *string) repository.File {
+		path := filepath.Join(uploadDir, "default", name)
+		return repository.File{Id: &id, Bucket: &bucket, FilePath: &path, Checksum: checksum}
+	}
+	files := []repository.File{newFile(1, "intact.txt", &checksum), newFile(2, "unchecked.txt", nil), newFile(3, "restorable.txt", &checksum),
+		newFile(4, "corrupt.txt", &checksum), newFile(5, "missing.txt", &checksum), newFile(6, "moved.txt", &checksum),
+		newFile(7, "deleted.txt", &checksum)}
+	// The corrupt and missing blobs are checked against the current rows
+	for _, file := range files[2:5] {
+		fileRepo.On("GetFileById", mock.Anything, bucket, *file.Id).Return(file, nil).Once()
+	}
+	// Moved to the cold storage meanwhile, and deleted meanwhile
+	cold := repository.BackendCold
+	moved := newFile(6, "moved.txt", &checksum)
+	moved.Backend = &cold
+	fileRepo.On("GetFileById", mock.Anything, bucket, int64(6)).Return(moved, nil).Once()
+	fileRepo.On("GetFileById", mock.Anything, bucket, int64(7)).Return(repository.File{}, sql.ErrNoRows).Once()
+	fileRepo.On("GetFilesScrubbedBefore", mock.Anything, mock.MatchedBy(func(scrubbedBefore time.Time) bool {
+		return scrubbedBefore.Before(time.Now().Add(-59 * time.Minute))
+	}), int64(0), mock.AnythingOfType("int")).Return(files, nil).Once()
+	fileRepo.On("UpdateIntegrity", mock.Anything, int64(1), &checksum, repository.IntegrityOk).Return(nil).Once()
+	fileRepo.On("UpdateIntegrity", mock.Anything, int64(2), &checksum, repository.IntegrityOk).Return(nil).Once()
+	fileRepo.On("UpdateIntegrity", mock.Anything, int64(3), &checksum, repository.IntegrityOk).Return(nil).Once()
+	fileRepo.On("UpdateIntegrity", mock.Anything, int64(4), &checksum, repository.IntegrityCorrupt).Return(nil).Once()
+	fileRepo.On("UpdateIntegrity", mock.Anything, int64(5), &checksum, repository.IntegrityCorrupt).Return(nil).Once()
+	// When
+	err = fileService.ScrubFiles(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertNumberOfCalls(t, "UpdateIntegrity", 5)
+	fileRepo.AssertNumberOfCalls(t, "GetFileById", 5)
+	restoredContents, err := ioutil.ReadFile(filepath.Join(uploadDir, "default", "restorable.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(restoredContents))
+	_, err = os.Stat(filepath.Join(uploadDir, "default", "corrupt.txt.staged"))
+	assert.True(t, os.IsNotExist(err), "the corrupt secondary copy is not kept")
+}
+
+func TestSaveFileReplicatesSynchronously(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primaryDir := filepath.Join(dir, "uploads")
+	secondaryDir := filepath.Join(dir, "secondary")
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), storage.NewLocalMirror(primaryDir, secondaryDir), nil, nil, nil, nil,
+		config.Configuration{UploadDir: primaryDir, ReplicationMode: services.ReplicationSync})
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain")
+	fileHeader := &multipart.FileHeader{Filename: "replicated.txt", Header: header}
+	var savedFile repository.File
+	fileRepo.On("TxSaveFile", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		savedFile = args.Get(1).(repository.File)
+	}).Return(int64(1), nil).Once()
+	// When
+	_, err = fileService.SaveFile(context.Background(), config.DefaultBucket, "", &MockFile{Reader: strings.NewReader("hello")}, fileHeader, services.UploadOptions{})
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, repository.ReplicationReplicated, *savedFile.ReplicationStatus)
+	secondaryContents, err := ioutil.ReadFile(filepath.Join(secondaryDir, *savedFile.FilePath))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(secondaryContents))
+	// Reads fall back to the secondary copy once the primary blob is lost
+	err = os.Remove(filepath.Join(primaryDir, *savedFile.FilePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := fileService.OpenFile(context.Background(), savedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	fallbackContents, err := ioutil.ReadAll(contents)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(fallbackContents))
+}
+
+func TestReplicatePendingFiles(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primaryDir := filepath.Join(dir, "uploads")
+	secondaryDir := filepath.Join(dir, "secondary")
+	fileRepo := &mockRepos.FileRepo{}
+	fileService := services.NewFileService(&mockDb.Db{}, fileRepo, storage.NewLocalStorage(), storage.NewLocalMirror(primaryDir, secondaryDir), nil, nil, nil, nil,
+		config.Configuration{UploadDir: primaryDir})
+	pendingPath := filepath.Join(primaryDir, "default", "pending.txt")
+	missingPath := filepath.Join(primaryDir, "default", "missing.txt")
+	err = os.MkdirAll(filepath.Dir(pendingPath), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(pendingPath, []byte("hello"), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingId, missingId := int64(1), int64(2)
+	files := []repository.File{{Id: &pendingId, FilePath: &pendingPath}, {Id: &missingId, FilePath: &missingPath}}
+	fileRepo.On("GetUnreplicatedFiles", mock.Anything, int64(0), mock.AnythingOfType("int")).Return(files, nil).Once()
+	fileRepo.On("UpdateReplicationStatus", mock.Anything, pendingId, repository.ReplicationReplicated).Return(nil).Once()
+	// When
+	err = fileService.ReplicatePendingFiles(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	fileRepo.AssertNotCalled(t, "UpdateReplicationStatus", mock.Anything, missingId, mock.Anything)
+	secondaryContents, err := ioutil.ReadFile(filepath.Join(secondaryDir, "default", "pending.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(secondaryContents))
+}
+
+func TestApplyLifecycleRules(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hotDir := filepath.Join(dir, "uploads")
+	coldDir := filepath.Join(dir, "cold")
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	rules := []config.LifecycleRule{
+		{Bucket: "default", MinAgeDays: 30, ContentTypes: []string{"image/*"}, Action: services.LifecycleExpire},
+		{MinAgeDays: 7, Tags: []string{"export"}, Action: services.LifecycleTransition},
+	}
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, storage.NewLocalMirror(hotDir, coldDir), nil, nil, nil,
+		config.Configuration{UploadDir: hotDir, LifecycleRules: rules})
+	newFile := func(id int64, name string, contentType string, tags string) repository.File {
+		bucket, path, backend := "default", filepath.Join(hotDir, "default", name), repository.BackendHot
+		return repository.File{Id: &id, Bucket: &bucket, FilePath: &path, ContentType: &contentType, Tags: &tags, Backend: &backend}
+	}
+	image, export, other := newFile(1, "image.png", "image/png", ""), newFile(2, "export.csv", "text/csv", "monthly,export"), newFile(3, "other.csv", "text/csv", "")
+	for _, file := range []repository.File{image, export, other} {
+		err = os.MkdirAll(filepath.Dir(*file.FilePath), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(*file.FilePath, []byte("hello"), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileRepo.On("GetFilesOlderThan", mock.Anything, mock.MatchedBy(func(createdBefore time.Time) bool {
+		return createdBefore.Before(time.Now().AddDate(0, 0, -29))
+	}), int64(0), mock.AnythingOfType("int")).Return([]repository.File{image}, nil).Once()
+	fileRepo.On("GetFilesOlderThan", mock.Anything, mock.Anything, int64(0), mock.AnythingOfType("int")).Return([]repository.File{export, other}, nil).Once()
+	fileRepo.On("TxDeleteFileById", mock.Anything, "default", int64(1), mock.Anything).Return(nil).Once()
+	fileRepo.On("TxUpdateBackend", mock.Anything, int64(2), repository.BackendHot, repository.BackendCold, mock.Anything).Return(true, nil).Once()
+	// When
+	err = fileService.ApplyLifecycleRules(context.Background())
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	fileRepo.AssertNotCalled(t, "TxUpdateBackend", mock.Anything, int64(3), mock.Anything, mock.Anything, mock.Anything)
+	_, err = os.Stat(*image.FilePath)
+	assert.True(t, os.IsNotExist(err), "the expired file is deleted")
+	_, err = os.Stat(*export.FilePath)
+	assert.True(t, os.IsNotExist(err), "the hot blob of the transitioned file is deleted")
+	coldContents, err := ioutil.ReadFile(filepath.Join(coldDir, "default", "export.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(coldContents))
+	_, err = os.Stat(*other.FilePath)
+	assert.Nil(t, err)
+	// The transitioned file is read from the cold storage
+	cold := repository.BackendCold
+	export.Backend = &cold
+	contents, err := fileService.OpenFile(context.Background(), export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	readContents, err := ioutil.ReadAll(contents)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(readContents))
+}
+
+func TestApplyLifecycleRulesWithoutColdStorage(t *testing.T) {
+	fileService := services.NewFileService(&mockDb.Db{}, &mockRepos.FileRepo{}, storage.NewLocalStorage(), nil, nil, nil, nil, nil,
+		config.Configuration{UploadDir: uploadDir, LifecycleRules: []config.LifecycleRule{{Action: services.LifecycleTransition}}})
+	err := fileService.ApplyLifecycleRules(context.Background())
+	assert.Equal(t, services.ErrColdStorageDisabled, err)
+}
+
+func TestDeleteFileByIdProtected(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	hold, noHold := true, false
+	tests := []struct {
+		retentionUntil *time.Time
+		legalHold      *bool
+	}{
+		{&future, nil},
+		{nil, &hold},
+		{&past, &hold},
+	}
+	for _, test := range tests {
+		// Given
+		db, fileRepo, fileService := createFileService()
+		fileId, bucket, filePath := int64(1), config.DefaultBucket, uploadDir+"TestDeleteFileByIdProtected.txt"
+		file := repository.File{Id: &fileId, Bucket: &bucket, FilePath: &filePath, RetentionUntilDt: test.retentionUntil, LegalHold: test.legalHold}
+		fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(file, nil).Once()
+		// When
+		err := fileService.DeleteFileById(context.Background(), bucket, fileId)
+		// Then
+		assert.Equal(t, services.ErrFileProtected, err)
+		db.AssertNotCalled(t, "Transact", mock.Anything, mock.Anything)
+	}
+	// A retention that has ended doesn't protect the file
+	db, fileRepo, fileService := createFileService()
+	fileId, bucket, filePath := int64(1), config.DefaultBucket, uploadDir+"TestDeleteFileByIdRetentionEnded.txt"
+	file := repository.File{Id: &fileId, Bucket: &bucket, FilePath: &filePath, RetentionUntilDt: &past, LegalHold: &noHold}
+	fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(file, nil).Once()
+	runTransactions(db)
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, fileId, mock.Anything).Return(nil).Once()
+	fileRepo.On("TxSavePendingDeletion", mock.Anything, filePath, (*string)(nil), mock.Anything).Return(int64(5), nil).Once()
+	fileRepo.On("DeletePendingDeletion", mock.Anything, int64(5)).Return(nil).Once()
+	err := fileService.DeleteFileById(context.Background(), bucket, fileId)
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+}
+
+func TestDeleteFileByIdProtectedConcurrently(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	fileId, bucket, filePath := int64(1), config.DefaultBucket, uploadDir+"TestDeleteFileByIdProtectedConcurrently.txt"
+	fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(repository.File{Id: &fileId, Bucket: &bucket, FilePath: &filePath}, nil).Once()
+	runTransactions(db)
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, fileId, mock.Anything).Return(sql.ErrNoRows).Once()
+	// When
+	err := fileService.DeleteFileById(context.Background(), bucket, fileId)
+	// Then
+	assert.Equal(t, services.ErrFileNotFound, err)
+	fileRepo.AssertNotCalled(t, "TxSavePendingDeletion", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetRetention(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	runTransactions(db)
+	fileId, bucket := int64(4), config.DefaultBucket
+	retentionUntil := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(repository.File{Id: &fileId, Bucket: &bucket}, nil).Once()
+	fileRepo.On("TxUpdateRetention", mock.Anything, fileId, &retentionUntil, true, mock.Anything).Return(true, nil).Once()
+	var entries []repository.AuditLogEntry
+	fileRepo.On("TxSaveAuditLogEntry", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		entries = append(entries, args.Get(1).(repository.AuditLogEntry))
+	}).Return(int64(1), nil).Twice()
+	hold := true
+	// When
+	file, err := fileService.SetRetention(context.Background(), bucket, fileId, services.RetentionUpdate{RetentionUntil: &retentionUntil, LegalHold: &hold}, "admin1")
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	assert.Equal(t, retentionUntil, *file.RetentionUntilDt)
+	assert.True(t, *file.LegalHold)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, repository.AuditSetRetention, *entries[0].Action)
+		assert.Nil(t, entries[0].OldValue)
+		assert.Equal(t, "2030-01-02T15:04:05Z", *entries[0].NewValue)
+		assert.Equal(t, repository.AuditSetLegalHold, *entries[1].Action)
+		assert.Equal(t, "false", *entries[1].OldValue)
+		assert.Equal(t, "true", *entries[1].NewValue)
+		assert.Equal(t, "admin1", *entries[1].Actor)
+		assert.Equal(t, bucket, *entries[1].Bucket)
+	}
+}
+
+func TestGetAuditLogOfDeletedFile(t *testing.T) {
+	_, fileRepo, fileService := createFileService()
+	action := repository.AuditSetRetention
+	fileRepo.On("GetAuditLog", mock.Anything, "images", int64(4)).Return([]repository.AuditLogEntry{{Action: &action}}, nil).Once()
+	entries, err := fileService.GetAuditLog(context.Background(), "images", 4)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	fileRepo.AssertNotCalled(t, "GetFileById", mock.Anything, mock.Anything, mock.Anything)
+	_, err = fileService.GetAuditLog(context.Background(), "unknown", 4)
+	assert.Equal(t, services.ErrBucketNotFound, err)
+}
+
+func TestSetRetentionShortened(t *testing.T) {
+	db, fileRepo, fileService := createFileService()
+	fileId, bucket := int64(4), config.DefaultBucket
+	retentionUntil := time.Now().AddDate(1, 0, 0)
+	fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(repository.File{Id: &fileId, Bucket: &bucket, RetentionUntilDt: &retentionUntil}, nil).Once()
+	earlier := retentionUntil.AddDate(0, -1, 0)
+	_, err := fileService.SetRetention(context.Background(), bucket, fileId, services.RetentionUpdate{RetentionUntil: &earlier}, "admin1")
+	assert.Equal(t, services.ErrRetentionShortened, err)
+	db.AssertNotCalled(t, "Transact", mock.Anything, mock.Anything)
+}
+
+func TestMigrateLayout(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, config.Configuration{UploadDir: dir, ShardDepth: 2})
+	bucket := config.DefaultBucket
+	bucketDir := filepath.Join(dir, bucket)
+	newFile := func(id int64, path string) repository.File {
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte("hello"), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repository.File{Id: &id, Bucket: &bucket, FilePath: &path}
+	}
+	flatPath := filepath.Join(bucketDir, "2018-12-06T05:46:29+09:00_report.pdf")
+	shardedPath := storage.ShardedPath(bucketDir, "2018-12-06T05:46:29+09:00_report.pdf", 2)
+	flat := newFile(1, flatPath)
+	sharded := newFile(2, storage.ShardedPath(bucketDir, "0123456789abcdef", 2))
+	quarantined := newFile(3, filepath.Join(dir, ".quarantine", bucket, "virus.exe"))
+	fileRepo.On("GetFiles", mock.Anything, int64(0), 2).Return([]repository.File{flat, sharded}, nil).Once()
+	fileRepo.On("GetFiles", mock.Anything, int64(2), 2).Return([]repository.File{quarantined}, nil).Once()
+	shardedKey, err := filepath.Rel(dir, shardedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileRepo.On("TxUpdateFilePath", mock.Anything, int64(1), flatPath, filepath.ToSlash(shardedKey), mock.Anything).Return(true, nil).Once()
+	// When
+	report, err := fileService.MigrateLayout(context.Background(), 0, 2)
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	assert.Equal(t, services.MigrationReport{Migrated: 1, LastId: 3}, report)
+	_, err = os.Stat(flatPath)
+	assert.True(t, os.IsNotExist(err))
+	contents, err := ioutil.ReadFile(shardedPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(contents))
+	_, err = os.Stat(*quarantined.FilePath)
+	assert.Nil(t, err)
+}
+
+func TestMigrateLayoutMovesBackWhenUpdateFails(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, fileRepo, _ := createFileService()
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, config.Configuration{UploadDir: dir, ShardDepth: 1})
+	id, bucket := int64(1), config.DefaultBucket
+	flatPath := filepath.Join(dir, bucket, "report.pdf")
+	err = os.MkdirAll(filepath.Dir(flatPath), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(flatPath, []byte("hello"), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitErr := errors.New("commit failed")
+	db.On("Transact", mock.Anything, mock.Anything).Return(func(ctx context.Context, f func(*sql.Tx) error) error {
+		err := f(&sql.Tx{})
+		if err != nil {
+			return err
+		}
+		return commitErr
+	}).Once()
+	fileRepo.On("GetFiles", mock.Anything, int64(0), 100).Return([]repository.File{{Id: &id, Bucket: &bucket, FilePath: &flatPath}}, nil).Once()
+	fileRepo.On("TxUpdateFilePath", mock.Anything, id, flatPath, mock.Anything, mock.Anything).Return(true, nil).Once()
+	// When
+	report, err := fileService.MigrateLayout(context.Background(), 0, 0)
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, []services.MigrationFailure{{FileId: id, Reason: commitErr.Error()}}, report.Failures)
+	_, err = os.Stat(flatPath)
+	assert.Nil(t, err, "the blob is moved back")
+}
+
+func TestMigrateFilePaths(t *testing.T) {
+	// Given
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, nil, nil, nil, config.Configuration{UploadDir: uploadDir})
+	bucket := config.DefaultBucket
+	newFile := func(id int64, path string) repository.File {
+		return repository.File{Id: &id, Bucket: &bucket, FilePath: &path}
+	}
+	oldDir := filepath.Join(os.TempDir(), "old-uploads")
+	absolute := newFile(1, filepath.Join(oldDir, bucket, "ab", "cd", "0123456789abcdef"))
+	relative := newFile(2, "default/12/34/fedcba9876543210")
+	outside := newFile(3, filepath.Join(os.TempDir(), "quarantine", bucket, "virus.exe"))
+	failing := newFile(4, filepath.Join(oldDir, bucket, "report.pdf"))
+	updateErr := errors.New("update failed")
+	fileRepo.On("GetFiles", mock.Anything, int64(0), 100).Return([]repository.File{absolute, relative, outside, failing}, nil).Once()
+	fileRepo.On("TxUpdateFilePath", mock.Anything, int64(1), *absolute.FilePath, "default/ab/cd/0123456789abcdef", mock.Anything).Return(true, nil).Once()
+	fileRepo.On("TxUpdateFilePath", mock.Anything, int64(4), *failing.FilePath, "default/report.pdf", mock.Anything).Return(false, updateErr).Once()
+	// When
+	report, err := fileService.MigrateFilePaths(context.Background(), oldDir, 0, 0)
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	assert.Equal(t, services.MigrationReport{Migrated: 1, LastId: 4, Failures: []services.MigrationFailure{{FileId: 4, Reason: updateErr.Error()}}}, report)
+}
+
+func TestMigrateStorage(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hotDir := filepath.Join(dir, "uploads")
+	remoteDir := filepath.Join(dir, "remote")
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, storage.NewLocalMirror(hotDir, remoteDir), nil, nil,
+		config.Configuration{UploadDir: hotDir})
+	helloChecksum := sha256.Sum256([]byte("hello"))
+	checksum := hex.EncodeToString(helloChecksum[:])
+	newFile := func(id int64, name string, contents string, backend string) repository.File {
+		bucket, key := config.DefaultBucket, "default/"+name
+		path := filepath.Join(hotDir, "default", name)
+		if backend == repository.BackendRemote {
+			path = filepath.Join(remoteDir, "default", name)
+		}
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repository.File{Id: &id, Bucket: &bucket, FilePath: &key, Checksum: &checksum, Backend: &backend}
+	}
+	moved := newFile(1, "moved.txt", "hello", repository.BackendHot)
+	corrupt := newFile(2, "corrupt.txt", "jello", repository.BackendHot)
+	remote := newFile(3, "remote.txt", "hello", repository.BackendRemote)
+	fileRepo.On("GetFiles", mock.Anything, int64(0), 2).Return([]repository.File{moved, corrupt}, nil).Once()
+	fileRepo.On("GetFiles", mock.Anything, int64(2), 2).Return([]repository.File{remote}, nil).Once()
+	fileRepo.On("TxUpdateBackend", mock.Anything, int64(1), repository.BackendHot, repository.BackendRemote, mock.Anything).Return(true, nil).Once()
+	// When
+	report, err := fileService.MigrateStorage(context.Background(), repository.BackendHot, repository.BackendRemote,
+		services.StorageMigrationOptions{BatchSize: 2, Concurrency: 2})
+	// Then
+	assert.Nil(t, err)
+	fileRepo.AssertExpectations(t)
+	assert.Equal(t, services.MigrationReport{Migrated: 1, LastId: 3,
+		Failures: []services.MigrationFailure{{FileId: 2, Reason: "the blob doesn't match the checksum of the file"}}}, report)
+	_, err = os.Stat(filepath.Join(hotDir, "default", "moved.txt"))
+	assert.True(t, os.IsNotExist(err), "the source blob is deleted once the file is switched")
+	remoteContents, err := ioutil.ReadFile(filepath.Join(remoteDir, "default", "moved.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(remoteContents))
+	_, err = os.Stat(filepath.Join(hotDir, "default", "corrupt.txt"))
+	assert.Nil(t, err, "the source blob of a failed file is left untouched")
+	_, err = os.Stat(filepath.Join(remoteDir, "default", "corrupt.txt"))
+	assert.True(t, os.IsNotExist(err), "the copy of a failed file is deleted")
+}
+
+func TestMigrateStorageConcurrently(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hotDir := filepath.Join(dir, "uploads")
+	remoteDir := filepath.Join(dir, "remote")
+	db, fileRepo, _ := createFileService()
+	runTransactions(db)
+	recordPendingDeletions(fileRepo)
+	fileService := services.NewFileService(db, fileRepo, storage.NewLocalStorage(), nil, nil, storage.NewLocalMirror(hotDir, remoteDir), nil, nil,
+		config.Configuration{UploadDir: hotDir})
+	err = os.MkdirAll(filepath.Join(hotDir, "default"), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(hotDir, "default", "moved.txt"), []byte("hello"), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	helloChecksum := sha256.Sum256([]byte("hello"))
+	id, bucket, key, backend, checksum := int64(1), config.DefaultBucket, "default/moved.txt", repository.BackendHot, hex.EncodeToString(helloChecksum[:])
+	file := repository.File{Id: &id, Bucket: &bucket, FilePath: &key, Checksum: &checksum, Backend: &backend}
+	fileRepo.On("GetFiles", mock.Anything, int64(0), 100).Return([]repository.File{file}, nil).Twice()
+	// Both movers have copied the blob before either switches the file, and only one of them can switch it
+	var copied sync.WaitGroup
+	copied.Add(2)
+	var switches int32
+	fileRepo.On("TxUpdateBackend", mock.Anything, int64(1), repository.BackendHot, repository.BackendRemote, mock.Anything).
+		Run(func(mock.Arguments) {
+			copied.Done()
+			copied.Wait()
+		}).
+		Return(func(context.Context, int64, string, string, *sql.Tx) bool {
+			return atomic.AddInt32(&switches, 1) == 1
+		}, nil).Twice()
+	// When
+	reports := make([]services.MigrationReport, 2)
+	var movers sync.WaitGroup
+	for i := range reports {
+		movers.Add(1)
+		go func(i int) {
+			defer movers.Done()
+			reports[i], _ = fileService.MigrateStorage(context.Background(), repository.BackendHot, repository.BackendRemote,
+				services.StorageMigrationOptions{BatchSize: 100, Concurrency: 1})
+		}(i)
+	}
+	movers.Wait()
+	// Then
+	fileRepo.AssertExpectations(t)
+	assert.Equal(t, 1, reports[0].Migrated+reports[1].Migrated)
+	remoteContents, err := ioutil.ReadFile(filepath.Join(remoteDir, "default", "moved.txt"))
+	assert.Nil(t, err, "the losing mover doesn't delete the blob of the winner")
+	assert.Equal(t, "hello", string(remoteContents))
+	entries, err := ioutil.ReadDir(filepath.Join(remoteDir, "default"))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "the copy of the losing mover is deleted")
+}
+
+func TestMigrateStorageToUnavailableBackend(t *testing.T) {
+	_, _, fileService := createFileService()
+	_, err := fileService.MigrateStorage(context.Background(), repository.BackendHot, repository.BackendRemote, services.StorageMigrationOptions{})
+	assert.Equal(t, services.ErrBackendUnavailable, err)
+	_, err = fileService.MigrateStorage(context.Background(), repository.BackendHot, repository.BackendHot, services.StorageMigrationOptions{})
+	assert.Equal(t, services.ErrSameBackend, err)
+}
+
+func TestGetThumbnail(t *testing.T) {
+	// Given
+	db, fileRepo, fileService := createFileService()
+	fileId, bucket, filePath := int64(700), config.DefaultBucket, uploadDir+"TestGetThumbnail.png"
+	contentType, checksum := "image/png", "0123abcd"
+	file := repository.File{Id: &fileId, Bucket: &bucket, FilePath: &filePath, ContentType: &contentType, Checksum: &checksum}
+	original, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(original, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := services.ThumbnailOptions{Width: 100, Height: 100, Fit: "cover"}
+	// When
+	thumbnail, thumbnailType, err := fileService.GetThumbnail(context.Background(), file, options)
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "image/png", thumbnailType)
+	thumbnailConfig, err := png.DecodeConfig(thumbnail)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, thumbnailConfig.Width)
+	assert.Equal(t, 100, thumbnailConfig.Height)
+	// Served from the cache once generated
+	os.Remove(filePath)
+	_, _, err = fileService.GetThumbnail(context.Background(), file, options)
+	assert.Nil(t, err)
+	// And deleted along with the file
+	runTransactions(db)
+	fileRepo.On("GetFileById", mock.Anything, bucket, fileId).Return(file, nil).Once()
+	fileRepo.On("TxDeleteFileById", mock.Anything, bucket, fileId, mock.Anything).Return(nil).Once()
+	recordPendingDeletions(fileRepo)
+	err = fileService.DeleteFileById(context.Background(), bucket, fileId)
+	assert.Nil(t, err)
+	_, _, err = fileService.GetThumbnail(context.Background(), file, options)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetThumbnailCacheIsBounded(t *testing.T) {
+	// Given
+	_, _, fileService := createFileService()
+	fileId, filePath := int64(703), uploadDir+"TestGetThumbnailCacheIsBounded.png"
+	contentType, checksum := "image/png", "89abcdef"
+	file := repository.File{Id: &fileId, FilePath: &filePath, ContentType: &contentType, Checksum: &checksum}
+	original, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(original, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivativesDir := storage.ShardedPath(filepath.Join(uploadDir, ".derivatives"), "703", 2)
+	defer os.RemoveAll(derivativesDir)
+	cachedNames := func() []string {
+		entries, _ := ioutil.ReadDir(derivativesDir)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	// When a size that isn't in ThumbnailSizes is requested
+	_, _, err = fileService.GetThumbnail(context.Background(), file, services.ThumbnailOptions{Width: 100, Height: 99})
+	// Then it's not cached
+	assert.Nil(t, err)
+	assert.Empty(t, cachedNames())
+	// When more thumbnails than MaxDerivativesPerFile are cached
+	for i, options := range []services.ThumbnailOptions{{Width: 50, Height: 50}, {Width: 100, Height: 50}, {Width: 100, Height: 100}} {
+		_, _, err = fileService.GetThumbnail(context.Background(), file, options)
+		assert.Nil(t, err)
+		// Distinct modification times regardless of the resolution of the file system
+		modTime := time.Now().Add(time.Duration(i-10) * time.Second)
+		os.Chtimes(filepath.Join(derivativesDir, fmt.Sprintf("%s-%dx%d-contain.png", checksum, options.Width, options.Height)), modTime, modTime)
+	}
+	// Then the oldest is evicted
+	assert.ElementsMatch(t, []string{checksum + "-100x50-contain.png", checksum + "-100x100-contain.png"}, cachedNames())
+}
+
+func TestGetThumbnailRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		contentType string
+		options     services.ThumbnailOptions
+		err         error
+	}{
+		{"application/pdf", services.ThumbnailOptions{Width: 100, Height: 100}, services.ErrNotAnImage},
+		{"image/jpeg", services.ThumbnailOptions{Width: 0, Height: 100}, services.ErrInvalidThumbnail},
+		{"image/jpeg", services.ThumbnailOptions{Width: 100, Height: 5000}, services.ErrInvalidThumbnail},
+		{"image/jpeg", services.ThumbnailOptions{Width: 100, Height: 100, Fit: "stretch"}, services.ErrInvalidThumbnail},
+	}
+	for _, test := range tests {
+		_, _, fileService := createFileService()
+		fileId, filePath, contentType := int64(701), uploadDir+"TestGetThumbnailRejectsInvalidRequests", test.contentType
+		file := repository.File{Id: &fileId, FilePath: &filePath, ContentType: &contentType}
+		_, _, err := fileService.GetThumbnail(context.Background(), file, test.options)
+		assert.Equal(t, test.err, err, test.contentType)
+	}
+}
+
+func TestGetThumbnailOfTooLargeImage(t *testing.T) {
+	appConfig := config.Configuration{UploadDir: uploadDir, MaxImagePixels: 1000}
+	fileService := services.NewFileService(&mockDb.Db{}, &mockRepos.FileRepo{}, storage.NewLocalStorage(), nil, nil, nil, nil, nil, appConfig)
+	fileId, filePath, contentType := int64(702), uploadDir+"TestGetThumbnailOfTooLargeImage.png", "image/png"
+	file := repository.File{Id: &fileId, FilePath: &filePath, ContentType: &contentType}
+	original, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(original, image.NewGray(image.Rect(0, 0, 100, 100)))
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = fileService.GetThumbnail(context.Background(), file, services.ThumbnailOptions{Width: 10, Height: 10})
+	assert.Equal(t, services.ErrImageTooLarge, err)
+}
+
+func TestTransformImage(t *testing.T) {
+	// Given
+	_, _, fileService := createFileService()
+	fileId, filePath := int64(710), uploadDir+"TestTransformImage.png"
+	contentType, checksum := "image/png", "4567cdef"
+	file := repository.File{Id: &fileId, FilePath: &filePath, ContentType: &contentType, Checksum: &checksum}
+	original, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(original, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crop := image.Rect(100, 50, 300, 100)
+	transformation := services.ImageTransformation{AutoOrient: true, Crop: &crop, Format: "jpeg", Quality: 70}
+	// When
+	transformed, transformedType, err := fileService.TransformImage(context.Background(), file, transformation)
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "image/jpeg", transformedType)
+	transformedConfig, err := jpeg.DecodeConfig(transformed)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, transformedConfig.Width)
+	assert.Equal(t, 50, transformedConfig.Height)
+	// Served from the cache once transformed, unless cropped
+	_, _, err = fileService.TransformImage(context.Background(), file, services.ImageTransformation{Format: "jpeg", Quality: 70})
+	assert.Nil(t, err)
+	os.Remove(filePath)
+	_, _, err = fileService.TransformImage(context.Background(), file, services.ImageTransformation{Format: "jpeg", Quality: 70})
+	assert.Nil(t, err)
+	_, _, err = fileService.TransformImage(context.Background(), file, transformation)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTransformImageRejectsInvalidTransformations(t *testing.T) {
+	outside, empty := image.Rect(500, 0, 600, 100), image.Rect(10, 10, 10, 20)
+	tests := []struct {
+		transformation services.ImageTransformation
+		err            error
+	}{
+		{services.ImageTransformation{Format: "webp"}, services.ErrInvalidTransformation},
+		{services.ImageTransformation{Quality: 70}, services.ErrInvalidTransformation}, // Of a png
+		{services.ImageTransformation{Format: "jpeg", Quality: 101}, services.ErrInvalidTransformation},
+		{services.ImageTransformation{Crop: &empty}, services.ErrInvalidTransformation},
+		{services.ImageTransformation{Crop: &outside}, services.ErrInvalidTransformation},
+		{services.ImageTransformation{Format: "jpeg"}, services.ErrImageTooLarge},
+	}
+	appConfig := config.Configuration{UploadDir: uploadDir, MaxOutputImagePixels: 1000}
+	fileService := services.NewFileService(&mockDb.Db{}, &mockRepos.FileRepo{}, storage.NewLocalStorage(), nil, nil, nil, nil, nil, appConfig)
+	fileId, filePath, contentType := int64(711), uploadDir+"TestTransformImageRejectsInvalidTransformations.png", "image/png"
+	file := repository.File{Id: &fileId, FilePath: &filePath, ContentType: &contentType}
+	original, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(original, image.NewGray(image.Rect(0, 0, 100, 100)))
+	original.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range tests {
+		_, _, err := fileService.TransformImage(context.Background(), file, test.transformation)
+		assert.Equal(t, test.err, err, i)
+	}
 }
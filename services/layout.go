@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"gocleancode/storage"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MigrationReport summarizes a run of MigrateLayout or MigrateFilePaths.
+type MigrationReport struct {
+	Migrated int
+	LastId   int64 // Id of the last processed file. Pass it as afterId to resume an interrupted migration.
+	Failures []MigrationFailure
+}
+
+type MigrationFailure struct {
+	FileId int64
+	Reason string
+}
+
+// MigrateLayout moves the blobs that are not at their sharded path, eg those stored flat in the bucket dir before the
+// sharding or under another ShardDepth, and updates their path in the files table. Blobs outside of their bucket dir,
+// eg quarantined ones, are left alone. Files that fail are reported and skipped, so the migration can be run again.
+func (f fileService) MigrateLayout(ctx context.Context, afterId int64, batchSize int) (MigrationReport, error) {
+	report := MigrationReport{LastId: afterId}
+	if batchSize <= 0 {
+		batchSize = purgeBatchSize
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		files, err := f.repo.GetFiles(ctx, report.LastId, batchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			moved, err := f.migrateFileLayout(ctx, file)
+			if err != nil {
+				log.Error(fmt.Sprintf("Failed to move file %d to its sharded path. Reason: %v", *file.Id, err))
+				report.Failures = append(report.Failures, MigrationFailure{*file.Id, err.Error()})
+			} else if moved {
+				report.Migrated++
+			}
+			report.LastId = *file.Id
+		}
+		log.Info(fmt.Sprintf("Moved %d files to their sharded path, up to file %d", report.Migrated, report.LastId))
+		if len(files) < batchSize {
+			return report, nil
+		}
+	}
+}
+
+// migrateFileLayout moves the blob of the file to its sharded path. It returns false if the blob is already there or
+// is outside of its bucket dir.
+func (f fileService) migrateFileLayout(ctx context.Context, file repository.File) (bool, error) {
+	bucketConfig, ok := f.config.Bucket(*file.Bucket)
+	if !ok {
+		return false, ErrBucketNotFound
+	}
+	fromPath := f.blobPath(*file.FilePath)
+	bucketDir := filepath.Join(f.fileDir, bucketConfig.StoragePrefix)
+	relativePath, err := filepath.Rel(bucketDir, fromPath)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return false, nil
+	}
+	toPath := storage.ShardedPath(bucketDir, filepath.Base(fromPath), f.config.ShardDepth)
+	if toPath == fromPath {
+		return false, nil
+	}
+	backendStorage, err := f.backendStorage(file)
+	if err != nil {
+		return false, err
+	}
+	// A blob already at toPath was moved by a run interrupted before its commit, only the row is left to update
+	blobMoved, err := backendStorage.Exists(ctx, toPath)
+	if err != nil {
+		return false, err
+	}
+	if !blobMoved {
+		exists, err := backendStorage.Exists(ctx, fromPath)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, &os.PathError{Op: "move", Path: fromPath, Err: os.ErrNotExist}
+		}
+	}
+	var updated bool
+	moved, err := f.transactMove(ctx, backendStorage, fromPath, toPath, func(tx *sql.Tx) (bool, error) {
+		var err error
+		updated, err = f.repo.TxUpdateFilePath(ctx, *file.Id, *file.FilePath, f.blobKey(toPath), tx)
+		return updated && !blobMoved, err
+	})
+	if err != nil {
+		if moved {
+			if moveErr := backendStorage.Move(context.Background(), toPath, fromPath); moveErr != nil {
+				log.Error(fmt.Sprintf("Failed to move file %s back to %s. Reason: %v", toPath, fromPath, moveErr))
+			}
+		}
+		return false, err
+	}
+	if !updated {
+		return false, nil // Deleted or moved concurrently
+	}
+	f.moveSecondaryCopy(ctx, fromPath, toPath)
+	return true, nil
+}
+
+// MigrateFilePaths replaces the absolute paths stored in the files table, before the paths were relative to the upload
+// dir, by their key. fromDir is the upload dir the paths were built from, the current one if empty. The blobs are not
+// moved: if the upload dir changed, move them to the current one before or after. Paths outside of fromDir are left
+// alone.
+func (f fileService) MigrateFilePaths(ctx context.Context, fromDir string, afterId int64, batchSize int) (MigrationReport, error) {
+	report := MigrationReport{LastId: afterId}
+	if batchSize <= 0 {
+		batchSize = purgeBatchSize
+	}
+	oldService := f
+	if fromDir != "" {
+		oldService.fileDir = absPath(fromDir)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		files, err := f.repo.GetFiles(ctx, report.LastId, batchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			report.LastId = *file.Id
+			fromPath := *file.FilePath
+			key := oldService.blobKey(fromPath)
+			if !filepath.IsAbs(fromPath) || filepath.IsAbs(key) {
+				continue
+			}
+			var updated bool
+			err = f.db.Transact(ctx, func(tx *sql.Tx) error {
+				var err error
+				updated, err = f.repo.TxUpdateFilePath(ctx, *file.Id, fromPath, key, tx)
+				return err
+			})
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return report, ctxErr
+				}
+				log.Error(fmt.Sprintf("Failed to migrate the path of file %d. Reason: %v", *file.Id, err))
+				report.Failures = append(report.Failures, MigrationFailure{*file.Id, err.Error()})
+			} else if updated {
+				report.Migrated++
+			}
+		}
+		log.Info(fmt.Sprintf("Migrated the path of %d files, up to file %d", report.Migrated, report.LastId))
+		if len(files) < batchSize {
+			return report, nil
+		}
+	}
+}
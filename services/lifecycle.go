@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/config"
+	"gocleancode/repository"
+	"strings"
+	"time"
+)
+
+// Actions of the lifecycle rules.
+const (
+	LifecycleTransition = "transition" // Moved to the cold storage
+	LifecycleExpire     = "expire"     // Deleted
+)
+
+var (
+	ErrUnknownLifecycleAction = errors.New("unknown lifecycle action")
+	ErrColdStorageDisabled    = errors.New("a lifecycle rule transitions files but no cold storage is configured")
+)
+
+// lifecycleMetrics counts the transitioned and expired files, the protected files that were not expired and the files
+// that failed. Published by expvar as "lifecycle".
+var lifecycleMetrics = expvar.NewMap("lifecycle")
+
+// ApplyLifecycleRules transitions to the cold storage, or expires, the files matching the configured rules. The rules
+// are applied in order. Files that fail are logged and retried on the next run.
+func (f fileService) ApplyLifecycleRules(ctx context.Context) error {
+	for _, rule := range f.config.LifecycleRules {
+		if rule.Action != LifecycleTransition && rule.Action != LifecycleExpire {
+			return ErrUnknownLifecycleAction
+		}
+		if rule.Action == LifecycleTransition && f.cold == nil {
+			return ErrColdStorageDisabled
+		}
+	}
+	for _, rule := range f.config.LifecycleRules {
+		err := f.applyLifecycleRule(ctx, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f fileService) applyLifecycleRule(ctx context.Context, rule config.LifecycleRule) error {
+	createdBefore := time.Now().AddDate(0, 0, -rule.MinAgeDays)
+	afterId := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		files, err := f.repo.GetFilesOlderThan(ctx, createdBefore, afterId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			afterId = *file.Id
+			if !matchesLifecycleRule(rule, file) {
+				continue
+			}
+			if rule.Action == LifecycleExpire {
+				err = f.deleteFile(ctx, file)
+			} else if file.Backend == nil || *file.Backend != repository.BackendCold {
+				err = f.transitionFile(ctx, file)
+			} else {
+				continue
+			}
+			if err == ErrFileProtected {
+				lifecycleMetrics.Add("protected", 1) // Expired once its retention ends and its legal hold is lifted
+				continue
+			}
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				lifecycleMetrics.Add("errors", 1)
+				log.Error(fmt.Sprintf("Failed to %s file %d. Reason: %v", rule.Action, *file.Id, err))
+				continue
+			}
+			if rule.Action == LifecycleExpire {
+				lifecycleMetrics.Add("expired", 1)
+			} else {
+				lifecycleMetrics.Add("transitioned", 1)
+			}
+		}
+		if len(files) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+func matchesLifecycleRule(rule config.LifecycleRule, file repository.File) bool {
+	if rule.Bucket != "" && (file.Bucket == nil || *file.Bucket != rule.Bucket) {
+		return false
+	}
+	if len(rule.ContentTypes) > 0 && (file.ContentType == nil || !matchesContentType(*file.ContentType, rule.ContentTypes)) {
+		return false
+	}
+	if len(rule.Tags) == 0 {
+		return true
+	}
+	if file.Tags == nil {
+		return false
+	}
+	for _, tag := range strings.Split(*file.Tags, ",") {
+		if containsIgnoreCase(rule.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionFile moves the blob of the file to the cold storage. See moveToBackend.
+func (f fileService) transitionFile(ctx context.Context, file repository.File) error {
+	moved, err := f.moveToBackend(ctx, file, repository.BackendCold, false)
+	if moved {
+		log.Info(fmt.Sprintf("Transitioned file %d to the cold storage", *file.Id))
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"gocleancode/storage"
+	"io"
+	"sync"
+)
+
+var (
+	ErrSameBackend      = errors.New("the source and target backends are the same")
+	errChecksumMismatch = errors.New("the blob doesn't match the checksum of the file")
+	errCopyMismatch     = errors.New("the copy doesn't match the source blob")
+)
+
+// StorageMigrationOptions tune MigrateStorage.
+type StorageMigrationOptions struct {
+	AfterId     int64 // Only the files with a greater id are moved. Pass the LastId of a report to resume.
+	BatchSize   int   // Files fetched per query. Defaults to 100
+	Concurrency int   // Files copied at once. Defaults to 4
+	KeepSource  bool  // Leaves the source blobs in place once the files are switched
+}
+
+// MigrateStorage moves the blobs of the files on fromBackend to toBackend, eg from the upload dir to the remote S3
+// bucket. Each blob is copied and verified before its file is switched to toBackend, so the files stay readable
+// throughout and the source blob is only deleted once the switch has committed. Files that fail are reported and left on
+// fromBackend, so the migration can be run again. Batches are completed before moving on, so LastId is always safe to
+// resume from.
+func (f fileService) MigrateStorage(ctx context.Context, fromBackend string, toBackend string, options StorageMigrationOptions) (MigrationReport, error) {
+	report := MigrationReport{LastId: options.AfterId}
+	if fromBackend == toBackend {
+		return report, ErrSameBackend
+	}
+	for _, backend := range []string{fromBackend, toBackend} {
+		if _, err := f.storageOf(backend); err != nil {
+			return report, err
+		}
+	}
+	batchSize, concurrency := options.BatchSize, options.Concurrency
+	if batchSize <= 0 {
+		batchSize = purgeBatchSize
+	}
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	var mutex sync.Mutex // Guards the report
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		files, err := f.repo.GetFiles(ctx, report.LastId, batchSize)
+		if err != nil {
+			return report, err
+		}
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, concurrency)
+		for _, file := range files {
+			if (file.Backend == nil && fromBackend != repository.BackendHot) || (file.Backend != nil && *file.Backend != fromBackend) {
+				continue
+			}
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(file repository.File) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				moved, err := f.moveToBackend(ctx, file, toBackend, options.KeepSource)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err != nil {
+					log.Error(fmt.Sprintf("Failed to move file %d to the %s storage. Reason: %v", *file.Id, toBackend, err))
+					report.Failures = append(report.Failures, MigrationFailure{*file.Id, err.Error()})
+				} else if moved {
+					report.Migrated++
+				}
+			}(file)
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return report, err // The batch may be incomplete, LastId is left at the previous one
+		}
+		if len(files) > 0 {
+			report.LastId = *files[len(files)-1].Id
+		}
+		log.Info(fmt.Sprintf("Moved %d files to the %s storage, up to file %d", report.Migrated, toBackend, report.LastId))
+		if len(files) < batchSize {
+			return report, nil
+		}
+	}
+}
+
+// moveToBackend copies the blob of the file to the toBackend storage, verifies the copy, switches the file to
+// toBackend, then deletes the source blob unless keepSource. The copy is staged under a unique path and renamed by the
+// transaction switching the file, so a concurrent mover of the same file only ever deletes its own copy. Like an
+// upload, the blob that may be left behind at each step is recorded as a pending deletion first: the staged copy until
+// the switch commits, the source blob afterwards. It returns false if the file was deleted or moved concurrently.
+func (f fileService) moveToBackend(ctx context.Context, file repository.File, toBackend string, keepSource bool) (bool, error) {
+	fromBackend := repository.BackendHot
+	if file.Backend != nil {
+		fromBackend = *file.Backend
+	}
+	source, err := f.storageOf(fromBackend)
+	if err != nil {
+		return false, err
+	}
+	target, err := f.storageOf(toBackend)
+	if err != nil {
+		return false, err
+	}
+	name, err := storage.NewBlobName()
+	if err != nil {
+		return false, err
+	}
+	filePath := f.blobPath(*file.FilePath)
+	stagedPath := filePath + "." + name + stagedSuffix
+	var stagedPendingId int64
+	err = f.db.Transact(ctx, func(tx *sql.Tx) error {
+		var err error
+		stagedPendingId, err = f.repo.TxSavePendingDeletion(ctx, f.blobKey(stagedPath), &toBackend, tx)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	err = copyBlob(ctx, source, target, filePath, stagedPath, file.Checksum)
+	var switched bool
+	var sourcePendingId int64
+	if err == nil {
+		_, err = f.transactMove(ctx, target, stagedPath, filePath, func(tx *sql.Tx) (bool, error) {
+			var err error
+			switched, err = f.repo.TxUpdateBackend(ctx, *file.Id, fromBackend, toBackend, tx)
+			if err != nil || !switched {
+				return false, err // Deleted or moved concurrently, the copy is not needed
+			}
+			err = f.repo.TxDeletePendingDeletion(ctx, stagedPendingId, tx)
+			if err != nil {
+				return false, err
+			}
+			if !keepSource {
+				sourcePendingId, err = f.repo.TxSavePendingDeletion(ctx, *file.FilePath, &fromBackend, tx)
+				if err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		})
+	}
+	if err != nil || !switched {
+		// Only the staged copy, the blob at the final path may belong to a concurrent mover
+		f.deleteBlob(context.Background(), stagedPendingId, stagedPath, &toBackend)
+		return false, err
+	}
+	if !keepSource {
+		f.deleteBlob(ctx, sourcePendingId, filePath, &fromBackend)
+	}
+	return true, nil
+}
+
+// copyBlob copies the blob at the source path of the source storage to the target path of the target storage, then
+// reads the copy back to verify it. A source blob that doesn't match the checksum of the file is not copied, the
+// scrubber will restore it.
+func copyBlob(ctx context.Context, source storage.Storage, target storage.Storage, sourcePath string, targetPath string, checksum *string) error {
+	contents, err := source.Open(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	hash := sha256.New()
+	err = target.Put(ctx, targetPath, io.TeeReader(contents, hash))
+	if err != nil {
+		return err
+	}
+	sourceChecksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != nil && sourceChecksum != *checksum {
+		return errChecksumMismatch
+	}
+	copyChecksum, err := blobChecksum(ctx, nil, target, targetPath)
+	if err != nil {
+		return err
+	}
+	if copyChecksum != sourceChecksum {
+		return errCopyMismatch
+	}
+	return nil
+}
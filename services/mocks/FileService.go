@@ -2,22 +2,25 @@
 
 package mocks
 
+import context "context"
 import mock "github.com/stretchr/testify/mock"
+import io "io"
 import multipart "mime/multipart"
 import repository "gocleancode/repository"
+import services "gocleancode/services"
 
 // FileService is an autogenerated mock type for the FileService type
 type FileService struct {
 	mock.Mock
 }
 
-// DeleteFileById provides a mock function with given fields: fileId
-func (_m *FileService) DeleteFileById(fileId int64) error {
-	ret := _m.Called(fileId)
+// ApplyLifecycleRules provides a mock function with given fields: ctx
+func (_m *FileService) ApplyLifecycleRules(ctx context.Context) error {
+	ret := _m.Called(ctx)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(int64) error); ok {
-		r0 = rf(fileId)
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -25,20 +28,266 @@ func (_m *FileService) DeleteFileById(fileId int64) error {
 	return r0
 }
 
-// GetFileById provides a mock function with given fields: id
-func (_m *FileService) GetFileById(id int64) (repository.File, error) {
-	ret := _m.Called(id)
+// DeleteFileById provides a mock function with given fields: ctx, bucket, fileId
+func (_m *FileService) DeleteFileById(ctx context.Context, bucket string, fileId int64) error {
+	ret := _m.Called(ctx, bucket, fileId)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) error); ok {
+		r0 = rf(ctx, bucket, fileId)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetAuditLog provides a mock function with given fields: ctx, bucket, id
+func (_m *FileService) GetAuditLog(ctx context.Context, bucket string, id int64) ([]repository.AuditLogEntry, error) {
+	ret := _m.Called(ctx, bucket, id)
+
+	var r0 []repository.AuditLogEntry
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) []repository.AuditLogEntry); ok {
+		r0 = rf(ctx, bucket, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]repository.AuditLogEntry)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, bucket, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetFileById provides a mock function with given fields: ctx, bucket, id
+func (_m *FileService) GetFileById(ctx context.Context, bucket string, id int64) (repository.File, error) {
+	ret := _m.Called(ctx, bucket, id)
 
 	var r0 repository.File
-	if rf, ok := ret.Get(0).(func(int64) repository.File); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64) repository.File); ok {
+		r0 = rf(ctx, bucket, id)
 	} else {
 		r0 = ret.Get(0).(repository.File)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(int64) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64) error); ok {
+		r1 = rf(ctx, bucket, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetThumbnail provides a mock function with given fields: ctx, file, options
+func (_m *FileService) GetThumbnail(ctx context.Context, file repository.File, options services.ThumbnailOptions) (io.ReadSeekCloser, string, error) {
+	ret := _m.Called(ctx, file, options)
+
+	var r0 io.ReadSeekCloser
+	if rf, ok := ret.Get(0).(func(context.Context, repository.File, services.ThumbnailOptions) io.ReadSeekCloser); ok {
+		r0 = rf(ctx, file, options)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadSeekCloser)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, repository.File, services.ThumbnailOptions) string); ok {
+		r1 = rf(ctx, file, options)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, repository.File, services.ThumbnailOptions) error); ok {
+		r2 = rf(ctx, file, options)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// GetUsage provides a mock function with given fields: ctx, bucket, owner
+func (_m *FileService) GetUsage(ctx context.Context, bucket string, owner string) (services.UsageReport, error) {
+	ret := _m.Called(ctx, bucket, owner)
+
+	var r0 services.UsageReport
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) services.UsageReport); ok {
+		r0 = rf(ctx, bucket, owner)
+	} else {
+		r0 = ret.Get(0).(services.UsageReport)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, bucket, owner)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MigrateFilePaths provides a mock function with given fields: ctx, fromDir, afterId, batchSize
+func (_m *FileService) MigrateFilePaths(ctx context.Context, fromDir string, afterId int64, batchSize int) (services.MigrationReport, error) {
+	ret := _m.Called(ctx, fromDir, afterId, batchSize)
+
+	var r0 services.MigrationReport
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64, int) services.MigrationReport); ok {
+		r0 = rf(ctx, fromDir, afterId, batchSize)
+	} else {
+		r0 = ret.Get(0).(services.MigrationReport)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64, int) error); ok {
+		r1 = rf(ctx, fromDir, afterId, batchSize)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MigrateLayout provides a mock function with given fields: ctx, afterId, batchSize
+func (_m *FileService) MigrateLayout(ctx context.Context, afterId int64, batchSize int) (services.MigrationReport, error) {
+	ret := _m.Called(ctx, afterId, batchSize)
+
+	var r0 services.MigrationReport
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int) services.MigrationReport); ok {
+		r0 = rf(ctx, afterId, batchSize)
+	} else {
+		r0 = ret.Get(0).(services.MigrationReport)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int) error); ok {
+		r1 = rf(ctx, afterId, batchSize)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MigrateStorage provides a mock function with given fields: ctx, fromBackend, toBackend, options
+func (_m *FileService) MigrateStorage(ctx context.Context, fromBackend string, toBackend string, options services.StorageMigrationOptions) (services.MigrationReport, error) {
+	ret := _m.Called(ctx, fromBackend, toBackend, options)
+
+	var r0 services.MigrationReport
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, services.StorageMigrationOptions) services.MigrationReport); ok {
+		r0 = rf(ctx, fromBackend, toBackend, options)
+	} else {
+		r0 = ret.Get(0).(services.MigrationReport)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, services.StorageMigrationOptions) error); ok {
+		r1 = rf(ctx, fromBackend, toBackend, options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OpenEncodedFile provides a mock function with given fields: ctx, file
+func (_m *FileService) OpenEncodedFile(ctx context.Context, file repository.File) (io.ReadSeekCloser, error) {
+	ret := _m.Called(ctx, file)
+
+	var r0 io.ReadSeekCloser
+	if rf, ok := ret.Get(0).(func(context.Context, repository.File) io.ReadSeekCloser); ok {
+		r0 = rf(ctx, file)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadSeekCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, repository.File) error); ok {
+		r1 = rf(ctx, file)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// OpenFile provides a mock function with given fields: ctx, file
+func (_m *FileService) OpenFile(ctx context.Context, file repository.File) (io.ReadSeekCloser, error) {
+	ret := _m.Called(ctx, file)
+
+	var r0 io.ReadSeekCloser
+	if rf, ok := ret.Get(0).(func(context.Context, repository.File) io.ReadSeekCloser); ok {
+		r0 = rf(ctx, file)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadSeekCloser)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, repository.File) error); ok {
+		r1 = rf(ctx, file)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PurgeExpiredFiles provides a mock function with given fields: ctx
+func (_m *FileService) PurgeExpiredFiles(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// PurgePendingDeletions provides a mock function with given fields: ctx
+func (_m *FileService) PurgePendingDeletions(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Reconcile provides a mock function with given fields: ctx, orphanAction, dryRun
+func (_m *FileService) Reconcile(ctx context.Context, orphanAction string, dryRun bool) (services.ReconcileReport, error) {
+	ret := _m.Called(ctx, orphanAction, dryRun)
+
+	var r0 services.ReconcileReport
+	if rf, ok := ret.Get(0).(func(context.Context, string, bool) services.ReconcileReport); ok {
+		r0 = rf(ctx, orphanAction, dryRun)
+	} else {
+		r0 = ret.Get(0).(services.ReconcileReport)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, bool) error); ok {
+		r1 = rf(ctx, orphanAction, dryRun)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -46,23 +295,158 @@ func (_m *FileService) GetFileById(id int64) (repository.File, error) {
 	return r0, r1
 }
 
-// SaveFile provides a mock function with given fields: file, handle
-func (_m *FileService) SaveFile(file multipart.File, handle *multipart.FileHeader) (int64, error) {
-	ret := _m.Called(file, handle)
+// RemainingQuota provides a mock function with given fields: ctx, bucket, owner
+func (_m *FileService) RemainingQuota(ctx context.Context, bucket string, owner string) (int64, error) {
+	ret := _m.Called(ctx, bucket, owner)
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func(multipart.File, *multipart.FileHeader) int64); ok {
-		r0 = rf(file, handle)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) int64); ok {
+		r0 = rf(ctx, bucket, owner)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(multipart.File, *multipart.FileHeader) error); ok {
-		r1 = rf(file, handle)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, bucket, owner)
 	} else {
 		r1 = ret.Error(1)
 	}
 
 	return r0, r1
 }
+
+// ReplicatePendingFiles provides a mock function with given fields: ctx
+func (_m *FileService) ReplicatePendingFiles(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RewrapDataKeys provides a mock function with given fields: ctx, afterId, batchSize
+func (_m *FileService) RewrapDataKeys(ctx context.Context, afterId int64, batchSize int) (services.KeyRotationReport, error) {
+	ret := _m.Called(ctx, afterId, batchSize)
+
+	var r0 services.KeyRotationReport
+	if rf, ok := ret.Get(0).(func(context.Context, int64, int) services.KeyRotationReport); ok {
+		r0 = rf(ctx, afterId, batchSize)
+	} else {
+		r0 = ret.Get(0).(services.KeyRotationReport)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int64, int) error); ok {
+		r1 = rf(ctx, afterId, batchSize)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SaveFile provides a mock function with given fields: ctx, bucket, owner, file, handle, options
+func (_m *FileService) SaveFile(ctx context.Context, bucket string, owner string, file multipart.File, handle *multipart.FileHeader, options services.UploadOptions) (int64, error) {
+	ret := _m.Called(ctx, bucket, owner, file, handle, options)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, multipart.File, *multipart.FileHeader, services.UploadOptions) int64); ok {
+		r0 = rf(ctx, bucket, owner, file, handle, options)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, multipart.File, *multipart.FileHeader, services.UploadOptions) error); ok {
+		r1 = rf(ctx, bucket, owner, file, handle, options)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ScanPendingFiles provides a mock function with given fields: ctx
+func (_m *FileService) ScanPendingFiles(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ScrubFiles provides a mock function with given fields: ctx
+func (_m *FileService) ScrubFiles(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetRetention provides a mock function with given fields: ctx, bucket, id, update, actor
+func (_m *FileService) SetRetention(ctx context.Context, bucket string, id int64, update services.RetentionUpdate, actor string) (repository.File, error) {
+	ret := _m.Called(ctx, bucket, id, update, actor)
+
+	var r0 repository.File
+	if rf, ok := ret.Get(0).(func(context.Context, string, int64, services.RetentionUpdate, string) repository.File); ok {
+		r0 = rf(ctx, bucket, id, update, actor)
+	} else {
+		r0 = ret.Get(0).(repository.File)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, int64, services.RetentionUpdate, string) error); ok {
+		r1 = rf(ctx, bucket, id, update, actor)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TransformImage provides a mock function with given fields: ctx, file, transformation
+func (_m *FileService) TransformImage(ctx context.Context, file repository.File, transformation services.ImageTransformation) (io.ReadSeekCloser, string, error) {
+	ret := _m.Called(ctx, file, transformation)
+
+	var r0 io.ReadSeekCloser
+	if rf, ok := ret.Get(0).(func(context.Context, repository.File, services.ImageTransformation) io.ReadSeekCloser); ok {
+		r0 = rf(ctx, file, transformation)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadSeekCloser)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(context.Context, repository.File, services.ImageTransformation) string); ok {
+		r1 = rf(ctx, file, transformation)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, repository.File, services.ImageTransformation) error); ok {
+		r2 = rf(ctx, file, transformation)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What Reconcile does with the orphans, the blobs that no file references.
+const (
+	OrphanReport     = "report"
+	OrphanQuarantine = "quarantine" // Moved to the orphans dir under the quarantine dir
+	OrphanDelete     = "delete"
+)
+
+var ErrUnknownOrphanAction = errors.New("unknown orphan action")
+
+// ReconcileReport lists the differences between the files table and the upload dir.
+type ReconcileReport struct {
+	MissingBlobs []MissingBlob // Files whose blob doesn't exist
+	Orphans      []string      // Paths of the blobs that no file references
+	Failures     []OrphanFailure
+}
+
+type MissingBlob struct {
+	FileId   int64
+	FilePath string
+}
+
+// OrphanFailure is an orphan that couldn't be deleted or quarantined.
+type OrphanFailure struct {
+	Path   string
+	Reason string
+}
+
+// Reconcile finds the files whose blob is missing and the blobs in the upload dir that no file references, then
+// applies orphanAction to the orphans. Missing blobs are only reported. With dryRun, nothing is changed and the report
+// lists what would have been done. Blobs modified within pendingDeletionGrace are skipped, since they may belong to
+// uploads in progress. An orphan that can't be handled is added to the failures of the report and the next ones are
+// still handled.
+func (f fileService) Reconcile(ctx context.Context, orphanAction string, dryRun bool) (ReconcileReport, error) {
+	report := ReconcileReport{}
+	if orphanAction != OrphanReport && orphanAction != OrphanQuarantine && orphanAction != OrphanDelete {
+		return report, ErrUnknownOrphanAction
+	}
+	err := f.findMissingBlobs(ctx, &report)
+	if err != nil {
+		return report, err
+	}
+	err = f.findOrphans(ctx, &report)
+	if err != nil {
+		return report, err
+	}
+	log.Info(fmt.Sprintf("Reconciled the upload dir. %d missing blobs and %d orphans", len(report.MissingBlobs), len(report.Orphans)))
+	if orphanAction == OrphanReport {
+		return report, nil
+	}
+	for _, orphan := range report.Orphans {
+		if dryRun {
+			log.Info(fmt.Sprintf("Would %s orphan %s", orphanAction, orphan))
+			continue
+		}
+		if orphanAction == OrphanDelete {
+			err = f.storage.Delete(ctx, orphan)
+		} else {
+			err = f.storage.Move(ctx, orphan, f.orphanQuarantinePath(orphan))
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return report, ctxErr
+			}
+			log.Error(fmt.Sprintf("Failed to %s orphan %s. Reason: %v", orphanAction, orphan, err))
+			report.Failures = append(report.Failures, OrphanFailure{orphan, err.Error()})
+		}
+	}
+	if len(report.Failures) > 0 {
+		return report, fmt.Errorf("failed to %s %d orphans", orphanAction, len(report.Failures))
+	}
+	return report, nil
+}
+
+func (f fileService) findMissingBlobs(ctx context.Context, report *ReconcileReport) error {
+	afterId := int64(0)
+	for {
+		files, err := f.repo.GetFiles(ctx, afterId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			backendStorage, err := f.backendStorage(file)
+			if err != nil {
+				return err
+			}
+			filePath := f.blobPath(*file.FilePath)
+			exists, err := backendStorage.Exists(ctx, filePath)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				report.MissingBlobs = append(report.MissingBlobs, MissingBlob{*file.Id, filePath})
+			}
+			afterId = *file.Id
+		}
+		if len(files) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+func (f fileService) findOrphans(ctx context.Context, report *ReconcileReport) error {
+	modifiedBefore := time.Now().Add(-pendingDeletionGrace)
+	var candidates []string
+	// Looks up the candidates in batches, the ones that are not referenced are orphans
+	flush := func() error {
+		// Rows not migrated by MigrateFilePaths still reference the absolute paths
+		keys := make([]string, 0, 2*len(candidates))
+		for _, candidate := range candidates {
+			keys = append(keys, f.blobKey(candidate), candidate)
+		}
+		referencedKeys, err := f.repo.GetReferencedFilePaths(ctx, keys)
+		if err != nil {
+			return err
+		}
+		referenced := make(map[string]bool, len(referencedKeys))
+		for _, referencedKey := range referencedKeys {
+			referenced[referencedKey] = true
+		}
+		for _, candidate := range candidates {
+			if !referenced[f.blobKey(candidate)] && !referenced[candidate] {
+				report.Orphans = append(report.Orphans, candidate)
+			}
+		}
+		candidates = candidates[:0]
+		return nil
+	}
+	err := f.storage.Walk(ctx, filepath.Clean(f.fileDir), func(path string, modTime time.Time) error {
+		if !modTime.Before(modifiedBefore) || f.isReservedPath(path) {
+			return nil
+		}
+		candidates = append(candidates, path)
+		if len(candidates) < purgeBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// isReservedPath reports whether the path under the upload dir is not a blob of a file: staged uploads, the
+// quarantine dir, the cached derivatives and the files of an embedded db.
+func (f fileService) isReservedPath(path string) bool {
+	if strings.HasSuffix(path, stagedSuffix) || isUnder(path, f.quarantineDir) || isUnder(path, f.derivativeDir) {
+		return true
+	}
+	return f.config.DbDriver == "sqlite" && strings.HasPrefix(absPath(path), absPath(f.config.DbName))
+}
+
+func (f fileService) orphanQuarantinePath(path string) string {
+	relativePath, err := filepath.Rel(filepath.Clean(f.fileDir), path)
+	if err != nil {
+		relativePath = filepath.Base(path)
+	}
+	return filepath.Join(f.quarantineDir, "orphans", relativePath)
+}
+
+func isUnder(path string, dir string) bool {
+	relativePath, err := filepath.Rel(absPath(dir), absPath(path))
+	return err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
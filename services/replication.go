@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"gocleancode/storage"
+	"os"
+)
+
+// When the uploads are copied to the secondary storage.
+const (
+	ReplicationSync  = "sync"  // Before the upload is committed. The upload fails if the copy does.
+	ReplicationAsync = "async" // After the upload is committed. Failed copies are retried by ReplicatePendingFiles.
+)
+
+// replicationMetrics counts the copies to the secondary storage, the failed ones and the reads served by the
+// secondary storage. Published by expvar as "replication".
+var replicationMetrics = expvar.NewMap("replication")
+
+// ReplicatePendingFiles copies to the secondary storage the blobs whose asynchronous replication failed or was
+// interrupted by a restart. Files that still fail stay pending until the next run.
+func (f fileService) ReplicatePendingFiles(ctx context.Context) error {
+	if f.secondary == nil {
+		return nil
+	}
+	afterId := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		files, err := f.repo.GetUnreplicatedFiles(ctx, afterId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			err = f.replicateFile(ctx, file) // Failures are logged and retried on the next run
+			if err != nil && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			afterId = *file.Id
+		}
+		if len(files) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// replicateFile copies the blob of the file to the secondary storage and marks the file replicated.
+func (f fileService) replicateFile(ctx context.Context, file repository.File) error {
+	backendStorage, err := f.backendStorage(file)
+	if err == nil {
+		filePath := f.blobPath(*file.FilePath)
+		err = f.copyToSecondary(ctx, backendStorage, filePath, filePath)
+	}
+	if err != nil {
+		replicationMetrics.Add("failed", 1)
+		log.Error(fmt.Sprintf("Failed to replicate file %d. Reason: %v", *file.Id, err))
+		return err
+	}
+	replicationMetrics.Add("replicated", 1)
+	err = f.repo.UpdateReplicationStatus(ctx, *file.Id, repository.ReplicationReplicated)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to update replication status of file %d. Reason: %v", *file.Id, err))
+	}
+	return err
+}
+
+// copyToSecondary copies the blob at fromPath in the source storage to toPath in the secondary storage. The blob is
+// copied as stored, encrypted or not.
+func (f fileService) copyToSecondary(ctx context.Context, source storage.Storage, fromPath string, toPath string) error {
+	contents, err := source.Open(ctx, fromPath)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	return f.secondary.Put(ctx, toPath, contents)
+}
+
+// moveSecondaryCopy follows a move of a blob in the primary storage. Failures are only logged, since the primary blob
+// has already moved.
+func (f fileService) moveSecondaryCopy(ctx context.Context, fromPath string, toPath string) {
+	if f.secondary == nil {
+		return
+	}
+	err := f.secondary.Move(ctx, fromPath, toPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(fmt.Sprintf("Failed to move the secondary copy of file %s. Reason: %v", fromPath, err))
+	}
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"strconv"
+	"time"
+)
+
+// RetentionUpdate changes the protection of a file. Nil fields are left unchanged.
+type RetentionUpdate struct {
+	RetentionUntil *time.Time // Can only be extended
+	LegalHold      *bool
+}
+
+// isProtected tells whether the file can't be deleted at the given time.
+func isProtected(file repository.File, now time.Time) bool {
+	if file.LegalHold != nil && *file.LegalHold {
+		return true
+	}
+	return file.RetentionUntilDt != nil && file.RetentionUntilDt.After(now)
+}
+
+// SetRetention updates the retention and the legal hold of the file, and records each change in the audit log along
+// with the actor, in the same transaction. ErrRetentionShortened is returned if the retention would end earlier.
+func (f fileService) SetRetention(ctx context.Context, bucket string, id int64, update RetentionUpdate, actor string) (repository.File, error) {
+	file, err := f.GetFileById(ctx, bucket, id)
+	if err != nil {
+		return file, err
+	}
+	retentionUntil, legalHold := file.RetentionUntilDt, file.LegalHold != nil && *file.LegalHold
+	var entries []repository.AuditLogEntry
+	if update.RetentionUntil != nil && (retentionUntil == nil || !update.RetentionUntil.Equal(*retentionUntil)) {
+		if retentionUntil != nil && update.RetentionUntil.Before(*retentionUntil) {
+			return file, ErrRetentionShortened
+		}
+		entries = append(entries, auditLogEntry(bucket, id, repository.AuditSetRetention, formatTime(retentionUntil), formatTime(update.RetentionUntil), actor))
+		retentionUntil = update.RetentionUntil
+	}
+	if update.LegalHold != nil && *update.LegalHold != legalHold {
+		oldValue, newValue := strconv.FormatBool(legalHold), strconv.FormatBool(*update.LegalHold)
+		entries = append(entries, auditLogEntry(bucket, id, repository.AuditSetLegalHold, &oldValue, &newValue, actor))
+		legalHold = *update.LegalHold
+	}
+	if len(entries) == 0 {
+		return file, nil
+	}
+	err = f.db.Transact(ctx, func(tx *sql.Tx) error {
+		updated, err := f.repo.TxUpdateRetention(ctx, id, retentionUntil, legalHold, tx)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return ErrRetentionShortened // Extended further, or deleted, since it was read
+		}
+		for _, entry := range entries {
+			_, err = f.repo.TxSaveAuditLogEntry(ctx, entry, tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return file, err
+	}
+	for _, entry := range entries {
+		log.Info(fmt.Sprintf("Audit: %s %s of file %d from %s to %s", actor, *entry.Action, id, stringValue(entry.OldValue), *entry.NewValue))
+	}
+	file.RetentionUntilDt, file.LegalHold = retentionUntil, &legalHold
+	return file, nil
+}
+
+// GetAuditLog returns the changes to the retention and the legal hold of the file, the oldest first. The audit log is
+// kept after the file is deleted.
+func (f fileService) GetAuditLog(ctx context.Context, bucket string, id int64) ([]repository.AuditLogEntry, error) {
+	if _, ok := f.config.Bucket(bucket); !ok {
+		return nil, ErrBucketNotFound
+	}
+	return f.repo.GetAuditLog(ctx, bucket, id)
+}
+
+func auditLogEntry(bucket string, fileId int64, action string, oldValue *string, newValue *string, actor string) repository.AuditLogEntry {
+	entry := repository.AuditLogEntry{Bucket: &bucket, FileId: &fileId, Action: &action, OldValue: oldValue, NewValue: newValue}
+	if actor != "" {
+		entry.Actor = &actor
+	}
+	return entry
+}
+
+func formatTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	formatted := t.UTC().Format(time.RFC3339)
+	return &formatted
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return "none"
+	}
+	return *s
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/repository"
+	"gocleancode/storage"
+	"io"
+	"os"
+	"time"
+)
+
+// scrubMetrics counts the verified, corrupt and restored files, those that changed while being scrubbed, the failed
+// scrubs and the bytes read. Published by expvar as "scrubber".
+var scrubMetrics = expvar.NewMap("scrubber")
+
+// ScrubFiles re-reads the blobs of the files not scrubbed within the scrub interval and compares them with their
+// checksum. A corrupt or missing blob is restored from the secondary storage if it holds an intact copy, otherwise the
+// file is marked corrupt. Files without a checksum get the one of their current blob. Reads are throttled to the configured
+// bytes per second.
+func (f fileService) ScrubFiles(ctx context.Context) error {
+	scrubbedBefore := time.Now().Add(-time.Duration(f.config.ScrubInterval) * time.Second)
+	limiter := newRateLimiter(f.config.ScrubBytesPerSecond)
+	afterId := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		files, err := f.repo.GetFilesScrubbedBefore(ctx, scrubbedBefore, afterId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			err = f.scrubFile(ctx, limiter, file)
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				scrubMetrics.Add("errors", 1)
+				log.Error(fmt.Sprintf("Failed to scrub file %d. Reason: %v", *file.Id, err))
+			}
+			afterId = *file.Id
+		}
+		if len(files) < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+func (f fileService) scrubFile(ctx context.Context, limiter *rateLimiter, file repository.File) error {
+	backendStorage, err := f.backendStorage(file)
+	if err != nil {
+		return err
+	}
+	filePath := f.blobPath(*file.FilePath)
+	checksum, err := blobChecksum(ctx, limiter, backendStorage, filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && (file.Checksum == nil || checksum == *file.Checksum) {
+		scrubMetrics.Add("verified", 1)
+		return f.repo.UpdateIntegrity(ctx, *file.Id, &checksum, repository.IntegrityOk)
+	}
+	// The file may have been moved or deleted since the batch was read, then the blob read is not its blob anymore
+	changed, err := f.blobChanged(ctx, file)
+	if err != nil {
+		return err
+	}
+	if changed {
+		scrubMetrics.Add("changed", 1) // Scrubbed on the next run
+		return nil
+	}
+	scrubMetrics.Add("corrupt", 1)
+	log.Error(fmt.Sprintf("The blob %s of file %d is corrupt or missing", filePath, *file.Id))
+	if f.secondary != nil && file.Checksum != nil {
+		restored, err := f.restoreFromSecondary(ctx, limiter, backendStorage, file)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to restore file %d from the secondary storage. Reason: %v", *file.Id, err))
+		}
+		if restored {
+			scrubMetrics.Add("restored", 1)
+			log.Info(fmt.Sprintf("Restored file %d from the secondary storage", *file.Id))
+			return f.repo.UpdateIntegrity(ctx, *file.Id, file.Checksum, repository.IntegrityOk)
+		}
+	}
+	return f.repo.UpdateIntegrity(ctx, *file.Id, file.Checksum, repository.IntegrityCorrupt)
+}
+
+// blobChanged reports whether the file was deleted, or its blob moved or replaced, since the file was read.
+func (f fileService) blobChanged(ctx context.Context, file repository.File) (bool, error) {
+	current, err := f.repo.GetFileById(ctx, *file.Bucket, *file.Id)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	backend, currentBackend := repository.BackendHot, repository.BackendHot
+	if file.Backend != nil {
+		backend = *file.Backend
+	}
+	if current.Backend != nil {
+		currentBackend = *current.Backend
+	}
+	return *current.FilePath != *file.FilePath || currentBackend != backend, nil
+}
+
+// restoreFromSecondary replaces the blob of the file with the secondary copy, if the copy matches the checksum. The copy
+// is staged like an upload so that a failed restore doesn't leave a partial blob.
+func (f fileService) restoreFromSecondary(ctx context.Context, limiter *rateLimiter, backendStorage storage.Storage, file repository.File) (bool, error) {
+	filePath := f.blobPath(*file.FilePath)
+	contents, err := f.secondary.Open(ctx, filePath)
+	if err != nil {
+		return false, err
+	}
+	defer contents.Close()
+	stagedPath := filePath + stagedSuffix
+	pendingIds, err := f.recordPendingDeletions(ctx, stagedPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.deleteBlobs(ctx, pendingIds, stagedPath) // Nothing to delete once moved
+	hash := sha256.New()
+	err = backendStorage.Put(ctx, stagedPath, io.TeeReader(throttledReader{ctx, contents, limiter}, hash))
+	if err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != *file.Checksum {
+		log.Error(fmt.Sprintf("The secondary copy of file %d is corrupt too", *file.Id))
+		return false, nil
+	}
+	return true, backendStorage.Move(ctx, stagedPath, filePath)
+}
+
+// blobChecksum returns the hex encoded sha256 of the blob. The reads are not throttled if limiter is nil.
+func blobChecksum(ctx context.Context, limiter *rateLimiter, fileStorage storage.Storage, path string) (string, error) {
+	contents, err := fileStorage.Open(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer contents.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, throttledReader{ctx, contents, limiter})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// rateLimiter keeps the average rate of the reads since its creation under bytesPerSecond. 0 means unlimited.
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+// wait accounts for n bytes read and sleeps for as long as the reads are ahead of the rate.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.bytes += int64(n)
+	scrubMetrics.Add("bytesRead", int64(n))
+	if l.bytesPerSecond <= 0 {
+		return nil
+	}
+	ahead := time.Duration(float64(l.bytes)/float64(l.bytesPerSecond)*float64(time.Second)) - time.Since(l.start)
+	if ahead <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.limiter == nil {
+		return n, err
+	}
+	if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocleancode/imaging"
+	"gocleancode/repository"
+	"gocleancode/storage"
+	"gocleancode/utils"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxThumbnailSize = 2048 // Of the width and the height
+
+var (
+	ErrNotAnImage       = errors.New("the file is not a JPEG, PNG or GIF image")
+	ErrInvalidThumbnail = fmt.Errorf("the thumbnail width and height must be between 1 and %d, and fit one of %s, %s or %s",
+		maxThumbnailSize, imaging.FitContain, imaging.FitCover, imaging.FitFill)
+	ErrImageTooLarge = errors.New("the image has too many pixels to be processed")
+)
+
+// thumbnailFormats maps the content types that thumbnails are generated for to the format of their thumbnails. The
+// thumbnails of GIF images are PNG, which keeps their colors.
+var thumbnailFormats = map[string]string{
+	"image/jpeg": imaging.FormatJpeg,
+	"image/png":  imaging.FormatPng,
+	"image/gif":  imaging.FormatPng,
+}
+
+// derivativeMetrics counts the derivatives served from the cache, those generated, those that failed to be cached,
+// those generated without caching and those evicted. Published by expvar as "derivatives".
+var derivativeMetrics = expvar.NewMap("derivatives")
+
+// ThumbnailOptions are the dimensions of a thumbnail and how the image is fitted in them.
+type ThumbnailOptions struct {
+	Width  int
+	Height int
+	Fit    string // contain, cover or fill. Defaults to contain
+}
+
+// GetThumbnail returns the thumbnail of an image file and its content type. Thumbnails of the ThumbnailSizes are
+// generated on the first request and cached in the derivatives dir, encrypted with the data key of the file if it's
+// encrypted, the others on each request. The cached derivatives are named after the checksum of the file so that they
+// are never served for other contents, evicted beyond MaxDerivativesPerFile, and deleted along with the file.
+func (f fileService) GetThumbnail(ctx context.Context, file repository.File, options ThumbnailOptions) (io.ReadSeekCloser, string, error) {
+	format, ok := thumbnailFormats[mediaType(*file.ContentType)]
+	if !ok {
+		return nil, "", ErrNotAnImage
+	}
+	if options.Fit == "" {
+		options.Fit = imaging.FitContain
+	}
+	if options.Width < 1 || options.Width > maxThumbnailSize || options.Height < 1 || options.Height > maxThumbnailSize ||
+		(options.Fit != imaging.FitContain && options.Fit != imaging.FitCover && options.Fit != imaging.FitFill) {
+		return nil, "", ErrInvalidThumbnail
+	}
+	if f.config.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.config.DownloadTimeout)*time.Second)
+		defer cancel()
+	}
+	name := fmt.Sprintf("%dx%d-%s.%s", options.Width, options.Height, options.Fit, format)
+	cacheable := f.isThumbnailSize(options.Width) && f.isThumbnailSize(options.Height)
+	thumbnail, err := f.cachedDerivative(ctx, file, name, cacheable, func() ([]byte, error) {
+		img, _, err := f.decodeImage(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		var thumbnail bytes.Buffer
+		err = imaging.Encode(&thumbnail, imaging.Resize(img, options.Width, options.Height, options.Fit), format, 0)
+		return thumbnail.Bytes(), err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return bytesReader{bytes.NewReader(thumbnail)}, imaging.ContentType(format), nil
+}
+
+// isThumbnailSize reports whether the width or height is one of the ThumbnailSizes, whose thumbnails are cached.
+func (f fileService) isThumbnailSize(length int) bool {
+	for _, size := range f.config.ThumbnailSizes {
+		if length == size {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeImage decodes the image of the file and reads its EXIF orientation.
+func (f fileService) decodeImage(ctx context.Context, file repository.File) (image.Image, int, error) {
+	contents, err := f.openFile(ctx, file, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer utils.CloseFile(contents)
+	orientation, err := imaging.Orientation(contents)
+	if err != nil {
+		return nil, 0, err
+	}
+	img, _, err := imaging.Decode(contents, f.config.MaxImagePixels)
+	switch err {
+	case nil:
+		return img, orientation, nil
+	case imaging.ErrTooManyPixels:
+		return nil, 0, ErrImageTooLarge
+	case imaging.ErrUnsupportedFormat:
+		return nil, 0, ErrNotAnImage
+	}
+	return nil, 0, err
+}
+
+// cachedDerivative returns the named derivative of the file from the cache, or generates it and caches it if
+// cacheable, evicting the oldest derivatives of the file beyond MaxDerivativesPerFile. Failing to cache it only logs a
+// warning.
+func (f fileService) cachedDerivative(ctx context.Context, file repository.File, name string, cacheable bool, generate func() ([]byte, error)) ([]byte, error) {
+	if !cacheable || f.config.MaxDerivativesPerFile <= 0 {
+		derivative, err := generate()
+		if err == nil {
+			derivativeMetrics.Add("uncached", 1)
+		}
+		return derivative, err
+	}
+	derivativePath := f.derivativePath(file, name)
+	derivative, err := f.readDerivative(ctx, file, derivativePath)
+	if err == nil {
+		derivativeMetrics.Add("hits", 1)
+		return derivative, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Warn(fmt.Sprintf("Failed to read the cached derivative %s. Reason: %v", derivativePath, err))
+	}
+	derivative, err = generate()
+	if err != nil {
+		return nil, err
+	}
+	derivativeMetrics.Add("generated", 1)
+	err = f.writeDerivative(ctx, file, derivativePath, derivative)
+	if err != nil {
+		derivativeMetrics.Add("failed", 1)
+		log.Warn(fmt.Sprintf("Failed to cache the derivative %s. Reason: %v", derivativePath, err))
+		return derivative, nil
+	}
+	f.evictDerivatives(ctx, *file.Id)
+	return derivative, nil
+}
+
+// evictDerivatives deletes the oldest cached derivatives of the file beyond MaxDerivativesPerFile, including those of
+// its previous contents. Failures are logged, the next derivative cached evicts them again.
+func (f fileService) evictDerivatives(ctx context.Context, fileId int64) {
+	type derivative struct {
+		path    string
+		modTime time.Time
+	}
+	var derivatives []derivative
+	err := f.storage.Walk(ctx, f.derivativesOf(fileId), func(path string, modTime time.Time) error {
+		if !strings.HasSuffix(path, stagedSuffix) { // Being written by a concurrent request
+			derivatives = append(derivatives, derivative{path, modTime})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to list the derivatives of file %d. Reason: %v", fileId, err))
+		return
+	}
+	if len(derivatives) <= f.config.MaxDerivativesPerFile {
+		return
+	}
+	sort.Slice(derivatives, func(i, j int) bool {
+		return derivatives[i].modTime.Before(derivatives[j].modTime)
+	})
+	for _, evicted := range derivatives[:len(derivatives)-f.config.MaxDerivativesPerFile] {
+		err := f.storage.Delete(ctx, evicted.path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn(fmt.Sprintf("Failed to evict the derivative %s. Reason: %v", evicted.path, err))
+			continue
+		}
+		derivativeMetrics.Add("evicted", 1)
+	}
+}
+
+// derivativesOf returns the dir holding the derivatives of the file, sharded like the blobs.
+func (f fileService) derivativesOf(fileId int64) string {
+	return storage.ShardedPath(f.derivativeDir, strconv.FormatInt(fileId, 10), f.config.ShardDepth)
+}
+
+// derivativePath returns the path of the named derivative of the file, for its current contents.
+func (f fileService) derivativePath(file repository.File, name string) string {
+	version := "0"
+	if file.Checksum != nil {
+		version = *file.Checksum
+	}
+	return filepath.Join(f.derivativesOf(*file.Id), version+"-"+name)
+}
+
+func (f fileService) readDerivative(ctx context.Context, file repository.File, derivativePath string) ([]byte, error) {
+	contents, err := f.storage.Open(ctx, derivativePath)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := f.dataKey(file)
+	if err == nil && dataKey != nil {
+		var decrypted io.ReadSeekCloser
+		decrypted, err = storage.Decrypt(contents, dataKey)
+		if err == nil {
+			contents = decrypted
+		}
+	}
+	defer utils.CloseFile(contents)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(contents)
+}
+
+// writeDerivative stores the derivative, staged then moved so that the concurrent requests never read a partial one.
+func (f fileService) writeDerivative(ctx context.Context, file repository.File, derivativePath string, derivative []byte) error {
+	var contents io.Reader = bytes.NewReader(derivative)
+	dataKey, err := f.dataKey(file)
+	if err != nil {
+		return err
+	}
+	if dataKey != nil {
+		contents, err = storage.Encrypt(contents, dataKey)
+		if err != nil {
+			return err
+		}
+	}
+	name, err := storage.NewBlobName()
+	if err != nil {
+		return err
+	}
+	stagedPath := derivativePath + "." + name + stagedSuffix
+	err = f.storage.Put(ctx, stagedPath, contents)
+	if err == nil {
+		err = f.storage.Move(ctx, stagedPath, derivativePath)
+	}
+	if err != nil {
+		f.storage.Delete(context.Background(), stagedPath)
+	}
+	return err
+}
+
+// deleteDerivatives deletes the cached derivatives of the file. Failures are logged, the derivatives left behind are
+// never served since their file no longer exists.
+func (f fileService) deleteDerivatives(ctx context.Context, fileId int64) {
+	var paths []string
+	err := f.storage.Walk(ctx, f.derivativesOf(fileId), func(path string, modTime time.Time) error {
+		paths = append(paths, path)
+		return nil
+	})
+	for _, path := range paths {
+		if deleteErr := f.storage.Delete(ctx, path); deleteErr != nil && !os.IsNotExist(deleteErr) {
+			err = deleteErr
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn(fmt.Sprintf("Failed to delete the derivatives of file %d. Reason: %v", fileId, err))
+	}
+}
+
+// bytesReader serves the contents held in memory.
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func (r bytesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"gocleancode/imaging"
+	"gocleancode/repository"
+	"image"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrInvalidTransformation = errors.New("the format must be jpeg, png or gif, the quality between 1 and 100 for jpeg " +
+	"only, and the crop within the image")
+
+// transformFormats are the formats that the images can be converted to.
+var transformFormats = map[string]string{
+	"jpeg": imaging.FormatJpeg,
+	"jpg":  imaging.FormatJpeg,
+	"png":  imaging.FormatPng,
+	"gif":  imaging.FormatGif,
+}
+
+// ImageTransformation lists the operations applied to an image file on download, in the order of the fields. Only
+// these operations are allowed.
+type ImageTransformation struct {
+	AutoOrient bool             // Rotates and flips the image as specified by its EXIF orientation
+	Crop       *image.Rectangle // Relative to the top left corner of the oriented image. Clipped to the image
+	Format     string           // jpeg, png or gif. Defaults to the format of the file, or png for gif
+	Quality    int              // From 1 to 100. JPEG only. Defaults to 85
+}
+
+// TransformImage returns the image file transformed as specified, and its content type. Images of more than
+// MaxImagePixels are not decoded, and transformations resulting in more than MaxOutputImagePixels are rejected, with
+// ErrImageTooLarge. The transformed images are cached like the thumbnails, see GetThumbnail, except the cropped ones
+// since any rectangle can be requested.
+func (f fileService) TransformImage(ctx context.Context, file repository.File, transformation ImageTransformation) (io.ReadSeekCloser, string, error) {
+	sourceFormat, ok := thumbnailFormats[mediaType(*file.ContentType)]
+	if !ok {
+		return nil, "", ErrNotAnImage
+	}
+	format := sourceFormat
+	if transformation.Format != "" {
+		format, ok = transformFormats[strings.ToLower(transformation.Format)]
+		if !ok {
+			return nil, "", ErrInvalidTransformation
+		}
+	}
+	if transformation.Quality != 0 && (transformation.Quality < 1 || transformation.Quality > 100 || format != imaging.FormatJpeg) {
+		return nil, "", ErrInvalidTransformation
+	}
+	if transformation.Crop != nil && transformation.Crop.Empty() {
+		return nil, "", ErrInvalidTransformation
+	}
+	if f.config.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.config.DownloadTimeout)*time.Second)
+		defer cancel()
+	}
+	transformed, err := f.cachedDerivative(ctx, file, transformation.name(format), transformation.Crop == nil, func() ([]byte, error) {
+		img, orientation, err := f.decodeImage(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		if transformation.AutoOrient {
+			img = imaging.Orient(img, orientation)
+		}
+		if transformation.Crop != nil {
+			img, err = imaging.Crop(img, *transformation.Crop)
+			if err == imaging.ErrEmptyCrop {
+				return nil, ErrInvalidTransformation
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		bounds := img.Bounds()
+		if f.config.MaxOutputImagePixels > 0 && int64(bounds.Dx())*int64(bounds.Dy()) > f.config.MaxOutputImagePixels {
+			return nil, ErrImageTooLarge
+		}
+		var encoded bytes.Buffer
+		err = imaging.Encode(&encoded, img, format, transformation.Quality)
+		return encoded.Bytes(), err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return bytesReader{bytes.NewReader(transformed)}, imaging.ContentType(format), nil
+}
+
+// name returns the name of the cached derivative, eg oriented-crop0,0,100,50-q70.jpeg.
+func (t ImageTransformation) name(format string) string {
+	var operations []string
+	if t.AutoOrient {
+		operations = append(operations, "oriented")
+	}
+	if t.Crop != nil {
+		operations = append(operations, fmt.Sprintf("crop%d,%d,%d,%d", t.Crop.Min.X, t.Crop.Min.Y, t.Crop.Dx(), t.Crop.Dy()))
+	}
+	if t.Quality != 0 {
+		operations = append(operations, fmt.Sprintf("q%d", t.Quality))
+	}
+	if len(operations) == 0 {
+		operations = append(operations, "converted")
+	}
+	return strings.Join(operations, "-") + "." + format
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"gocleancode/config"
+	"path/filepath"
+	"strings"
+)
+
+// uploadPolicy combines the global upload policy with the settings of a bucket.
+type uploadPolicy struct {
+	policy config.UploadPolicy
+	bucket config.BucketConfig
+}
+
+func (p uploadPolicy) maxFileSize() int64 {
+	maxFileSize := p.policy.MaxFileSize
+	if maxFileSize <= 0 || (p.bucket.MaxFileSize > 0 && p.bucket.MaxFileSize < maxFileSize) {
+		maxFileSize = p.bucket.MaxFileSize
+	}
+	return maxFileSize
+}
+
+func (p uploadPolicy) checkSize(size int64) error {
+	maxFileSize := p.maxFileSize()
+	if maxFileSize > 0 && size > maxFileSize {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+func (p uploadPolicy) checkFileName(fileName string) error {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	if len(p.policy.AllowedExtensions) > 0 && !containsIgnoreCase(p.policy.AllowedExtensions, extension) {
+		return ErrExtensionNotAllowed
+	}
+	if containsIgnoreCase(p.policy.DeniedExtensions, extension) {
+		return ErrExtensionNotAllowed
+	}
+	return nil
+}
+
+// checkContent detects the type of the contents and returns the content type to store.
+func (p uploadPolicy) checkContent(claimedType string, data []byte) (string, error) {
+	contentType, consistent := resolveContentType(claimedType, detectContentType(data))
+	if !consistent {
+		return contentType, ErrContentTypeMismatch
+	}
+	for _, allowedTypes := range [][]string{p.policy.AllowedTypes, p.bucket.AllowedTypes} {
+		if len(allowedTypes) > 0 && !matchesContentType(contentType, allowedTypes) {
+			return contentType, ErrContentTypeNotAllowed
+		}
+	}
+	if matchesContentType(contentType, p.policy.DeniedTypes) {
+		return contentType, ErrContentTypeNotAllowed
+	}
+	return contentType, nil
+}
+
+func containsIgnoreCase(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
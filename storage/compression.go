@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// Encodings of the compressed blobs, named after their HTTP content coding.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+var ErrUnknownEncoding = errors.New("unknown content encoding")
+
+// Compress returns the contents compressed with the encoding.
+func Compress(contents []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case EncodingGzip:
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := writer.Write(contents)
+		if err == nil {
+			err = writer.Close()
+		}
+		return compressed.Bytes(), err
+	case EncodingZstd:
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(contents, nil), nil
+	}
+	return nil, ErrUnknownEncoding
+}
+
+// Decompress returns a seekable reader of the decompressed contents, of the given size. The compressed streams can't
+// be seeked, so seeking backwards decompresses again from the start and seeking forwards skips the contents in between.
+func Decompress(compressed io.ReadSeekCloser, encoding string, size int64) (io.ReadSeekCloser, error) {
+	if encoding != EncodingGzip && encoding != EncodingZstd {
+		return nil, ErrUnknownEncoding
+	}
+	return &decompressingReader{src: compressed, encoding: encoding, size: size}, nil
+}
+
+type decompressingReader struct {
+	src      io.ReadSeekCloser
+	encoding string
+	size     int64 // Size of the decompressed contents
+	pos      int64
+	decoder  io.ReadCloser // Nil until the first read
+	decoded  int64         // Position of the decoder
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.decoder == nil || r.decoded > r.pos {
+		err := r.rewind()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.decoded < r.pos {
+		n, err := io.CopyN(io.Discard, r.decoder, r.pos-r.decoded)
+		r.decoded += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.decoder.Read(p)
+	r.decoded += int64(n)
+	r.pos += int64(n)
+	return n, err
+}
+
+// rewind starts decompressing again from the start of the blob.
+func (r *decompressingReader) rewind() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+		r.decoder = nil
+	}
+	_, err := r.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if r.encoding == EncodingGzip {
+		decoder, err := gzip.NewReader(r.src)
+		if err != nil {
+			return err
+		}
+		r.decoder = decoder
+	} else {
+		decoder, err := zstd.NewReader(r.src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		r.decoder = decoder.IOReadCloser()
+	}
+	r.decoded = 0
+	return nil
+}
+
+func (r *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *decompressingReader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return r.src.Close()
+}
@@ -0,0 +1,62 @@
+package storage_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"gocleancode/storage"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressAndDecompress(t *testing.T) {
+	contents := []byte(strings.Repeat("id,name,amount\n1,alice,10\n2,bob,20\n", 1000))
+	for _, encoding := range []string{storage.EncodingGzip, storage.EncodingZstd} {
+		compressed, err := storage.Compress(contents, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Less(t, len(compressed), len(contents)/10, encoding)
+		decompressed, err := storage.Decompress(readSeekCloser{bytes.NewReader(compressed)}, encoding, int64(len(contents)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		readContents, err := ioutil.ReadAll(decompressed)
+		assert.Nil(t, err)
+		assert.Equal(t, contents, readContents, encoding)
+	}
+}
+
+func TestDecompressSeek(t *testing.T) {
+	contents := []byte(strings.Repeat("0123456789", 10000))
+	compressed, err := storage.Compress(contents, storage.EncodingZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := storage.Decompress(readSeekCloser{bytes.NewReader(compressed)}, storage.EncodingZstd, int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := decompressed.Seek(0, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(contents)), size)
+	// Forwards, then backwards
+	for _, offset := range []int64{54321, 3} {
+		_, err = decompressed.Seek(offset, io.SeekStart)
+		assert.Nil(t, err)
+		part := make([]byte, 5)
+		_, err = io.ReadFull(decompressed, part)
+		assert.Nil(t, err)
+		assert.Equal(t, contents[offset:offset+5], part)
+	}
+	_, err = decompressed.Seek(int64(len(contents)), io.SeekStart)
+	assert.Nil(t, err)
+	_, err = decompressed.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCompressWithUnknownEncoding(t *testing.T) {
+	_, err := storage.Compress([]byte("hello"), "br")
+	assert.Equal(t, storage.ErrUnknownEncoding, err)
+}
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader fails the reads once the context is done, so that long copies stop when the request is cancelled.
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+type contextReadSeekCloser struct {
+	contextReader
+	io.Seeker
+	io.Closer
+}
+
+// WithContext returns a reader that fails the reads once the context is done.
+func WithContext(ctx context.Context, contents io.ReadSeekCloser) io.ReadSeekCloser {
+	return contextReadSeekCloser{contextReader{ctx, contents}, contents, contents}
+}
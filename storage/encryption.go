@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted blobs start with a header followed by chunks. Each chunk is sealed with AES-256-GCM using a nonce made of
+// the random prefix from the header, the chunk index and a flag marking the last chunk, so chunks can't be reordered
+// or truncated without failing authentication.
+const (
+	encryptionMagic = "GCE1"
+	noncePrefixSize = 7
+	headerSize      = len(encryptionMagic) + noncePrefixSize
+	plainChunkSize  = 64 << 10
+	tagSize         = 16
+	cipherChunkSize = plainChunkSize + tagSize
+	dataKeySize     = 32
+	masterKeySize   = 32
+)
+
+var (
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	ErrCorruptedBlob    = errors.New("encrypted blob is corrupted")
+)
+
+// Encryptor does envelope encryption. Each blob is encrypted with its own data key, which is wrapped by a master key.
+// The master key id is stored with the wrapped key so that master keys can be rotated.
+type Encryptor struct {
+	masterKeys  map[string]cipher.AEAD
+	activeKeyId string
+}
+
+// NewEncryptor creates an encryptor from base64 encoded 256 bit master keys. New data keys are wrapped by the active key.
+func NewEncryptor(masterKeys map[string]string, activeKeyId string) (*Encryptor, error) {
+	encryptor := &Encryptor{map[string]cipher.AEAD{}, activeKeyId}
+	for keyId, encodedKey := range masterKeys {
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s is not base64 encoded: %v", keyId, err)
+		}
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("master key %s must be %d bytes", keyId, masterKeySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		encryptor.masterKeys[keyId] = aead
+	}
+	if _, ok := encryptor.masterKeys[activeKeyId]; !ok {
+		return nil, fmt.Errorf("active master key %s is not configured", activeKeyId)
+	}
+	return encryptor, nil
+}
+
+func (e *Encryptor) ActiveKeyId() string {
+	return e.activeKeyId
+}
+
+// NewDataKey generates a data key and wraps it with the active master key.
+func (e *Encryptor) NewDataKey() ([]byte, string, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	wrappedKey, err := e.wrapKey(e.activeKeyId, dataKey)
+	return dataKey, wrappedKey, err
+}
+
+func (e *Encryptor) UnwrapKey(keyId string, wrappedKey string) ([]byte, error) {
+	masterKey, ok := e.masterKeys[keyId]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < masterKey.NonceSize() {
+		return nil, ErrCorruptedBlob
+	}
+	nonce := sealed[:masterKey.NonceSize()]
+	return masterKey.Open(nil, nonce, sealed[masterKey.NonceSize():], []byte(keyId))
+}
+
+// RewrapKey unwraps a data key with the master key that wrapped it and wraps it again with the active master key.
+// The data key itself doesn't change, so the blob encrypted with it doesn't need to be rewritten.
+func (e *Encryptor) RewrapKey(keyId string, wrappedKey string) (string, error) {
+	dataKey, err := e.UnwrapKey(keyId, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	return e.wrapKey(e.activeKeyId, dataKey)
+}
+
+func (e *Encryptor) wrapKey(keyId string, dataKey []byte) (string, error) {
+	masterKey, ok := e.masterKeys[keyId]
+	if !ok {
+		return "", ErrUnknownMasterKey
+	}
+	nonce := make([]byte, masterKey.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := masterKey.Seal(nonce, nonce, dataKey, []byte(keyId))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(noncePrefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// Encrypt returns a reader of the encrypted contents.
+func Encrypt(contents io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize, headerSize+cipherChunkSize)
+	copy(header, encryptionMagic)
+	noncePrefix := header[len(encryptionMagic):]
+	_, err = rand.Read(noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{
+		src:         bufio.NewReaderSize(contents, plainChunkSize),
+		aead:        aead,
+		noncePrefix: append([]byte{}, noncePrefix...),
+		plain:       make([]byte, plainChunkSize),
+		out:         header,
+	}, nil
+}
+
+type encryptingReader struct {
+	src         *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	index       int64
+	plain       []byte
+	sealed      []byte
+	out         []byte // Encrypted bytes not yet read
+	done        bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.sealNextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealNextChunk() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		_, err = r.src.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.noncePrefix, r.index, last), r.plain[:n], nil)
+	r.out = r.sealed
+	r.index++
+	r.done = last
+	return nil
+}
+
+// Decrypt returns a seekable reader of the decrypted contents. The last chunk is authenticated upfront so that a
+// truncated blob is detected before any content is returned.
+func Decrypt(encrypted io.ReadSeekCloser, dataKey []byte) (io.ReadSeekCloser, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(encrypted, header)
+	if err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, ErrCorruptedBlob
+	}
+	total, err := encrypted.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	body := total - int64(headerSize)
+	if body < tagSize {
+		return nil, ErrCorruptedBlob
+	}
+	chunkCount := (body + cipherChunkSize - 1) / cipherChunkSize
+	lastChunkSize := body - (chunkCount-1)*cipherChunkSize
+	if lastChunkSize < tagSize {
+		return nil, ErrCorruptedBlob
+	}
+	r := &decryptingReader{
+		src:           encrypted,
+		aead:          aead,
+		noncePrefix:   header[len(encryptionMagic):],
+		size:          (chunkCount-1)*plainChunkSize + lastChunkSize - tagSize,
+		chunkCount:    chunkCount,
+		lastChunkSize: lastChunkSize,
+		chunkIndex:    -1,
+		sealed:        make([]byte, cipherChunkSize),
+	}
+	err = r.loadChunk(chunkCount - 1)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type decryptingReader struct {
+	src           io.ReadSeekCloser
+	aead          cipher.AEAD
+	noncePrefix   []byte
+	size          int64 // Size of the decrypted contents
+	chunkCount    int64
+	lastChunkSize int64
+	pos           int64
+	chunkIndex    int64 // Index of the chunk in plain
+	sealed        []byte
+	plain         []byte
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / plainChunkSize
+	if index != r.chunkIndex {
+		err := r.loadChunk(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-index*plainChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) loadChunk(index int64) error {
+	_, err := r.src.Seek(int64(headerSize)+index*cipherChunkSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	last := index == r.chunkCount-1
+	sealed := r.sealed[:cipherChunkSize]
+	if last {
+		sealed = r.sealed[:r.lastChunkSize]
+	}
+	_, err = io.ReadFull(r.src, sealed)
+	if err != nil {
+		return err
+	}
+	r.plain, err = r.aead.Open(r.plain[:0], chunkNonce(r.noncePrefix, index, last), sealed, nil)
+	if err != nil {
+		r.chunkIndex = -1
+		return ErrCorruptedBlob
+	}
+	r.chunkIndex = index
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
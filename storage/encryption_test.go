@@ -0,0 +1,157 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"gocleancode/storage"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type readSeekCloser struct {
+	*bytes.Reader
+}
+
+func (r readSeekCloser) Close() error {
+	return nil
+}
+
+func newMasterKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func encrypt(t *testing.T, contents []byte, dataKey []byte) []byte {
+	encrypted, err := storage.Encrypt(bytes.NewReader(contents), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedBytes, err := ioutil.ReadAll(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptedBytes
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	chunkSize := 64 << 10
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		contents := make([]byte, size)
+		rand.Read(contents)
+		dataKey := make([]byte, 32)
+		rand.Read(dataKey)
+		encrypted := encrypt(t, contents, dataKey)
+		if size > 16 { // A few random bytes may appear in the ciphertext by chance
+			assert.NotContains(t, string(encrypted), string(contents))
+		}
+		// When
+		decrypted, err := storage.Decrypt(readSeekCloser{bytes.NewReader(encrypted)}, dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decryptedBytes, err := ioutil.ReadAll(decrypted)
+		// Then
+		assert.Nil(t, err)
+		assert.Equal(t, contents, decryptedBytes, "size %d", size)
+		end, err := decrypted.Seek(0, io.SeekEnd)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), end)
+	}
+}
+
+func TestDecryptRange(t *testing.T) {
+	chunkSize := 64 << 10
+	contents := make([]byte, 3*chunkSize+100)
+	rand.Read(contents)
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	decrypted, err := storage.Decrypt(readSeekCloser{bytes.NewReader(encrypt(t, contents, dataKey))}, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A range spanning the chunk boundaries
+	start := int64(chunkSize - 10)
+	_, err = decrypted.Seek(start, io.SeekStart)
+	assert.Nil(t, err)
+	actual := make([]byte, 2*chunkSize)
+	_, err = io.ReadFull(decrypted, actual)
+	assert.Nil(t, err)
+	assert.Equal(t, contents[start:start+int64(len(actual))], actual)
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	chunkSize := 64 << 10
+	contents := make([]byte, 2*chunkSize+100)
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	encrypted := encrypt(t, contents, dataKey)
+	// Flipping a bit of the first chunk
+	tampered := append([]byte{}, encrypted...)
+	tampered[20] ^= 1
+	decrypted, err := storage.Decrypt(readSeekCloser{bytes.NewReader(tampered)}, dataKey)
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(decrypted)
+	assert.Equal(t, storage.ErrCorruptedBlob, err)
+	// Dropping the last chunk
+	truncated := encrypted[:len(encrypted)-116]
+	_, err = storage.Decrypt(readSeekCloser{bytes.NewReader(truncated)}, dataKey)
+	assert.Equal(t, storage.ErrCorruptedBlob, err)
+	// Using another key
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	_, err = storage.Decrypt(readSeekCloser{bytes.NewReader(encrypted)}, otherKey)
+	assert.Equal(t, storage.ErrCorruptedBlob, err)
+}
+
+func TestWrapAndUnwrapDataKey(t *testing.T) {
+	encryptor, err := storage.NewEncryptor(map[string]string{"key1": newMasterKey(), "key2": newMasterKey()}, "key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, wrappedKey, err := encryptor.NewDataKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "key2", encryptor.ActiveKeyId())
+	// When
+	unwrappedKey, err := encryptor.UnwrapKey("key2", wrappedKey)
+	// Then
+	assert.Nil(t, err)
+	assert.Equal(t, dataKey, unwrappedKey)
+	_, err = encryptor.UnwrapKey("key1", wrappedKey)
+	assert.NotNil(t, err)
+	_, err = encryptor.UnwrapKey("key3", wrappedKey)
+	assert.Equal(t, storage.ErrUnknownMasterKey, err)
+}
+
+func TestRewrapDataKey(t *testing.T) {
+	masterKeys := map[string]string{"key1": newMasterKey(), "key2": newMasterKey()}
+	oldEncryptor, err := storage.NewEncryptor(masterKeys, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEncryptor, err := storage.NewEncryptor(masterKeys, "key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, wrappedKey, err := oldEncryptor.NewDataKey()
+	assert.Nil(t, err)
+	// When
+	rewrappedKey, err := newEncryptor.RewrapKey("key1", wrappedKey)
+	// Then
+	assert.Nil(t, err)
+	unwrappedKey, err := newEncryptor.UnwrapKey("key2", rewrappedKey)
+	assert.Nil(t, err)
+	assert.Equal(t, dataKey, unwrappedKey)
+	_, err = newEncryptor.RewrapKey("key3", wrappedKey)
+	assert.Equal(t, storage.ErrUnknownMasterKey, err)
+}
+
+func TestNewEncryptorWithInvalidKeys(t *testing.T) {
+	_, err := storage.NewEncryptor(map[string]string{"key1": "c2hvcnQ="}, "key1")
+	assert.NotNil(t, err)
+	_, err = storage.NewEncryptor(map[string]string{"key1": newMasterKey()}, "key2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// NewBlobName returns a random name for a new blob.
+func NewBlobName() (string, error) {
+	name := make([]byte, 16)
+	_, err := rand.Read(name)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(name), nil
+}
+
+// ShardedPath returns the path of the blob named name in dir, under depth levels of sub directories named after the
+// leading hex digits of the sha256 of the name. Eg, dir/ab/cd/name for a depth of 2. The blobs are spread evenly
+// whatever their names, so that no directory holds too many entries. A depth of 0 or less puts the blob in dir.
+func ShardedPath(dir string, name string, depth int) string {
+	hash := sha256.Sum256([]byte(name))
+	if depth > len(hash) {
+		depth = len(hash)
+	}
+	elements := []string{dir}
+	for i := 0; i < depth; i++ {
+		elements = append(elements, hex.EncodeToString(hash[i:i+1]))
+	}
+	return filepath.Join(append(elements, name)...)
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// localStorage stores the files in the local disk.
+type localStorage struct{}
+
+func NewLocalStorage() Storage {
+	return localStorage{}
+}
+
+func (s localStorage) Put(ctx context.Context, path string, contents io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, contextReader{ctx, contents})
+	if err == nil {
+		err = file.Sync() // The contents must be durable before the file is referenced by the db
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path) // Don't leave a partially written file
+	}
+	return err
+}
+
+func (s localStorage) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return WithContext(ctx, file), nil
+}
+
+func (s localStorage) Delete(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s localStorage) Move(ctx context.Context, fromPath string, toPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(toPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(toPath))
+}
+
+func (s localStorage) Exists(ctx context.Context, path string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s localStorage) Walk(ctx context.Context, dir string, walkFn func(path string, modTime time.Time) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return walkFn(path, info.ModTime())
+	})
+}
+
+// syncDir makes a rename durable by flushing the directory entry.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	closeErr := dir.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gocleancode/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStorageObservesCancellation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localStorage := storage.NewLocalStorage()
+	path := filepath.Join(dir, "file.txt")
+	ctx, cancel := context.WithCancel(context.Background())
+	err = localStorage.Put(ctx, path, strings.NewReader("hello world"))
+	assert.Nil(t, err)
+	contents, err := localStorage.Open(ctx, path)
+	assert.Nil(t, err)
+	defer contents.Close()
+	// When
+	cancel()
+	// Then
+	_, err = ioutil.ReadAll(contents)
+	assert.Equal(t, context.Canceled, err)
+	err = localStorage.Put(ctx, filepath.Join(dir, "cancelled.txt"), strings.NewReader("hello world"))
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(filepath.Join(dir, "cancelled.txt"))
+	assert.True(t, os.IsNotExist(err), "the partially written file is removed")
+	assert.Equal(t, context.Canceled, localStorage.Delete(ctx, path))
+}
+
+func TestLocalMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uploadDir := filepath.Join(dir, "uploads")
+	mirrorDir := filepath.Join(dir, "mirror")
+	mirror := storage.NewLocalMirror(uploadDir, mirrorDir)
+	ctx := context.Background()
+	// When
+	err = mirror.Put(ctx, filepath.Join(uploadDir, "default", "a.txt"), strings.NewReader("hello"))
+	assert.Nil(t, err)
+	err = mirror.Move(ctx, filepath.Join(uploadDir, "default", "a.txt"), filepath.Join(uploadDir, "default", "b.txt"))
+	assert.Nil(t, err)
+	// Then
+	contents, err := ioutil.ReadFile(filepath.Join(mirrorDir, "default", "b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(contents))
+	var walked []string
+	err = mirror.Walk(ctx, uploadDir, func(path string, modTime time.Time) error {
+		walked = append(walked, path)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(uploadDir, "default", "b.txt")}, walked)
+	exists, err := mirror.Exists(ctx, filepath.Join(uploadDir, "default", "a.txt"))
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestShardedPath(t *testing.T) {
+	// sha256("report.pdf") starts with 6466
+	assert.Equal(t, filepath.Join("uploads", "64", "66", "report.pdf"), storage.ShardedPath("uploads", "report.pdf", 2))
+	assert.Equal(t, filepath.Join("uploads", "64", "report.pdf"), storage.ShardedPath("uploads", "report.pdf", 1))
+	assert.Equal(t, filepath.Join("uploads", "report.pdf"), storage.ShardedPath("uploads", "report.pdf", 0))
+	name, err := storage.NewBlobName()
+	assert.Nil(t, err)
+	assert.Len(t, name, 32)
+	otherName, err := storage.NewBlobName()
+	assert.Nil(t, err)
+	assert.NotEqual(t, name, otherName)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// localMirror stores the files under dir in mirrorDir instead, at the same relative path. Eg, a second disk or a
+// mounted network share used as a secondary backend.
+type localMirror struct {
+	localStorage
+	dir       string
+	mirrorDir string
+}
+
+func NewLocalMirror(dir string, mirrorDir string) Storage {
+	return localMirror{localStorage{}, absPath(dir), absPath(mirrorDir)}
+}
+
+// mirrorPath returns where the file at path is stored.
+func (s localMirror) mirrorPath(path string) (string, error) {
+	relativePath, err := filepath.Rel(s.dir, absPath(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.mirrorDir, relativePath), nil
+}
+
+func (s localMirror) Put(ctx context.Context, path string, contents io.Reader) error {
+	mirrorPath, err := s.mirrorPath(path)
+	if err != nil {
+		return err
+	}
+	return s.localStorage.Put(ctx, mirrorPath, contents)
+}
+
+func (s localMirror) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	mirrorPath, err := s.mirrorPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.localStorage.Open(ctx, mirrorPath)
+}
+
+func (s localMirror) Delete(ctx context.Context, path string) error {
+	mirrorPath, err := s.mirrorPath(path)
+	if err != nil {
+		return err
+	}
+	return s.localStorage.Delete(ctx, mirrorPath)
+}
+
+func (s localMirror) Move(ctx context.Context, fromPath string, toPath string) error {
+	fromMirrorPath, err := s.mirrorPath(fromPath)
+	if err != nil {
+		return err
+	}
+	toMirrorPath, err := s.mirrorPath(toPath)
+	if err != nil {
+		return err
+	}
+	return s.localStorage.Move(ctx, fromMirrorPath, toMirrorPath)
+}
+
+func (s localMirror) Exists(ctx context.Context, path string) (bool, error) {
+	mirrorPath, err := s.mirrorPath(path)
+	if err != nil {
+		return false, err
+	}
+	return s.localStorage.Exists(ctx, mirrorPath)
+}
+
+// Walk reports the files at the path they mirror.
+func (s localMirror) Walk(ctx context.Context, dir string, walkFn func(path string, modTime time.Time) error) error {
+	mirrorDir, err := s.mirrorPath(dir)
+	if err != nil {
+		return err
+	}
+	return s.localStorage.Walk(ctx, mirrorDir, func(path string, modTime time.Time) error {
+		relativePath, err := filepath.Rel(s.mirrorDir, path)
+		if err != nil {
+			return err
+		}
+		return walkFn(filepath.Join(s.dir, relativePath), modTime)
+	})
+}
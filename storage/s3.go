@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// S3Config locates a bucket of an S3 compatible store, eg AWS S3 or MinIO.
+type S3Config struct {
+	Endpoint        string // Eg, s3.amazonaws.com or localhost:9000
+	AccessKeyId     string
+	SecretAccessKey string
+	Region          string // Defaults to us-east-1
+	Bucket          string
+	DisableTls      bool
+}
+
+// s3Storage stores the files as objects. The object key of a file is its path relative to rootDir, so that the
+// paths used with the local storage can be used as is.
+type s3Storage struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	rootDir  string
+}
+
+func NewS3Storage(config S3Config, rootDir string) (Storage, error) {
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(config.Endpoint),
+		Region:           aws.String(region),
+		Credentials:      credentials.NewStaticCredentials(config.AccessKeyId, config.SecretAccessKey, ""),
+		DisableSSL:       aws.Bool(config.DisableTls),
+		S3ForcePathStyle: aws.Bool(true), // The stores other than AWS seldom support the bucket as sub domain
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+	return s3Storage{client, s3manager.NewUploaderWithClient(client), config.Bucket, absPath(rootDir)}, nil
+}
+
+func (s s3Storage) key(filePath string) (string, error) {
+	relativePath, err := filepath.Rel(s.rootDir, absPath(filePath))
+	if err != nil {
+		return "", err
+	}
+	if relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", filePath, s.rootDir)
+	}
+	return filepath.ToSlash(relativePath), nil
+}
+
+// Put uploads the contents in parts, since their size isn't known beforehand.
+func (s s3Storage) Put(ctx context.Context, filePath string, contents io.Reader) error {
+	key, err := s.key(filePath)
+	if err != nil {
+		return err
+	}
+	_, err = s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{Bucket: aws.String(s.bucket), Key: aws.String(key), Body: contents})
+	return err
+}
+
+func (s s3Storage) Open(ctx context.Context, filePath string) (io.ReadSeekCloser, error) {
+	key, err := s.key(filePath)
+	if err != nil {
+		return nil, err
+	}
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, pathError("open", filePath, err)
+	}
+	return &s3Object{ctx: ctx, storage: s, key: key, size: aws.Int64Value(head.ContentLength)}, nil
+}
+
+func (s s3Storage) Delete(ctx context.Context, filePath string) error {
+	key, err := s.key(filePath)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	return err
+}
+
+// Move copies the object then deletes the original, since objects can't be renamed.
+func (s s3Storage) Move(ctx context.Context, fromPath string, toPath string) error {
+	fromKey, err := s.key(fromPath)
+	if err != nil {
+		return err
+	}
+	toKey, err := s.key(toPath)
+	if err != nil {
+		return err
+	}
+	copySource := (&url.URL{Path: s.bucket + "/" + fromKey}).EscapedPath()
+	_, err = s.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(toKey), CopySource: aws.String(copySource)})
+	if err != nil {
+		return pathError("move", fromPath, err)
+	}
+	_, err = s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(fromKey)})
+	return err
+}
+
+func (s s3Storage) Exists(ctx context.Context, filePath string) (bool, error) {
+	key, err := s.key(filePath)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s s3Storage) Walk(ctx context.Context, dir string, walkFn func(path string, modTime time.Time) error) error {
+	prefix, err := s.key(dir)
+	if err != nil {
+		return err
+	}
+	if prefix == "." {
+		prefix = ""
+	} else {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+	var walkErr error
+	err = s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				walkErr = walkFn(filepath.Join(s.rootDir, filepath.FromSlash(aws.StringValue(object.Key))), aws.TimeValue(object.LastModified))
+				if walkErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+// s3Object reads an object from its current offset. Seeking closes the response being read, the next read requests
+// the object from the new offset.
+type s3Object struct {
+	ctx     context.Context
+	storage s3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		output, err := o.storage.client.GetObjectWithContext(o.ctx, &s3.GetObjectInput{Bucket: aws.String(o.storage.bucket), Key: aws.String(o.key),
+			Range: aws.String(fmt.Sprintf("bytes=%d-", o.offset))})
+		if err != nil {
+			return 0, err
+		}
+		o.body = output.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return o.offset, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// pathError makes the missing objects satisfy os.IsNotExist, like the missing files of the local storage.
+func pathError(op string, filePath string, err error) error {
+	if isNotFound(err) {
+		return &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	requestErr, ok := err.(awserr.RequestFailure)
+	return ok && requestErr.StatusCode() == http.StatusNotFound
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
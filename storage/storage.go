@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Storage stores the contents of the files. The readers returned by Open fail once the context is done.
+type Storage interface {
+	Put(ctx context.Context, path string, contents io.Reader) error // The contents are durable once it returns
+	Open(ctx context.Context, path string) (io.ReadSeekCloser, error)
+	Delete(ctx context.Context, path string) error
+	Move(ctx context.Context, fromPath string, toPath string) error
+	Exists(ctx context.Context, path string) (bool, error)
+	// Walk calls walkFn for each file under dir, in lexical order. It stops at the first error returned by walkFn.
+	Walk(ctx context.Context, dir string, walkFn func(path string, modTime time.Time) error) error
+}